@@ -0,0 +1,314 @@
+package serve2
+
+import "sync"
+
+// StaticProtocol is implemented by protocols matching a fixed set of prefixes,
+// such as proto.SimpleMatcher. The Server matches the prefixes of all such
+// protocols added through AddHandler using a shared prefix tree, consulted
+// once per read, instead of calling their Check. The result is the same as
+// that of a Check looking through the prefixes sorted by length. The
+// prefixes must not change after the protocol is added.
+type StaticProtocol interface {
+	Protocol
+
+	// Prefixes returns the prefixes matched by the protocol, or nil if its
+	// Check must be called instead.
+	Prefixes() [][]byte
+}
+
+// staticPrefixes returns the prefixes of protocols added through AddHandler
+// implementing StaticProtocol.
+func staticPrefixes(p ProtocolV2) ([][]byte, bool) {
+	a, ok := p.(protocolAdapter)
+	if !ok {
+		return nil, false
+	}
+	sp, ok := a.Protocol.(StaticProtocol)
+	if !ok {
+		return nil, false
+	}
+	prefixes := sp.Prefixes()
+	return prefixes, prefixes != nil
+}
+
+// prefixNode is a node in the prefix tree, reached by the bytes leading to it.
+type prefixNode struct {
+	children map[byte]*prefixNode
+
+	// ends holds the protocols with a prefix ending at this node.
+	ends []int
+
+	// below holds the protocols with prefixes further down the tree, with
+	// the length of their shortest such prefix.
+	below map[int]int
+
+	// needed is the smallest length in below of the protocols that may
+	// request it, or 0 if there are none. priority and largest are the
+	// highest priority and limit of those protocols.
+	needed   int
+	priority int
+	largest  int
+
+	// over holds the protocols in below with a shortest prefix longer than
+	// their limit, which are evicted when reaching the node.
+	over []int
+}
+
+// finish fills in below for the node and its children.
+func (n *prefixNode) finish(depth int) {
+	n.below = make(map[int]int)
+	for _, child := range n.children {
+		child.finish(depth + 1)
+
+		for _, index := range child.ends {
+			n.below[index] = depth + 1
+		}
+		for index, length := range child.below {
+			if l, ok := n.below[index]; !ok || length < l {
+				n.below[index] = length
+			}
+		}
+	}
+}
+
+// summarize fills in needed, priority, largest and over for the node and its
+// children, such that the protocols below the node can be handled as a group.
+func (n *prefixNode) summarize(candidates []candidate) {
+	n.needed, n.priority, n.largest, n.over = 0, 0, 0, nil
+	for index, length := range n.below {
+		c := &candidates[index]
+		if length > c.limit {
+			n.over = append(n.over, index)
+			continue
+		}
+		if n.needed == 0 {
+			n.needed, n.priority, n.largest = length, c.priority, c.limit
+			continue
+		}
+		if length < n.needed {
+			n.needed = length
+		}
+		if c.priority > n.priority {
+			n.priority = c.priority
+		}
+		if c.limit > n.largest {
+			n.largest = c.limit
+		}
+	}
+
+	for _, child := range n.children {
+		child.summarize(candidates)
+	}
+}
+
+// undecided checks if any static protocols may still match below the node.
+func (n *prefixNode) undecided() bool {
+	return n != nil && n.needed > 0
+}
+
+// overAt checks if the protocol is in over of the node.
+func (n *prefixNode) overAt(index int) bool {
+	if n == nil {
+		return false
+	}
+	for _, i := range n.over {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch holds the candidates of a set of protocols. Static protocols are
+// matched as a group through the prefix tree, while the other protocols are
+// copied for each connection from dynamic.
+type dispatch struct {
+	// protocols is a copy of the protocols the dispatch was built for, as
+	// they may be replaced in place.
+	protocols  []Protocol
+	candidates []candidate
+	static     []bool
+	dynamic    []candidate
+	root       *prefixNode
+
+	// maxPriority is the highest priority of the candidates.
+	maxPriority int
+
+	// bytesToCheck and maxBytesToCheck are the limits the candidates were
+	// set up with.
+	bytesToCheck    int
+	maxBytesToCheck int
+
+	// handlers holds buffers for the dynamic candidates of connections.
+	handlers sync.Pool
+}
+
+// newDispatch builds the prefix tree for the static protocols, and sets the
+// amount of bytes initially needed by the dynamic candidates.
+func newDispatch(protocols []Protocol, candidates []candidate) *dispatch {
+	d := &dispatch{
+		protocols:  append([]Protocol(nil), protocols...),
+		candidates: candidates,
+		static:     make([]bool, len(protocols)),
+		root:       &prefixNode{},
+	}
+
+	for i, c := range candidates {
+		if i == 0 || c.priority > d.maxPriority {
+			d.maxPriority = c.priority
+		}
+
+		prefixes, ok := staticPrefixes(c.protocol)
+		if !ok {
+			if r := c.protocol.Detect(nil, nil); r.Status == NeedMore {
+				c.needed = r.Needed
+			}
+			d.dynamic = append(d.dynamic, c)
+			continue
+		}
+		d.static[i] = true
+
+		for _, prefix := range prefixes {
+			n := d.root
+			for _, b := range prefix {
+				if n.children == nil {
+					n.children = make(map[byte]*prefixNode)
+				}
+				next, ok := n.children[b]
+				if !ok {
+					next = &prefixNode{}
+					n.children[b] = next
+				}
+				n = next
+			}
+			n.ends = append(n.ends, i)
+		}
+	}
+
+	d.root.finish(0)
+
+	for _, index := range d.root.ends {
+		// Empty prefixes match anything.
+		delete(d.root.below, index)
+	}
+
+	d.root.summarize(candidates)
+
+	for _, index := range d.root.ends {
+		// Empty prefixes match once anything has been read.
+		c := &candidates[index]
+		if !d.root.undecided() {
+			d.root.needed, d.root.priority, d.root.largest = 1, c.priority, c.limit
+			continue
+		}
+		d.root.needed = 1
+		if c.priority > d.root.priority {
+			d.root.priority = c.priority
+		}
+		if c.limit > d.root.largest {
+			d.root.largest = c.limit
+		}
+	}
+
+	size := len(d.dynamic)
+	d.handlers.New = func() interface{} {
+		handlers := make([]candidate, 0, size)
+		return &handlers
+	}
+
+	return d
+}
+
+// builtFor checks if the dispatch was built for the protocols, priorities and
+// limits of the server. A dispatch with protocols that cannot be compared is
+// never reused.
+func (d *dispatch) builtFor(s *Server) (built bool) {
+	if len(d.protocols) != len(s.Protocols) ||
+		d.bytesToCheck != s.BytesToCheck || d.maxBytesToCheck != s.MaxBytesToCheck {
+		return false
+	}
+
+	// Comparing protocols of a type that cannot be compared panics.
+	defer func() {
+		if recover() != nil {
+			built = false
+		}
+	}()
+
+	for i, p := range s.Protocols {
+		var priority int
+		if i < len(s.priorities) {
+			priority = s.priorities[i]
+		}
+		if d.protocols[i] != p || d.candidates[i].priority != priority {
+			return false
+		}
+	}
+	return true
+}
+
+// step follows the header from depth, starting at the node reached by the
+// bytes before it. It returns the node reached, or nil if the header left the
+// tree, and the best static protocol with a prefix ending on the way, or -1.
+// At depth 0, the empty prefixes of the root are included.
+func (d *dispatch) step(n *prefixNode, header []byte, depth int) (*prefixNode, int) {
+	found := -1
+	if depth == 0 {
+		found = d.ends(n, 0, found)
+	}
+
+	for ; n != nil && depth < len(header); depth++ {
+		n = n.children[header[depth]]
+		if n != nil {
+			found = d.ends(n, depth+1, found)
+		}
+	}
+
+	return n, found
+}
+
+// ends returns the best of found and the static protocols with a prefix
+// ending at the node, ranked by priority and then registration order.
+func (d *dispatch) ends(n *prefixNode, depth, found int) int {
+	for _, index := range n.ends {
+		c := &d.candidates[index]
+		if depth > c.limit {
+			// The protocol was evicted before getting this far.
+			continue
+		}
+		if found == -1 {
+			found = index
+			continue
+		}
+		if f := &d.candidates[found]; c.priority > f.priority ||
+			c.priority == f.priority && index < found {
+			found = index
+		}
+	}
+	return found
+}
+
+// getHandlers returns the dynamic candidates for a connection.
+func (d *dispatch) getHandlers() *[]candidate {
+	handlers := d.handlers.Get().(*[]candidate)
+	*handlers = append((*handlers)[:0], d.dynamic...)
+	return handlers
+}
+
+// putHandlers returns the dynamic candidates of a connection.
+func (d *dispatch) putHandlers(handlers *[]candidate) {
+	d.handlers.Put(handlers)
+}
+
+// dispatcher returns the dispatch for the current protocols.
+func (s *Server) dispatcher() *dispatch {
+	s.dispatchMu.Lock()
+	defer s.dispatchMu.Unlock()
+
+	if s.dispatch == nil || !s.dispatch.builtFor(s) {
+		s.dispatch = newDispatch(s.Protocols, s.candidates())
+		s.dispatch.bytesToCheck = s.BytesToCheck
+		s.dispatch.maxBytesToCheck = s.MaxBytesToCheck
+	}
+	return s.dispatch
+}
@@ -0,0 +1,232 @@
+package serve2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/serve2/proto"
+)
+
+// dynamicProtocol hides the prefixes of a StaticProtocol, forcing its Check
+// to be called.
+type dynamicProtocol struct {
+	Protocol
+}
+
+func testMatchers() []Protocol {
+	return []Protocol{
+		proto.NewSimpleMatcher(proto.HTTPMethods, nil),
+		proto.NewMultiProxy([][]byte{[]byte("SSH-"), []byte("S")}, "tcp", "localhost:22"),
+		proto.NewProxy([]byte("GET /ws"), "tcp", "localhost:80"),
+		proto.NewProxy(nil, "tcp", "localhost:80"),
+		proto.NewEcho(),
+		proto.NewDiscard(),
+	}
+}
+
+func TestDispatchLookup(t *testing.T) {
+	s := New()
+	s.AddHandlers(testMatchers()...)
+	fold := proto.NewEcho()
+	fold.FoldCase = true
+	s.AddHandlers(&dynamicProtocol{proto.NewEcho()}, fold)
+
+	d := s.dispatcher()
+	if d.static[len(s.Protocols)-2] || d.static[len(s.Protocols)-1] {
+		t.Errorf("dynamic protocol registered as static")
+	}
+
+	headers := []string{
+		"", "G", "GE", "GET", "GET /", "GET /ws", "GET /wss", "S", "SSH-2.0",
+		"C", "CO", "CONNACT", "E", "ECH", "ECHO", "DIS", "DISCARD", "\x00",
+	}
+
+	for _, header := range headers {
+		n, found := d.step(d.root, []byte(header), 0)
+
+		expectedFound, needed := -1, 0
+		for i, c := range d.candidates {
+			if !d.static[i] {
+				continue
+			}
+
+			expected := c.protocol.Detect([]byte(header), nil)
+			switch expected.Status {
+			case Match:
+				if expectedFound == -1 {
+					expectedFound = i
+				}
+				continue
+			case NeedMore:
+				if needed == 0 || expected.Needed < needed {
+					needed = expected.Needed
+				}
+			}
+
+			result := NotMatched()
+			if n != nil {
+				if length, ok := n.below[i]; ok {
+					result = NeedBytes(length)
+				}
+			}
+			if result != expected {
+				t.Errorf("%q on %v was %+v, expected %+v", header, c.protocol, result, expected)
+			}
+		}
+
+		if found != expectedFound {
+			t.Errorf("%q matched %d, expected %d", header, found, expectedFound)
+		}
+		if expectedFound == -1 && (n.undecided() != (needed > 0) || n != nil && n.needed != needed) {
+			t.Errorf("%q left %v undecided, expected %d", header, n, needed)
+		}
+	}
+}
+
+func TestDispatchRebuild(t *testing.T) {
+	handled := make(chan *testProtocol, 1)
+	s := New()
+	s.AddHandler(proto.NewEcho())
+
+	first := s.dispatcher()
+	if s.dispatcher() != first {
+		t.Errorf("dispatch rebuilt without changes")
+	}
+
+	s.AddProtocol(&testProtocol{name: "dynamic", prefix: []byte("DYN"), confidence: ConfidenceCertain, handled: handled})
+	if s.dispatcher() == first {
+		t.Errorf("dispatch not rebuilt after adding protocol")
+	}
+
+	if p := serveOne(t, s, context.Background(), "DYNAMIC", handled); p.name != "dynamic" {
+		t.Errorf("handled by %s, expected dynamic", p.name)
+	}
+
+	second := s.dispatcher()
+	s.Protocols[1] = &legacyProtocol{testProtocol{name: "replaced", prefix: []byte("DYN"), confidence: ConfidenceCertain, handled: handled}}
+	if s.dispatcher() == second {
+		t.Errorf("dispatch not rebuilt after replacing protocol")
+	}
+
+	if p := serveOne(t, s, context.Background(), "DYNAMIC", handled); p.name != "replaced" {
+		t.Errorf("handled by %s, expected replaced", p.name)
+	}
+}
+
+// prefixProtocol is a Protocol of a type that cannot be compared.
+type prefixProtocol []byte
+
+func (p prefixProtocol) String() string {
+	return string(p)
+}
+
+func (p prefixProtocol) Check(header []byte, _ []interface{}) (bool, int) {
+	return bytes.HasPrefix(header, p), 0
+}
+
+func (p prefixProtocol) Handle(c net.Conn) (net.Conn, error) {
+	return nil, nil
+}
+
+func TestDispatchIncomparable(t *testing.T) {
+	s := New()
+	s.AddHandler(prefixProtocol("X"))
+	s.AddProtocol(AdaptProtocol(prefixProtocol("Y")))
+
+	// Protocols that cannot be compared cannot be checked for changes.
+	if first := s.dispatcher(); s.dispatcher() == first {
+		t.Errorf("dispatch reused with incomparable protocol")
+	}
+}
+
+func TestDispatchEvict(t *testing.T) {
+	s := New()
+	s.BytesToCheck = 4
+	s.AddHandler(proto.NewSimpleMatcher([][]byte{[]byte("ABCDEFGH")}, nil))
+
+	var stats DetectionStats
+	s.Profile = func(_ net.Conn, s DetectionStats) { stats = s }
+
+	err := s.HandleConn(&benchConn{r: bytes.NewReader([]byte("ABCDEFGH")), chunk: 128}, nil)
+	if err != ErrGreedyHandler || stats.Evicted[0] != ErrGreedyHandler {
+		t.Errorf("returned %v, evicted %v, expected %v", err, stats.Evicted, ErrGreedyHandler)
+	}
+}
+
+func TestDispatchEmptyPrefix(t *testing.T) {
+	handled := make(chan string, 1)
+	s := New()
+	s.AddHandler(proto.NewSimpleMatcher([][]byte{nil}, func(net.Conn) (net.Conn, error) {
+		handled <- "empty"
+		return nil, nil
+	}))
+
+	s.HandleConn(&benchConn{r: bytes.NewReader([]byte("anything")), chunk: 128}, nil)
+	select {
+	case <-handled:
+	default:
+		t.Errorf("empty prefix did not match")
+	}
+}
+
+// benchConn returns a header in chunks, recording the size of reads.
+type benchConn struct {
+	net.Conn
+	r     *bytes.Reader
+	chunk int
+	reads []int
+}
+
+func (c *benchConn) Read(b []byte) (int, error) {
+	if c.reads != nil {
+		c.reads = append(c.reads, len(b))
+	}
+	if len(b) > c.chunk {
+		b = b[:c.chunk]
+	}
+	return c.r.Read(b)
+}
+
+func (c *benchConn) Close() error                     { return nil }
+func (c *benchConn) RemoteAddr() net.Addr             { return nil }
+func (c *benchConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *benchConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *benchConn) SetDeadline(time.Time) error      { return nil }
+
+func benchmarkDispatch(b *testing.B, static bool, chunk int) {
+	s := New()
+	for i := 0; i < 300; i++ {
+		sm := proto.NewMultiProxy([][]byte{
+			[]byte(fmt.Sprintf("GET /%03d/", i)),
+			[]byte(fmt.Sprintf("POST /%03d/", i)),
+			[]byte(fmt.Sprintf("HEAD /%03d/", i)),
+			[]byte(fmt.Sprintf("OPTIONS /%03d/", i)),
+		}, "tcp", "localhost:80")
+		sm.Handler = func(net.Conn) (net.Conn, error) { return nil, nil }
+
+		var p Protocol = sm
+		if !static {
+			p = &dynamicProtocol{p}
+		}
+		s.AddHandler(p)
+	}
+
+	// The last protocol matches, so that all of them are considered
+	header := []byte("OPTIONS /299/ HTTP/1.1\r\n")
+	s.dispatcher()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.HandleConn(&benchConn{r: bytes.NewReader(header), chunk: chunk}, nil)
+	}
+}
+
+func BenchmarkDispatchStatic(b *testing.B)         { benchmarkDispatch(b, true, 128) }
+func BenchmarkDispatchDynamic(b *testing.B)        { benchmarkDispatch(b, false, 128) }
+func BenchmarkDispatchStaticTrickle(b *testing.B)  { benchmarkDispatch(b, true, 1) }
+func BenchmarkDispatchDynamicTrickle(b *testing.B) { benchmarkDispatch(b, false, 1) }
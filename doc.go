@@ -6,6 +6,24 @@ Protocols are defined as handlers that, given the amount of header bytes they
 require, can check if a header matches the protocol, as well as handle the
 connection itself afterwards.
 
+Protocols implementing ProtocolV2 report their detection as a Result, with a
+confidence used to choose between ambiguous matches, and receive a
+context.Context when handling the connection. Protocols only implementing the
+original Protocol interface are adapted automatically, and match with
+ConfidenceCertain, meaning that the first of them to match is used.
+
+Protocols can be registered with a priority, which takes precedence over
+confidence. Ties are broken by the length of the match, and then by
+registration order. Server.Explain reports which protocol would be selected
+for a header, and why.
+
+Protocols are only checked once the amount of bytes they requested has been
+read, with the ReadPolicy of the Server deciding whether to read ahead or only
+what is needed, and Server.Profile reporting the work done per connection.
+Protocols matching a fixed set of prefixes, such as proto.SimpleMatcher, can
+implement StaticProtocol, in which case their prefixes are all matched at once
+using a shared prefix tree, avoiding a check per protocol.
+
 The read bytes from the header are provided to the handler by ProxyConn, that
 simulates the first few reads until the header buffer is empty, at which point
 it resumes normal operation.
@@ -0,0 +1,45 @@
+package serve2
+
+// Lookahead is implemented by protocols declaring how many bytes they may
+// need to decide, such as protocols validating a complete line or packet.
+// The header buffer of a connection grows up to the largest lookahead of the
+// remaining protocols, bounded by MaxBytesToCheck of the Server. Protocols
+// not implementing Lookahead are limited to BytesToCheck.
+type Lookahead interface {
+	// MaxLookahead returns the maximum amount of bytes the protocol may
+	// request.
+	MaxLookahead() int
+}
+
+// lookahead returns the amount of bytes the protocol may request, and if it
+// was declared by the protocol. Protocols added through AddHandler are
+// unwrapped.
+func (s *Server) lookahead(p ProtocolV2) (int, bool) {
+	var l Lookahead
+	switch p := p.(type) {
+	case Lookahead:
+		l = p
+	case protocolAdapter:
+		l, _ = p.Protocol.(Lookahead)
+	}
+
+	limit, declared := s.BytesToCheck, false
+	if l != nil {
+		if max := l.MaxLookahead(); max > 0 {
+			limit, declared = max, true
+		}
+	}
+
+	if hard := s.maxBytesToCheck(); limit > hard {
+		limit = hard
+	}
+	return limit, declared
+}
+
+// maxBytesToCheck returns MaxBytesToCheck, or BytesToCheck if not set.
+func (s *Server) maxBytesToCheck() int {
+	if s.MaxBytesToCheck > 0 {
+		return s.MaxBytesToCheck
+	}
+	return s.BytesToCheck
+}
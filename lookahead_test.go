@@ -0,0 +1,114 @@
+package serve2
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// lookaheadProtocol is a legacyProtocol declaring a lookahead.
+type lookaheadProtocol struct {
+	legacyProtocol
+	max int
+}
+
+func (p *lookaheadProtocol) MaxLookahead() int {
+	return p.max
+}
+
+func TestLookahead(t *testing.T) {
+	prefix := bytes.Repeat([]byte("A"), 200)
+	payload := append(append([]byte{}, prefix...), "BBBB"...)
+
+	tests := []struct {
+		name            string
+		lookahead       int
+		maxBytesToCheck int
+		err             error
+		evicted         error
+	}{
+		{"default", 0, DefaultMaxBytesToCheck, ErrGreedyHandler, ErrGreedyHandler},
+		{"sufficient", 256, DefaultMaxBytesToCheck, nil, nil},
+		{"exact", 200, DefaultMaxBytesToCheck, nil, nil},
+		{"insufficient", 150, DefaultMaxBytesToCheck, ErrLookaheadExceeded, ErrLookaheadExceeded},
+		{"capped", 256, 180, ErrGreedyHandler, ErrGreedyHandler},
+		{"unset", 256, 0, ErrGreedyHandler, ErrGreedyHandler},
+	}
+
+	for _, test := range tests {
+		for _, chunk := range []int{1, 64, 512} {
+			handled := make(chan *testProtocol, 1)
+			s := New()
+			s.MaxBytesToCheck = test.maxBytesToCheck
+			s.AddHandler(&lookaheadProtocol{
+				legacyProtocol{testProtocol{name: "long", prefix: prefix, confidence: ConfidenceCertain, handled: handled}},
+				test.lookahead,
+			})
+
+			var stats DetectionStats
+			s.Profile = func(_ net.Conn, s DetectionStats) { stats = s }
+
+			err := s.HandleConn(&benchConn{r: bytes.NewReader(payload), chunk: chunk}, nil)
+			if err != test.err {
+				t.Errorf("%s, chunk %d: handling returned %v, expected %v", test.name, chunk, err, test.err)
+			}
+			if stats.Evicted[0] != test.evicted {
+				t.Errorf("%s, chunk %d: evicted with %v, expected %v", test.name, chunk, stats.Evicted[0], test.evicted)
+			}
+			if test.err == nil && len(handled) != 1 {
+				t.Errorf("%s, chunk %d: not handled", test.name, chunk)
+			}
+		}
+	}
+}
+
+// readingProtocol is a Protocol that never matches, reading from the
+// connections it handles and reporting the result.
+type readingProtocol struct {
+	read chan error
+}
+
+func (p *readingProtocol) String() string {
+	return "reading"
+}
+
+func (p *readingProtocol) Check(header []byte, hints []interface{}) (bool, int) {
+	return false, 0
+}
+
+func (p *readingProtocol) Handle(c net.Conn) (net.Conn, error) {
+	b := make([]byte, 512)
+	n, err := c.Read(b)
+	if err == nil && n == 0 {
+		err = io.ErrNoProgress
+	}
+	p.read <- err
+	return nil, nil
+}
+
+func TestEvictionDefault(t *testing.T) {
+	prefix := bytes.Repeat([]byte("A"), 200)
+	payload := append(append([]byte{}, prefix...), "BBBB"...)
+
+	s := New()
+	s.AddHandler(&legacyProtocol{testProtocol{name: "long", prefix: prefix, confidence: ConfidenceCertain}})
+	def := &readingProtocol{read: make(chan error, 1)}
+	s.DefaultProtocol = def
+
+	if err := s.HandleConn(&benchConn{r: bytes.NewReader(payload), chunk: 512}, nil); err != nil {
+		t.Fatalf("handling returned %v, expected nil", err)
+	}
+	if err := <-def.read; err != nil {
+		t.Errorf("default protocol read failed with %v, expected the header", err)
+	}
+}
+
+func TestExplainLookahead(t *testing.T) {
+	s := New()
+	s.AddHandler(&lookaheadProtocol{legacyProtocol{testProtocol{name: "long", prefix: bytes.Repeat([]byte("A"), 200)}}, 256})
+
+	if e := s.Explain(bytes.Repeat([]byte("A"), 150), nil); !e.Waiting {
+		t.Errorf("explanation not waiting for protocol within its lookahead: %+v", e)
+	}
+}
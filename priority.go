@@ -0,0 +1,243 @@
+package serve2
+
+import "fmt"
+
+// candidate is a registered protocol taking part in detection.
+type candidate struct {
+	protocol ProtocolV2
+	priority int
+	index    int
+
+	// needed is the amount of bytes requested by the candidate.
+	needed int
+
+	// limit is the amount of bytes the candidate may request, and declared
+	// is set if it comes from the Lookahead of the candidate.
+	limit    int
+	declared bool
+}
+
+// match is a candidate that matched.
+type match struct {
+	candidate
+	result Result
+
+	// length is the length of the match, being Result.Length if set, and
+	// otherwise the amount of header bytes the match was made with.
+	length int
+}
+
+func newMatch(c candidate, r Result, headerLength int) *match {
+	m := &match{candidate: c, result: r, length: r.Length}
+	if m.length == 0 {
+		m.length = headerLength
+	}
+	return m
+}
+
+// outranks checks if the match ranks above other, by priority, then
+// confidence, then length, and finally registration order. The reason is
+// returned for Explain.
+func (m *match) outranks(other *match) (bool, string) {
+	switch {
+	case m.priority != other.priority:
+		return m.priority > other.priority, "priority"
+	case m.result.Confidence != other.result.Confidence:
+		return m.result.Confidence > other.result.Confidence, "confidence"
+	case m.length != other.length:
+		return m.length > other.length, "longer match"
+	default:
+		return m.index < other.index, "registration order"
+	}
+}
+
+// contested checks if any of the undecided candidates, or the static
+// protocols below the node, could still outrank the match. Candidates with a
+// higher priority always can, while candidates with the same priority only can
+// if the match is not certain.
+func (m *match) contested(undecided []candidate, n *prefixNode) bool {
+	if n.undecided() && m.outprioritized(n.priority) {
+		return true
+	}
+	for _, c := range undecided {
+		if m.outprioritized(c.priority) {
+			return true
+		}
+	}
+	return false
+}
+
+// outprioritized checks if a candidate with the priority could outrank the
+// match.
+func (m *match) outprioritized(priority int) bool {
+	return priority > m.priority ||
+		priority == m.priority && m.result.Confidence < ConfidenceCertain
+}
+
+// unbeaten checks if the match is certain and no candidate has a higher
+// priority, in which case nothing can outrank it and it is used without
+// calling the remaining candidates.
+func (m *match) unbeaten(maxPriority int) bool {
+	return m.result.Confidence >= ConfidenceCertain && m.priority >= maxPriority
+}
+
+// rank returns the best of the current best match, which may be nil, and the
+// new match. A match that nothing can outrank always replaces the current
+// best, as the dynamic handlers are only called up to such a match, and thus
+// registered before it.
+func (d *dispatch) rank(best, m *match) *match {
+	if best == nil || m.unbeaten(d.maxPriority) {
+		return m
+	}
+	if ok, _ := m.outranks(best); ok {
+		return m
+	}
+	return best
+}
+
+// candidates returns the registered protocols with their priorities.
+func (s *Server) candidates() []candidate {
+	cs := make([]candidate, len(s.Protocols))
+	for i, p := range s.Protocols {
+		cs[i] = candidate{protocol: AdaptProtocol(p), index: i}
+		cs[i].limit, cs[i].declared = s.lookahead(cs[i].protocol)
+		if i < len(s.priorities) {
+			cs[i].priority = s.priorities[i]
+		}
+	}
+	return cs
+}
+
+// Explanation describes the outcome of detection for a header.
+type Explanation struct {
+	// Protocol is the selected protocol, or nil if nothing matched.
+	Protocol ProtocolV2
+	Result   Result
+
+	// Reason describes why Protocol was selected.
+	Reason string
+
+	// Waiting is set if undecided protocols could still outrank Protocol,
+	// in which case the Server would wait for more data before deciding.
+	Waiting bool
+
+	// Results holds the results of all protocols, in registration order.
+	Results []Result
+}
+
+// Explain reports which protocol the Server would select for the header and
+// hints, if the header was all the client sent before waiting, and why. The
+// header is given to the protocols in the same rounds as HandleConnContext
+// would read it, limited by BytesToCheck, MaxBytesToCheck, lookahead and
+// ReadPolicy.
+func (s *Server) Explain(header []byte, hints []interface{}) Explanation {
+	var (
+		e           Explanation
+		best        *match
+		runnerUp    *match
+		candidates  = s.candidates()
+		undecided   = candidates
+		maxPriority int
+		unbeaten    bool
+		ignored     bool
+		size        = s.initialBytesToCheck()
+		view        []byte
+	)
+
+	e.Results = make([]Result, len(candidates))
+	for i := range candidates {
+		c := &candidates[i]
+		if i == 0 || c.priority > maxPriority {
+			maxPriority = c.priority
+		}
+		e.Results[i] = c.protocol.Detect(nil, nil)
+		if e.Results[i].Status == NeedMore {
+			c.needed = e.Results[i].Needed
+		}
+	}
+
+	for len(undecided) > 0 {
+		want, largest := smallestNeeded(undecided, nil, len(view))
+		if want > largest {
+			// The remaining protocols cannot be given more
+			undecided = nil
+			break
+		}
+		if want > size {
+			size *= 2
+			if size < want {
+				size = want
+			}
+			if size > largest {
+				size = largest
+			}
+		}
+
+		limit := size
+		if s.ReadPolicy == ReadExact {
+			limit = want
+		}
+		if limit > len(header) {
+			limit = len(header)
+		}
+		if limit <= len(view) || limit < want {
+			// The Server would wait for more data
+			break
+		}
+		view = header[:limit]
+
+		remaining := make([]candidate, 0, len(undecided))
+		for _, c := range undecided {
+			result := c.protocol.Detect(view, hints)
+			e.Results[c.index] = result
+
+			switch {
+			case unbeaten && c.index > best.index:
+				// The Server does not call the remaining protocols.
+				ignored = ignored || result.Status == Match
+			case result.Status == Match:
+				m := newMatch(c, result, len(view))
+				if best == nil {
+					best = m
+				} else if ok, _ := m.outranks(best); ok || m.unbeaten(maxPriority) {
+					best, runnerUp = m, best
+				} else if runnerUp == nil {
+					runnerUp = m
+				} else if ok, _ := m.outranks(runnerUp); ok {
+					runnerUp = m
+				}
+				unbeaten = best.unbeaten(maxPriority)
+			case result.Status == NeedMore && result.Needed > len(view) && result.Needed <= c.limit:
+				c.needed = result.Needed
+				remaining = append(remaining, c)
+			}
+		}
+		undecided = remaining
+
+		if unbeaten || best != nil && !best.contested(undecided, nil) {
+			break
+		}
+	}
+
+	if best == nil {
+		e.Reason = "no protocol matched"
+		e.Waiting = len(undecided) > 0
+		return e
+	}
+
+	e.Protocol = best.protocol
+	e.Result = best.result
+	e.Waiting = best.contested(undecided, nil)
+
+	switch {
+	case runnerUp == nil && ignored:
+		e.Reason = "first certain match"
+	case runnerUp == nil:
+		e.Reason = "only match"
+	default:
+		_, reason := best.outranks(runnerUp)
+		e.Reason = fmt.Sprintf("outranks %v by %s", runnerUp.protocol, reason)
+	}
+
+	return e
+}
@@ -0,0 +1,121 @@
+package serve2
+
+import (
+	"context"
+	"testing"
+)
+
+// lengthProtocol is a testProtocol reporting the prefix length as match
+// length.
+type lengthProtocol struct {
+	testProtocol
+}
+
+func (p *lengthProtocol) Detect(header []byte, hints []interface{}) Result {
+	r := p.testProtocol.Detect(header, hints)
+	if r.Status == Match {
+		r.Length = len(p.prefix)
+	}
+	return r
+}
+
+func TestPriority(t *testing.T) {
+	handled := make(chan *testProtocol, 1)
+	s := New()
+	s.AddHandlerPriority(&legacyProtocol{testProtocol{name: "low", prefix: []byte("GET"), handled: handled}}, -1)
+	s.AddHandler(&legacyProtocol{testProtocol{name: "default", prefix: []byte("GE"), handled: handled}})
+	s.AddProtocolPriority(&testProtocol{name: "rtsp", prefix: []byte("OPTIONS rtsp"), confidence: ConfidenceLikely, handled: handled}, 1)
+	s.AddHandler(&legacyProtocol{testProtocol{name: "options", prefix: []byte("OPT"), handled: handled}})
+
+	tests := []struct {
+		payload string
+		name    string
+	}{
+		{"GET / HTTP/1.1\r\n", "default"},
+		{"OPTIONS rtsp://example.com RTSP/1.0\r\n", "rtsp"},
+		{"OPTIONS * HTTP/1.1\r\n", "options"},
+	}
+
+	for _, test := range tests {
+		p := serveOne(t, s, context.Background(), test.payload, handled)
+		if p.name != test.name {
+			t.Errorf("%q handled by %s, expected %s", test.payload, p.name, test.name)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	short := &lengthProtocol{testProtocol{name: "short", prefix: []byte("GE"), confidence: ConfidenceCertain}}
+	long := &lengthProtocol{testProtocol{name: "long", prefix: []byte("GET"), confidence: ConfidenceCertain}}
+	likely := &testProtocol{name: "likely", prefix: []byte("G"), confidence: ConfidenceLikely}
+	first := &testProtocol{name: "first", prefix: []byte("POST"), confidence: ConfidenceCertain}
+	second := &testProtocol{name: "second", prefix: []byte("POST"), confidence: ConfidenceCertain}
+	high := &testProtocol{name: "high", prefix: []byte("PUT / HTTP/1.1"), confidence: ConfidenceCertain}
+
+	s := New()
+	s.AddProtocol(short)
+	s.AddProtocol(long)
+	s.AddProtocol(likely)
+	s.AddProtocol(first)
+	s.AddProtocol(second)
+	s.AddProtocolPriority(high, 1)
+
+	tests := []struct {
+		header   string
+		protocol ProtocolV2
+		reason   string
+		waiting  bool
+	}{
+		{"GET / HTTP/1.1\r\n", long, "outranks short by longer match", false},
+		{"GO", likely, "only match", false},
+		{"POST / HTTP/1.1\r\n", first, "outranks second by registration order", false},
+		{"PUT", nil, "no protocol matched", true},
+		{"GE", short, "outranks likely by confidence", false},
+		{"X", nil, "no protocol matched", false},
+	}
+
+	for _, test := range tests {
+		e := s.Explain([]byte(test.header), nil)
+		if e.Protocol != test.protocol || e.Reason != test.reason || e.Waiting != test.waiting {
+			t.Errorf("%q explained as %v (%s, waiting %t), expected %v (%s, waiting %t)",
+				test.header, e.Protocol, e.Reason, e.Waiting, test.protocol, test.reason, test.waiting)
+		}
+		if len(e.Results) != len(s.Protocols) {
+			t.Errorf("%q explained with %d results, expected %d", test.header, len(e.Results), len(s.Protocols))
+		}
+	}
+}
+
+func TestExplainFirstCertain(t *testing.T) {
+	short := &lengthProtocol{testProtocol{name: "short", prefix: []byte("GE"), confidence: ConfidenceCertain}}
+	long := &lengthProtocol{testProtocol{name: "long", prefix: []byte("GET"), confidence: ConfidenceCertain}}
+
+	s := New()
+	s.AddProtocol(short)
+	s.AddProtocol(long)
+
+	e := s.Explain([]byte("GET / HTTP/1.1\r\n"), nil)
+	if e.Protocol != short || e.Reason != "first certain match" || len(e.Results) != 2 {
+		t.Errorf("explained as %v (%s) with %d results, expected short (first certain match)",
+			e.Protocol, e.Reason, len(e.Results))
+	}
+}
+
+func TestExplainBytesToCheck(t *testing.T) {
+	long := &testProtocol{name: "long", prefix: []byte("ABCDEFGH"), confidence: ConfidenceCertain}
+	short := &testProtocol{name: "short", prefix: []byte("ABC"), confidence: ConfidenceLikely}
+
+	s := New()
+	s.BytesToCheck = 4
+	s.MaxBytesToCheck = 16
+	s.AddProtocol(long)
+	s.AddProtocol(short)
+
+	// The Server evicts long, which requests more than BytesToCheck, before
+	// it has its prefix.
+	e := s.Explain([]byte("ABCDEFGH"), nil)
+	if e.Protocol != short || e.Reason != "only match" || e.Waiting {
+		t.Errorf("explained as %v (%s, waiting %t), expected short (only match, waiting false)",
+			e.Protocol, e.Reason, e.Waiting)
+	}
+}
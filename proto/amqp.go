@@ -0,0 +1,123 @@
+package proto
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// AMQP protocol IDs used in AMQP 1.0 protocol headers.
+const (
+	AMQPProtocolAMQP = 0
+	AMQPProtocolTLS  = 2
+	AMQPProtocolSASL = 3
+)
+
+var amqpPrefix = []byte("AMQP")
+
+// AMQPHeader is the parsed protocol header sent by an AMQP client. It is added
+// as a hint to connections handled by AMQP.
+type AMQPHeader struct {
+	// ProtocolID is the protocol ID of AMQP 1.0 headers. It is zero for
+	// earlier versions.
+	ProtocolID byte
+	Major      byte
+	Minor      byte
+	Revision   byte
+}
+
+// String returns the version in the usual notation, such as "0-9-1" or "1.0.0".
+func (h *AMQPHeader) String() string {
+	if h.Major == 1 {
+		return fmt.Sprintf("%d.%d.%d", h.Major, h.Minor, h.Revision)
+	}
+	return fmt.Sprintf("%d-%d-%d", h.Major, h.Minor, h.Revision)
+}
+
+// ParseAMQPHeader parses the 8 byte protocol header, supporting AMQP 0-8, 0-9,
+// 0-9-1 and 1.0.
+func ParseAMQPHeader(header []byte) (*AMQPHeader, error) {
+	if len(header) < 8 || !bytes.HasPrefix(header, amqpPrefix) {
+		return nil, fmt.Errorf("amqp: invalid protocol header %q", header)
+	}
+
+	switch {
+	case header[4] == 0 && header[5] == 0 && header[6] == 9 && header[7] == 1:
+		// 0-9-1
+		return &AMQPHeader{Major: 0, Minor: 9, Revision: 1}, nil
+	case header[4] == 1 && header[5] == 1 && header[6] == 0 && header[7] == 9:
+		// 0-9, with class 1 and instance 1
+		return &AMQPHeader{Major: 0, Minor: 9}, nil
+	case header[4] == 1 && header[5] == 1 && header[6] == 8 && header[7] == 0:
+		// 0-8, with class 1 and instance 1
+		return &AMQPHeader{Major: 0, Minor: 8}, nil
+	case header[5] == 1 && header[6] == 0 && header[7] == 0 &&
+		(header[4] == AMQPProtocolAMQP || header[4] == AMQPProtocolTLS || header[4] == AMQPProtocolSASL):
+		// 1.0.0
+		return &AMQPHeader{ProtocolID: header[4], Major: 1}, nil
+	default:
+		return nil, fmt.Errorf("amqp: unsupported protocol header %q", header)
+	}
+}
+
+// AMQP detects AMQP clients by their protocol header. The *AMQPHeader is added
+// as a hint to the connection given to the handler.
+type AMQP struct {
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (a *AMQP) String() string {
+	return a.Description
+}
+
+// Check verifies the protocol header.
+func (a *AMQP) Check(header []byte, _ []interface{}) (bool, int) {
+	if len(header) < 8 {
+		if len(header) > len(amqpPrefix) {
+			header = header[:len(amqpPrefix)]
+		}
+		if !bytes.HasPrefix(amqpPrefix, header) {
+			return false, 0
+		}
+		return false, 8
+	}
+
+	_, err := ParseAMQPHeader(header)
+	return err == nil, 0
+}
+
+// Handle adds the protocol header as a hint and calls the handler.
+func (a *AMQP) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, 8, a.Check)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	h, err := ParseAMQPHeader(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(h))
+	return a.Handler(pc)
+}
+
+// NewAMQP returns an AMQP with the provided handler.
+func NewAMQP(handler func(net.Conn) (net.Conn, error)) *AMQP {
+	return &AMQP{
+		Handler:     handler,
+		Description: "AMQP",
+	}
+}
+
+// NewAMQPProxy returns an AMQP set up to call DialAndProxy.
+func NewAMQPProxy(proto, dest string) *AMQP {
+	a := NewAMQP(ProxyHandler(proto, dest))
+	a.Description = fmt.Sprintf("AMQP [dest: %s]", dest)
+	return a
+}
@@ -0,0 +1,64 @@
+package proto
+
+import (
+	"testing"
+)
+
+func TestAMQP(t *testing.T) {
+	h := NewAMQP(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 8},
+		{[]byte("AM"), false, 8},
+		{[]byte("AMQP\x00"), false, 8},
+		{[]byte("AMQX"), false, 0},
+		{[]byte("GET / HTTP/1.1"), false, 0},
+		{[]byte("AMQP\x00\x00\x09\x01"), true, 0},
+		{[]byte("AMQP\x01\x01\x00\x09"), true, 0},
+		{[]byte("AMQP\x01\x01\x08\x00"), true, 0},
+		{[]byte("AMQP\x00\x01\x00\x00"), true, 0},
+		{[]byte("AMQP\x03\x01\x00\x00"), true, 0},
+		{[]byte("AMQP\x01\x01\x00\x00"), false, 0},
+		{[]byte("AMQP\x00\x00\x09\x02"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestParseAMQPHeader(t *testing.T) {
+	tests := []struct {
+		payload string
+		version string
+		id      byte
+	}{
+		{"AMQP\x00\x00\x09\x01", "0-9-1", 0},
+		{"AMQP\x01\x01\x08\x00", "0-8-0", 0},
+		{"AMQP\x03\x01\x00\x00", "1.0.0", AMQPProtocolSASL},
+	}
+
+	for _, test := range tests {
+		h, err := ParseAMQPHeader([]byte(test.payload))
+		if err != nil {
+			t.Errorf("parse failed for %q: %v", test.payload, err)
+			continue
+		}
+		if h.String() != test.version || h.ProtocolID != test.id {
+			t.Errorf("%q parsed as %v (id %d), expected %v (id %d)",
+				test.payload, h, h.ProtocolID, test.version, test.id)
+		}
+	}
+}
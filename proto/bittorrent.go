@@ -0,0 +1,124 @@
+package proto
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// BitTorrent field constants
+const (
+	BitTorrentProtocol     = "\x13BitTorrent protocol"
+	BitTorrentHandshakeLen = 68
+
+	// bitTorrentPeerIDOffset is the end of the info hash, after which peers
+	// may hold back their peer ID until the remote handshake arrives.
+	bitTorrentPeerIDOffset = 48
+)
+
+var bitTorrentPrefix = []byte(BitTorrentProtocol)
+
+// BitTorrentHandshake is the handshake sent by a BitTorrent peer. It is added
+// as a hint to connections handled by BitTorrent. PeerID is left zero if it was
+// not sent along with the info hash.
+type BitTorrentHandshake struct {
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+// BitTorrent detects unencrypted BitTorrent peers by their handshake. The
+// *BitTorrentHandshake is added as a hint to the connection given to the
+// handler.
+//
+// The handler decides what happens to the connection, such as DropHandler or
+// TarpitHandler to block it. Peers using message stream encryption cannot be
+// detected.
+type BitTorrent struct {
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (b *BitTorrent) String() string {
+	return b.Description
+}
+
+// Check verifies the protocol name.
+func (b *BitTorrent) Check(header []byte, _ []interface{}) (bool, int) {
+	if len(header) < len(bitTorrentPrefix) {
+		if !bytes.HasPrefix(bitTorrentPrefix, header) {
+			return false, 0
+		}
+		return false, len(bitTorrentPrefix)
+	}
+
+	return bytes.HasPrefix(header, bitTorrentPrefix), 0
+}
+
+// checkHandshake requires the handshake up to and including the info hash.
+func (b *BitTorrent) checkHandshake(header []byte, hints []interface{}) (bool, int) {
+	ok, needed := b.Check(header, hints)
+	if !ok {
+		return ok, needed
+	}
+	if len(header) < bitTorrentPeerIDOffset {
+		return false, bitTorrentPeerIDOffset
+	}
+	return true, 0
+}
+
+// checkPeerID requires the complete handshake.
+func checkPeerID(header []byte, _ []interface{}) (bool, int) {
+	if len(header) < BitTorrentHandshakeLen {
+		return false, BitTorrentHandshakeLen
+	}
+	return true, 0
+}
+
+// Handle reads the handshake up to the info hash, along with the peer ID if it
+// is available, adds it as a hint and calls the handler.
+func (b *BitTorrent) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, BitTorrentHandshakeLen, b.checkHandshake)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// The peer ID is only included if it has already been read, as peers may
+	// hold it back until the remote handshake arrives.
+	if x, ok := c.(*utils.ProxyConn); ok && x.Buffered() >= BitTorrentHandshakeLen-len(header) {
+		header, pc, err = peek(pc, BitTorrentHandshakeLen, checkPeerID)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	h := &BitTorrentHandshake{}
+	p := header[len(bitTorrentPrefix):]
+	copy(h.Reserved[:], p[0:8])
+	copy(h.InfoHash[:], p[8:28])
+	if len(header) >= BitTorrentHandshakeLen {
+		copy(h.PeerID[:], p[28:48])
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(h))
+	return b.Handler(pc)
+}
+
+// NewBitTorrent returns a BitTorrent with the provided handler.
+func NewBitTorrent(handler func(net.Conn) (net.Conn, error)) *BitTorrent {
+	return &BitTorrent{
+		Handler:     handler,
+		Description: "BitTorrent",
+	}
+}
+
+// NewBitTorrentProxy returns a BitTorrent set up to call DialAndProxy.
+func NewBitTorrentProxy(proto, dest string) *BitTorrent {
+	b := NewBitTorrent(ProxyHandler(proto, dest))
+	b.Description = fmt.Sprintf("BitTorrent [dest: %s]", dest)
+	return b
+}
@@ -0,0 +1,90 @@
+package proto
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+var bitTorrentHandshake = []byte(BitTorrentProtocol +
+	"\x00\x00\x00\x00\x00\x10\x00\x05" +
+	"\xd8\x4f\x2e\x19\x9a\x37\x60\xc1\x0b\x5e\x21\xf4\x86\x3a\x77\x02\xe5\x91\x4c\x08" +
+	"-qB4630-k8hj0wgej6ch")
+
+func TestBitTorrent(t *testing.T) {
+	h := NewBitTorrent(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 20},
+		{[]byte("\x13Bit"), false, 20},
+		{bitTorrentHandshake[:20], true, 0},
+		{bitTorrentHandshake, true, 0},
+		{[]byte("\x13BitTorrent protocoL"), false, 0},
+		{[]byte("\x12"), false, 0},
+		{[]byte("GET / HTTP/1.1"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestBitTorrentHint(t *testing.T) {
+	handshakes := make(chan *BitTorrentHandshake, 1)
+	h := NewBitTorrent(func(c net.Conn) (net.Conn, error) {
+		hints := utils.GetHints(c)
+		hs, _ := hints[len(hints)-1].(*BitTorrentHandshake)
+		handshakes <- hs
+		return nil, nil
+	})
+
+	tests := []struct {
+		buffered []byte
+		sent     []byte
+		peerID   string
+	}{
+		// The Server has read the complete handshake
+		{bitTorrentHandshake, nil, "-qB4630-k8hj0wgej6ch"},
+
+		// The peer ID has not been read, or is held back
+		{bitTorrentHandshake[:20], bitTorrentHandshake[20:], ""},
+		{bitTorrentHandshake[:20], bitTorrentHandshake[20:48], ""},
+		{nil, bitTorrentHandshake[:48], ""},
+	}
+
+	for _, test := range tests {
+		server, client := net.Pipe()
+		go client.Write(test.sent)
+		if _, err := h.Handle(utils.NewProxyConn(server, test.buffered, nil)); err != nil {
+			t.Fatalf("handle failed: %v", err)
+		}
+
+		var peerID [20]byte
+		copy(peerID[:], test.peerID)
+
+		select {
+		case hs := <-handshakes:
+			if hs == nil || string(hs.InfoHash[:]) != string(bitTorrentHandshake[28:48]) || hs.PeerID != peerID {
+				t.Errorf("handshake parsed as %+v, expected peer ID %q", hs, test.peerID)
+			}
+		case <-time.After(300 * time.Millisecond):
+			t.Errorf("no hint added")
+		}
+
+		client.Close()
+	}
+}
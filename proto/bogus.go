@@ -1,10 +1,13 @@
 package proto
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/kennylevinsen/serve2/utils"
 )
@@ -23,11 +26,20 @@ var (
 		[]byte("CONNECT"),
 		[]byte("OPTIONS"),
 	}
+
+	// ErrDropped is returned by DropHandler, so that dropped connections are
+	// logged by the server.
+	ErrDropped = errors.New("connection dropped")
 )
 
 // NewHTTP returns a ListenProxy with a http as the listening service. This is
 // a convenience wrapper kept in place for compatibility with older checkouts.
 // Might be removed in the future.
+//
+// As it only checks the method, NewHTTP also matches other protocols sharing
+// HTTP methods, such as RTSP and SIP. Use a RequestLineMatcher with a route
+// for HTTPVersions calling the Handle method of the returned ListenProxy to
+// tell these apart.
 func NewHTTP(handler http.Handler) *ListenProxy {
 	sm := &SimpleMatcher{Matches: HTTPMethods}
 	lp := NewListenProxy(sm.Check, 10)
@@ -86,16 +98,55 @@ func NewDiscard() *SimpleMatcher {
 	}
 }
 
-// NewMultiProxy returns a SimpleMatcher set up to call DialAndProxy.
-func NewMultiProxy(matches [][]byte, proto, dest string) *SimpleMatcher {
-	handler := func(c net.Conn) (net.Conn, error) {
+// ProxyHandler returns a handler that calls DialAndProxy with the provided
+// destination.
+func ProxyHandler(proto, dest string) func(net.Conn) (net.Conn, error) {
+	return func(c net.Conn) (net.Conn, error) {
 		return nil, utils.DialAndProxy(c, proto, dest)
 	}
+}
+
+// FailoverHandler returns a handler that calls DialAndProxy with the first of
+// the provided destinations that can be dialed.
+func FailoverHandler(proto string, dests ...string) func(net.Conn) (net.Conn, error) {
+	return func(c net.Conn) (net.Conn, error) {
+		err := ErrNoRoute
+		for _, dest := range dests {
+			if err = utils.DialAndProxy(c, proto, dest); err == nil {
+				return nil, nil
+			}
+		}
+		return nil, err
+	}
+}
 
+// DropHandler returns a handler that closes the connection.
+func DropHandler() func(net.Conn) (net.Conn, error) {
+	return func(c net.Conn) (net.Conn, error) {
+		c.Close()
+		return nil, ErrDropped
+	}
+}
+
+// TarpitHandler returns a handler that keeps the connection open without ever
+// replying, discarding everything it receives until the duration has passed.
+func TarpitHandler(d time.Duration) func(net.Conn) (net.Conn, error) {
+	return func(c net.Conn) (net.Conn, error) {
+		go func() {
+			c.SetDeadline(time.Now().Add(d))
+			io.Copy(ioutil.Discard, c)
+			c.Close()
+		}()
+		return nil, nil
+	}
+}
+
+// NewMultiProxy returns a SimpleMatcher set up to call DialAndProxy.
+func NewMultiProxy(matches [][]byte, proto, dest string) *SimpleMatcher {
 	sm := &SimpleMatcher{
 		Matches:     matches,
 		Description: fmt.Sprintf("Proxy [dest: %s]", dest),
-		Handler:     handler,
+		Handler:     ProxyHandler(proto, dest),
 	}
 
 	sm.Sort()
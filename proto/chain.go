@@ -20,16 +20,23 @@ func (c *Chain) Handle(conn net.Conn) (net.Conn, error) {
 	return c.Handler(conn)
 }
 
-// Check alls all the provided checkers in order, returning the output of the
-// first failing check. If all checkers pass, Check returns (true, 0).
+// Check calls all the provided checkers in order, following the rules of All.
 func (c *Chain) Check(header []byte, hints []interface{}) (bool, int) {
+	var needed int
 	for _, check := range c.Checkers {
 		ok, n := check(header, hints)
-		if !ok {
-			return ok, n
+		switch {
+		case ok:
+		case n == 0:
+			return false, 0
+		case needed == 0 || n < needed:
+			needed = n
 		}
 	}
 
+	if needed > 0 {
+		return false, needed
+	}
 	return true, 0
 }
 
@@ -27,4 +27,8 @@ func TestChain(t *testing.T) {
 		t.Errorf("Chain matched when it shouldn't")
 	}
 
+	header := []byte("GET")
+	if allocs := testing.AllocsPerRun(100, func() { cm1.Check(header, nil) }); allocs != 0 {
+		t.Errorf("Chain allocated %v times per check", allocs)
+	}
 }
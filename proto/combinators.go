@@ -0,0 +1,188 @@
+package proto
+
+// Checker is the signature of Check, following its rules: (true, 0) is a
+// match, (false, 0) is not, and (false, n) asks for n bytes.
+type Checker func(header []byte, hints []interface{}) (bool, int)
+
+// All matches if all the checkers match. It does not match as soon as any of
+// the checkers does not, even if others need more data, and otherwise needs
+// the smallest amount of bytes needed by the undecided checkers.
+func All(checkers ...Checker) Checker {
+	return func(header []byte, hints []interface{}) (bool, int) {
+		var needed int
+		for _, check := range checkers {
+			ok, n := check(header, hints)
+			switch {
+			case ok:
+			case n == 0:
+				return false, 0
+			case needed == 0 || n < needed:
+				needed = n
+			}
+		}
+
+		if needed > 0 {
+			return false, needed
+		}
+		return true, 0
+	}
+}
+
+// Any matches if any of the checkers match. It only does not match if none of
+// the checkers can, and otherwise needs the smallest amount of bytes needed by
+// the undecided checkers.
+func Any(checkers ...Checker) Checker {
+	return func(header []byte, hints []interface{}) (bool, int) {
+		var needed int
+		for _, check := range checkers {
+			ok, n := check(header, hints)
+			switch {
+			case ok:
+				return true, 0
+			case n == 0:
+			case needed == 0 || n < needed:
+				needed = n
+			}
+		}
+
+		return false, needed
+	}
+}
+
+// Not matches if the checker does not, needing the same amount of bytes.
+func Not(check Checker) Checker {
+	return func(header []byte, hints []interface{}) (bool, int) {
+		ok, n := check(header, hints)
+		switch {
+		case ok:
+			return false, 0
+		case n == 0:
+			return true, 0
+		default:
+			return false, n
+		}
+	}
+}
+
+// AtOffset runs the checker on the header from the offset, translating the
+// amount of bytes needed.
+func AtOffset(offset int, check Checker) Checker {
+	return func(header []byte, hints []interface{}) (bool, int) {
+		if len(header) < offset {
+			header = nil
+		} else {
+			header = header[offset:]
+		}
+
+		ok, n := check(header, hints)
+		if !ok && n > 0 {
+			return false, offset + n
+		}
+		return ok, 0
+	}
+}
+
+// Region matches a region at the start of the header for Seq. On a match, it
+// returns the length of the region, which may extend past the header.
+// Otherwise, it follows the rules of Check.
+type Region func(header []byte, hints []interface{}) (ok bool, length, needed int)
+
+// Check runs the region as a Checker.
+func (r Region) Check(header []byte, hints []interface{}) (bool, int) {
+	return Seq(r)(header, hints)
+}
+
+// Fixed is a region of the provided length, matching if the checker matches
+// the region. The checker may be nil to match anything. The checker is also
+// given partial regions, allowing it to rule out a match early.
+func Fixed(length int, check Checker) Region {
+	return func(header []byte, hints []interface{}) (bool, int, int) {
+		if len(header) > length {
+			header = header[:length]
+		}
+
+		if check != nil {
+			ok, n := check(header, hints)
+			if !ok && (n == 0 || len(header) == length) {
+				// The checker either ruled out the region, or wants more
+				// than the region.
+				return false, 0, 0
+			}
+		}
+
+		if len(header) < length {
+			return false, 0, length
+		}
+		return true, length, 0
+	}
+}
+
+// LengthPrefixed is a region with a big-endian length prefix of size bytes,
+// from 1 to 4, followed by that many bytes. The checker, which may be nil, is
+// run on the body, and the region matches as soon as the checker does,
+// without waiting for the rest of the body. The body may not be longer than
+// max, unless max is 0.
+func LengthPrefixed(size, max int, check Checker) Region {
+	return func(header []byte, hints []interface{}) (bool, int, int) {
+		if size < 1 || size > 4 {
+			return false, 0, 0
+		}
+		if len(header) < size {
+			return false, 0, size
+		}
+
+		var length int
+		for _, b := range header[:size] {
+			length = length<<8 | int(b)
+		}
+		if max > 0 && length > max {
+			return false, 0, 0
+		}
+
+		total := size + length
+		if check == nil {
+			return true, total, 0
+		}
+
+		body := header[size:]
+		if len(body) > length {
+			body = body[:length]
+		}
+
+		ok, n := check(body, hints)
+		switch {
+		case ok:
+			return true, total, 0
+		case n == 0, n > length:
+			return false, 0, 0
+		default:
+			return false, 0, size + n
+		}
+	}
+}
+
+// Seq matches consecutive regions, each starting where the previous ended.
+// Regions after one that is not yet decided are not checked.
+func Seq(regions ...Region) Checker {
+	return func(header []byte, hints []interface{}) (bool, int) {
+		var pos int
+		for _, region := range regions {
+			var rest []byte
+			if pos < len(header) {
+				rest = header[pos:]
+			}
+
+			ok, length, needed := region(rest, hints)
+			switch {
+			case ok:
+				pos += length
+			case needed == 0:
+				return false, 0
+			default:
+				return false, pos + needed
+			}
+		}
+
+		return true, 0
+	}
+}
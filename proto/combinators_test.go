@@ -0,0 +1,86 @@
+package proto
+
+import (
+	"testing"
+)
+
+func prefix(s string) Checker {
+	return NewSimpleMatcher([][]byte{[]byte(s)}, nil).Check
+}
+
+func TestCombinators(t *testing.T) {
+	clientHello := Seq(
+		Fixed(1, prefix("\x16")),
+		Fixed(1, prefix("\x03")),
+		Fixed(1, nil),
+		LengthPrefixed(2, 16384, Seq(Fixed(1, prefix("\x01")))),
+	)
+
+	tests := []struct {
+		name     string
+		check    Checker
+		payload  string
+		match    bool
+		required int
+	}{
+		{"all", All(prefix("G"), prefix("GET")), "G", false, 3},
+		{"all", All(prefix("G"), prefix("GET")), "GA", false, 0},
+		{"all", All(prefix("G"), prefix("GET")), "GET", true, 0},
+		{"all", All(prefix("GET"), prefix("P")), "", false, 1},
+		{"all", All(prefix("GET"), prefix("P")), "G", false, 0},
+
+		{"any", Any(prefix("GET"), prefix("POST")), "", false, 3},
+		{"any", Any(prefix("GET"), prefix("POST")), "P", false, 4},
+		{"any", Any(prefix("GET"), prefix("POST")), "GET", true, 0},
+		{"any", Any(prefix("GET"), prefix("POST")), "X", false, 0},
+
+		{"not", Not(prefix("GET")), "G", false, 3},
+		{"not", Not(prefix("GET")), "GET", false, 0},
+		{"not", Not(prefix("GET")), "GX", true, 0},
+
+		{"offset", AtOffset(2, prefix("ST")), "", false, 4},
+		{"offset", AtOffset(2, prefix("ST")), "PO", false, 4},
+		{"offset", AtOffset(2, prefix("ST")), "POS", false, 4},
+		{"offset", AtOffset(2, prefix("ST")), "POST", true, 0},
+		{"offset", AtOffset(2, prefix("ST")), "POOT", false, 0},
+
+		{"seq", Seq(Fixed(3, prefix("GET")), Fixed(1, prefix(" "))), "GE", false, 3},
+		{"seq", Seq(Fixed(3, prefix("GET")), Fixed(1, prefix(" "))), "GA", false, 0},
+		{"seq", Seq(Fixed(3, prefix("GET")), Fixed(1, prefix(" "))), "GET", false, 4},
+		{"seq", Seq(Fixed(3, prefix("GET")), Fixed(1, prefix(" "))), "GET ", true, 0},
+		{"seq", Seq(Fixed(3, prefix("GET")), Fixed(1, prefix(" "))), "GETX", false, 0},
+		{"seq", Seq(Fixed(2, prefix("GET"))), "GE", false, 0},
+
+		{"prefixed", LengthPrefixed(1, 0, nil).Check, "", false, 1},
+		{"prefixed", LengthPrefixed(1, 0, nil).Check, "\xFF", true, 0},
+		{"prefixed", Seq(LengthPrefixed(1, 0, nil), Fixed(1, prefix("X"))), "\x02ab", false, 4},
+		{"prefixed", Seq(LengthPrefixed(1, 0, nil), Fixed(1, prefix("X"))), "\x02abX", true, 0},
+		{"prefixed", LengthPrefixed(1, 4, nil).Check, "\x05", false, 0},
+		{"prefixed", LengthPrefixed(5, 0, nil).Check, "\x00\x00\x00\x00\x00", false, 0},
+
+		{"clienthello", clientHello, "", false, 1},
+		{"clienthello", clientHello, "\x16", false, 2},
+		{"clienthello", clientHello, "\x16\x03\x01", false, 5},
+		{"clienthello", clientHello, "\x16\x03\x01\x00\x10", false, 6},
+		{"clienthello", clientHello, "\x16\x03\x01\x00\x10\x01", true, 0},
+		{"clienthello", clientHello, "\x16\x03\x01\x00\x10\x02", false, 0},
+		{"clienthello", clientHello, "\x16\x03\x01\x00\x00", false, 0},
+		{"clienthello", clientHello, "\x16\x03\x01\x40\x01\x01", false, 0},
+		{"clienthello", clientHello, "\x17", false, 0},
+
+		{"chain", NewChain(nil, prefix("GET"), prefix("P")).Check, "G", false, 0},
+		{"chain", NewChain(nil, prefix("GET"), prefix("G")).Check, "G", false, 3},
+	}
+
+	for _, test := range tests {
+		match, required := test.check([]byte(test.payload), nil)
+		if test.match != match {
+			t.Errorf("%s: match not correct for %q: was %t, expected %t",
+				test.name, test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("%s: required not correct for %q: was %d, expected %d",
+				test.name, test.payload, required, test.required)
+		}
+	}
+}
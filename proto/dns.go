@@ -0,0 +1,215 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// DNS field constants
+const (
+	DNSHeaderLength  = 12
+	DNSMaxNameLength = 255
+	DNSMaxLookahead  = 2 + DNSHeaderLength + DNSMaxNameLength + 4
+	DNSClassIN       = 1
+	DNSClassCH       = 3
+	DNSClassANY      = 255
+)
+
+var errDNS = errors.New("dns: invalid query")
+
+// DNSQuestion is the parsed first question of a query sent by a DNS client. It
+// is added as a hint to connections handled by DNS.
+type DNSQuestion struct {
+	ID    uint16
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// ParseDNSQuery parses and validates the length prefix, header and first
+// question of a DNS-over-TCP query. If more data is needed, the amount of bytes
+// is returned as needed, with a nil question and error.
+//
+// Only standard queries are accepted, with QR, AA, TC, RA, Z and RCODE unset,
+// exactly one question, no answer or authority records, and at most two
+// additional records to allow for EDNS and TSIG.
+func ParseDNSQuery(header []byte) (q *DNSQuestion, needed int, err error) {
+	if len(header) < 2+DNSHeaderLength {
+		// Opcode, QR and AA are in the first flag byte
+		if len(header) > 4 && header[4]&^0x01 != 0 {
+			return nil, 0, errDNS
+		}
+		return nil, 2 + DNSHeaderLength, nil
+	}
+
+	length := int(binary.BigEndian.Uint16(header[0:2]))
+	msg := header[2:]
+
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	qdcount := binary.BigEndian.Uint16(msg[4:6])
+	ancount := binary.BigEndian.Uint16(msg[6:8])
+	nscount := binary.BigEndian.Uint16(msg[8:10])
+	arcount := binary.BigEndian.Uint16(msg[10:12])
+
+	// Only RD, AD and CD may be set
+	if flags&^0x0130 != 0 || qdcount != 1 || ancount != 0 || nscount != 0 || arcount > 2 {
+		return nil, 0, errDNS
+	}
+
+	// The shortest question is the root name, type and class
+	if length < DNSHeaderLength+1+4 {
+		return nil, 0, errDNS
+	}
+
+	var labels []string
+	pos := DNSHeaderLength
+	for {
+		if pos-DNSHeaderLength >= DNSMaxNameLength || pos+1 > length {
+			return nil, 0, errDNS
+		}
+		if len(msg) < pos+1 {
+			return nil, 2 + pos + 1, nil
+		}
+
+		l := int(msg[pos])
+		if l == 0 {
+			pos++
+			break
+		}
+
+		// Compression pointers and extended labels have no place in questions
+		if l&0xC0 != 0 {
+			return nil, 0, errDNS
+		}
+
+		if len(msg) < pos+1+l {
+			return nil, 2 + pos + 1 + l, nil
+		}
+
+		labels = append(labels, string(msg[pos+1:pos+1+l]))
+		pos += 1 + l
+	}
+
+	if pos+4 > length {
+		return nil, 0, errDNS
+	}
+	if len(msg) < pos+4 {
+		return nil, 2 + pos + 4, nil
+	}
+
+	q = &DNSQuestion{
+		ID:    binary.BigEndian.Uint16(msg[0:2]),
+		Name:  strings.Join(labels, ".") + ".",
+		Type:  binary.BigEndian.Uint16(msg[pos:]),
+		Class: binary.BigEndian.Uint16(msg[pos+2:]),
+	}
+
+	if q.Class != DNSClassIN && q.Class != DNSClassCH && q.Class != DNSClassANY {
+		return nil, 0, errDNS
+	}
+
+	return q, 0, nil
+}
+
+// DNSMessageHandler returns a handler that serves DNS-over-TCP by calling
+// resolve for every query received, writing back the response. Returning an
+// error closes the connection.
+func DNSMessageHandler(resolve func(query []byte) ([]byte, error)) func(net.Conn) (net.Conn, error) {
+	return func(c net.Conn) (net.Conn, error) {
+		go func() {
+			defer c.Close()
+
+			prefix := make([]byte, 2)
+			for {
+				if _, err := io.ReadFull(c, prefix); err != nil {
+					return
+				}
+
+				query := make([]byte, binary.BigEndian.Uint16(prefix))
+				if _, err := io.ReadFull(c, query); err != nil {
+					return
+				}
+
+				response, err := resolve(query)
+				if err != nil || len(response) > 0xFFFF {
+					return
+				}
+
+				binary.BigEndian.PutUint16(prefix, uint16(len(response)))
+				if _, err = c.Write(append(prefix, response...)); err != nil {
+					return
+				}
+			}
+		}()
+		return nil, nil
+	}
+}
+
+// DNS detects DNS-over-TCP clients by validating the header and first question
+// of their first query. The *DNSQuestion is added as a hint to the connection
+// given to the handler. Combined with TLS, this provides DNS-over-TLS.
+//
+// Query names can be up to 255 bytes long, so DNS declares DNSMaxLookahead as
+// its lookahead.
+type DNS struct {
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (d *DNS) String() string {
+	return d.Description
+}
+
+// MaxLookahead returns DNSMaxLookahead.
+func (d *DNS) MaxLookahead() int {
+	return DNSMaxLookahead
+}
+
+// Check validates the header and first question.
+func (d *DNS) Check(header []byte, _ []interface{}) (bool, int) {
+	q, needed, err := ParseDNSQuery(header)
+	if err != nil || q == nil {
+		return false, needed
+	}
+	return true, 0
+}
+
+// Handle parses the first question, adds it as a hint and calls the handler.
+func (d *DNS) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, DNSMaxLookahead, d.Check)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	q, _, err := ParseDNSQuery(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(q))
+	return d.Handler(pc)
+}
+
+// NewDNS returns a DNS with the provided handler.
+func NewDNS(handler func(net.Conn) (net.Conn, error)) *DNS {
+	return &DNS{
+		Handler:     handler,
+		Description: "DNS",
+	}
+}
+
+// NewDNSProxy returns a DNS set up to call DialAndProxy, forwarding to an
+// upstream resolver supporting DNS-over-TCP.
+func NewDNSProxy(proto, dest string) *DNS {
+	d := NewDNS(ProxyHandler(proto, dest))
+	d.Description = fmt.Sprintf("DNS [dest: %s]", dest)
+	return d
+}
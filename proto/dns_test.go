@@ -0,0 +1,128 @@
+package proto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+func dnsQuery(flags, arcount uint16, name string, qtype, class uint16) []byte {
+	msg := make([]byte, DNSHeaderLength)
+	binary.BigEndian.PutUint16(msg[0:], 0xbeef)
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[10:], arcount)
+
+	for _, label := range strings.FieldsFunc(name, func(r rune) bool { return r == '.' }) {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), byte(class>>8), byte(class))
+
+	return append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func TestDNS(t *testing.T) {
+	h := NewDNS(nil)
+
+	query := dnsQuery(0x0100, 0, "example.com", 1, DNSClassIN)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 14},
+		{query[:5], false, 14},
+		{[]byte{0x00, 0x1d, 0xbe, 0xef, 0x81}, false, 0},
+		{query[:14], false, 15},
+		{query[:15], false, 22},
+		{query[:22], false, 23},
+		{query[:27], false, 31},
+		{query, true, 0},
+		{dnsQuery(0x0120, 1, ".", 2, DNSClassIN), true, 0},
+		{dnsQuery(0x8180, 0, "example.com", 1, DNSClassIN), false, 0},
+		{dnsQuery(0x2800, 0, "example.com", 6, DNSClassIN), false, 0},
+		{dnsQuery(0x0100, 3, "example.com", 1, DNSClassIN), false, 0},
+		{dnsQuery(0x0100, 0, "example.com", 1, 2), false, 0},
+		{[]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestParseDNSQuery(t *testing.T) {
+	q, _, err := ParseDNSQuery(dnsQuery(0x0100, 1, "www.example.com", 28, DNSClassIN))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	expected := DNSQuestion{ID: 0xbeef, Name: "www.example.com.", Type: 28, Class: DNSClassIN}
+	if *q != expected {
+		t.Errorf("question was %+v, expected %+v", *q, expected)
+	}
+
+	// Compression pointers are not allowed in the question
+	pointer := dnsQuery(0x0100, 0, "example.com", 1, DNSClassIN)
+	pointer[14] = 0xC0
+	if _, _, err = ParseDNSQuery(pointer); err == nil {
+		t.Errorf("parse of compressed name did not fail")
+	}
+}
+
+func TestDNSMessageHandler(t *testing.T) {
+	hinted := make(chan *DNSQuestion, 1)
+	resolve := func(query []byte) ([]byte, error) {
+		query[2] |= 0x80
+		return query, nil
+	}
+
+	h := NewDNS(func(c net.Conn) (net.Conn, error) {
+		hints := utils.GetHints(c)
+		q, _ := hints[len(hints)-1].(*DNSQuestion)
+		hinted <- q
+		return DNSMessageHandler(resolve)(c)
+	})
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	query := dnsQuery(0x0100, 0, "example.com", 1, DNSClassIN)
+	go client.Write(query)
+
+	if _, err := h.Handle(server); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+
+	select {
+	case q := <-hinted:
+		if q == nil || q.Name != "example.com." {
+			t.Errorf("unexpected question hint: %+v", q)
+		}
+	case <-time.After(300 * time.Millisecond):
+		t.Fatalf("timed out waiting for handler")
+	}
+
+	response := make([]byte, len(query))
+	if _, err := io.ReadFull(client, response); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if response[4]&0x80 == 0 || string(response[5:]) != string(query[5:]) {
+		t.Errorf("unexpected response: %q", response)
+	}
+}
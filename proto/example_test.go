@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"crypto/tls"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/kennylevinsen/serve2"
 	"github.com/kennylevinsen/serve2/proto"
@@ -214,3 +217,399 @@ func ExampleNewChain() {
 
 	server.Serve(l)
 }
+
+func ExampleSeq() {
+	server := serve2.New()
+
+	// A TLS handshake record (0x16, major version 3, any minor version),
+	// carrying a ClientHello (0x01), without reading the whole record.
+	clientHello := proto.Seq(
+		proto.Fixed(1, proto.NewSimpleMatcher([][]byte{{0x16}}, nil).Check),
+		proto.Fixed(1, proto.NewSimpleMatcher([][]byte{{0x03}}, nil).Check),
+		proto.Fixed(1, nil),
+		proto.LengthPrefixed(2, 16384, proto.Seq(
+			proto.Fixed(1, proto.NewSimpleMatcher([][]byte{{0x01}}, nil).Check),
+		)),
+	)
+
+	cm := proto.NewChain(proto.ProxyHandler("tcp", "localhost:443"), clientHello)
+	cm.Description = "TLS"
+
+	server.AddHandlers(cm)
+	l, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewMaskMatcher() {
+	server := serve2.New()
+
+	// A TLS handshake record carrying a ClientHello
+	tls, err := proto.NewMaskMatcher(0, "16 03 ?? ?? ?? 01", proto.ProxyHandler("tcp", "localhost:443"))
+	if err != nil {
+		panic(err)
+	}
+
+	// An HTTP request line for the API
+	api, err := proto.NewRegexMatcher(`[A-Z]+ /api/`, proto.ProxyHandler("tcp", "localhost:8081"))
+	if err != nil {
+		panic(err)
+	}
+
+	server.AddHandlers(tls, api)
+	l, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleLoadSignatures() {
+	server := serve2.New()
+
+	f, err := os.Open("signatures.conf")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	sigs, err := proto.LoadSignatures(f, map[string]func(net.Conn) (net.Conn, error){
+		"http": proto.NewHTTP(&HTTPHandler{}).Handle,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	for _, conflict := range proto.ValidateSignatures(sigs) {
+		log.Printf("%v", conflict)
+	}
+
+	for _, sig := range sigs {
+		server.AddHandler(sig)
+	}
+
+	l, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewSSH() {
+	server := serve2.New()
+
+	ssh := proto.NewSSHProxy("tcp", "localhost:22")
+	ssh.Routes = []proto.Route{
+		{
+			Matcher: &proto.SSHMatch{SoftwarePrefixes: []string{"paramiko", "Go"}},
+			Handler: proto.ProxyHandler("tcp", "automation-bastion:22"),
+		},
+	}
+
+	server.AddHandlers(ssh)
+	l, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewPostgres() {
+	server := serve2.New()
+
+	tls, err := proto.NewTLS(nil, "cert.pem", "key.pem")
+	if err != nil {
+		panic(err)
+	}
+
+	// Postgres answers SSLRequest itself, terminating TLS with the TLS config
+	pg := proto.NewPostgresProxy("tcp", "localhost:5432")
+	pg.TLS = tls
+	pg.Routes = []proto.Route{
+		{
+			Matcher: &proto.PostgresMatch{Databases: []string{"billing"}},
+			Handler: proto.ProxyHandler("tcp", "billing-db:5432"),
+		},
+	}
+
+	server.AddHandlers(pg)
+	l, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewRedis() {
+	server := serve2.New()
+
+	// Redis behind the same TLS transport as everything else
+	tls, err := proto.NewTLS(nil, "cert.pem", "key.pem")
+	if err != nil {
+		panic(err)
+	}
+
+	redis := proto.NewRedisProxy("tcp", "redis-a:6379", "redis-b:6379")
+
+	server.AddHandlers(tls, redis)
+	l, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewMQTT() {
+	server := serve2.New()
+
+	tls, err := proto.NewTLS(nil, "cert.pem", "key.pem")
+	if err != nil {
+		panic(err)
+	}
+
+	// MQTT over TLS, with meters routed to their own broker
+	mqtt := proto.NewMQTTProxy("tcp", "broker:1883")
+	mqtt.Routes = []proto.Route{
+		{
+			Matcher: &proto.MQTTMatch{ClientIDPrefixes: []string{"meter-"}},
+			Handler: proto.ProxyHandler("tcp", "meter-broker:1883"),
+		},
+	}
+
+	server.AddHandlers(tls, mqtt)
+	l, err := net.Listen("tcp", ":443")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewAMQP() {
+	server := serve2.New()
+
+	// RabbitMQ, both over AMQP and STOMP, and NATS on the same port
+	server.AddHandlers(
+		proto.NewAMQPProxy("tcp", "rabbitmq:5672"),
+		proto.NewSTOMPProxy("tcp", "rabbitmq:61613"),
+		proto.NewNATSProxy("tcp", "nats:4222"),
+	)
+
+	// Most NATS clients wait for the server, so they are greeted when idle
+	server.IdleProtocol = proto.NewNATSGreetingProxy("tcp", "nats:4222")
+	server.IdleTimeout = 2 * time.Second
+	l, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewDNS() {
+	server := serve2.New()
+
+	tls, err := proto.NewTLS(nil, "cert.pem", "key.pem")
+	if err != nil {
+		panic(err)
+	}
+
+	// DNS-over-TLS, forwarded to a local resolver
+	server.AddHandlers(tls, proto.NewDNSProxy("tcp", "127.0.0.1:53"))
+	l, err := net.Listen("tcp", ":853")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewRDP() {
+	server := serve2.New()
+
+	// RDP next to the web portal, with alice routed to her own desktop
+	rdp := proto.NewRDPProxy("tcp", "terminal-server:3389")
+	rdp.Routes = []proto.Route{
+		{
+			Matcher: &proto.RDPMatch{Cookies: []string{"alice"}},
+			Handler: proto.ProxyHandler("tcp", "alice-desktop:3389"),
+		},
+	}
+
+	// VNC clients wait for the server, so they are handled when idle
+	server.IdleProtocol = proto.NewVNCProxy("tcp", "localhost:5900")
+	server.IdleTimeout = 2 * time.Second
+
+	server.AddHandlers(rdp, proto.NewHTTP(&HTTPHandler{}))
+	l, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewGit() {
+	server := serve2.New()
+
+	// git:// next to HTTPS, with mirrors served by a separate daemon
+	git := proto.NewGitProxy("tcp", "localhost:9418")
+	git.Routes = []proto.Route{
+		{
+			Matcher: &proto.GitMatch{PathPrefixes: []string{"/mirrors/"}},
+			Handler: proto.ProxyHandler("tcp", "mirror:9418"),
+		},
+	}
+
+	tls, err := proto.NewTLS(nil, "cert.pem", "key.pem")
+	if err != nil {
+		panic(err)
+	}
+
+	server.AddHandlers(git, tls, proto.NewHTTP(&HTTPHandler{}))
+	l, err := net.Listen("tcp", ":443")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewRTSP() {
+	server := serve2.New()
+
+	// RTSP and SIP share methods with HTTP, so they are given a higher
+	// priority, making HTTP wait for their complete request lines. Their
+	// request lines tend to be long, but they declare their lookahead.
+	rtsp := proto.NewRTSP(proto.ProxyHandler("tcp", "localhost:8554"))
+	sip := proto.NewSIP(proto.ProxyHandler("tcp", "localhost:5060"))
+	irc := proto.NewIRC(proto.ProxyHandler("tcp", "localhost:6667"))
+
+	server.AddHandlerPriority(rtsp, 1)
+	server.AddHandlerPriority(sip, 1)
+	server.AddHandlers(irc, proto.NewHTTP(&HTTPHandler{}))
+	l, err := net.Listen("tcp", ":80")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewRequestLineMatcher() {
+	server := serve2.New()
+
+	// HTTP, RTSP and SIP share methods such as OPTIONS, so they are told apart
+	// by the version of the request line.
+	http := proto.NewHTTP(&HTTPHandler{})
+	rl := proto.NewRequestLineMatcher(
+		proto.Route{
+			Matcher: &proto.RequestLineMatch{Versions: proto.RTSPVersions},
+			Handler: proto.ProxyHandler("tcp", "localhost:8554"),
+		},
+		proto.Route{
+			Matcher: &proto.RequestLineMatch{Versions: proto.SIPVersions, Schemes: []string{"sip", "sips"}},
+			Handler: proto.ProxyHandler("tcp", "localhost:5060"),
+		},
+		proto.Route{
+			Matcher: &proto.RequestLineMatch{Versions: proto.HTTPVersions},
+			Handler: http.Handle,
+		},
+	)
+
+	server.AddHandlers(rl)
+	l, err := net.Listen("tcp", ":80")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewOpenVPN() {
+	server := serve2.New()
+
+	// OpenVPN next to HTTPS on port 443
+	openvpn := proto.NewOpenVPNProxy("tcp", "localhost:1194")
+
+	tls, err := proto.NewTLS(nil, "cert.pem", "key.pem")
+	if err != nil {
+		panic(err)
+	}
+
+	server.AddHandlers(openvpn, tls, proto.NewHTTP(&HTTPHandler{}))
+	l, err := net.Listen("tcp", ":443")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewLDAP() {
+	server := serve2.New()
+
+	tls, err := proto.NewTLS(nil, "cert.pem", "key.pem")
+	if err != nil {
+		panic(err)
+	}
+
+	// StartTLS is terminated here, after which the LDAP messages are
+	// detected again inside TLS and passed on in plain text.
+	ldap := proto.NewLDAPProxy("tcp", "localhost:3389")
+	ldap.TLS = tls
+
+	server.AddHandlers(ldap, tls)
+	l, err := net.Listen("tcp", ":389")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewBitTorrent() {
+	server := serve2.New()
+	server.Logger = log.Printf
+
+	// File shares are passed on, while BitTorrent peers are kept busy
+	smb := proto.NewSMBProxy("tcp", "fileserver:445")
+	bt := proto.NewBitTorrent(proto.TarpitHandler(10 * time.Minute))
+
+	server.AddHandlers(smb, bt)
+	l, err := net.Listen("tcp", ":445")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
+
+func ExampleNewMinecraft() {
+	server := serve2.New()
+
+	// Two servers sharing the public Minecraft port
+	mc := proto.NewMinecraftProxy("tcp", "localhost:25566")
+	mc.Routes = []proto.Route{
+		{
+			Matcher: &proto.MinecraftMatch{Hostnames: []string{"creative.example.com"}},
+			Handler: proto.ProxyHandler("tcp", "localhost:25567"),
+		},
+	}
+
+	server.AddHandlers(mc)
+	l, err := net.Listen("tcp", ":25565")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
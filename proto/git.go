@@ -0,0 +1,224 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// Git field constants
+const (
+	GitMaxPktLineLength = 65520
+	GitMaxLookahead     = 4096
+)
+
+// GitServices are the services that can be requested from a Git daemon.
+var GitServices = []string{
+	"git-upload-pack",
+	"git-receive-pack",
+	"git-upload-archive",
+}
+
+var gitServiceMatcher = NewSimpleMatcher([][]byte{
+	[]byte("git-upload-pack "),
+	[]byte("git-receive-pack "),
+	[]byte("git-upload-archive "),
+}, nil)
+
+// GitRequest is the parsed request sent by a Git client to a Git daemon. It is
+// added as a hint to connections handled by Git.
+type GitRequest struct {
+	Service string
+	Path    string
+
+	// Host is the value of the host parameter, including the port if
+	// provided by the client.
+	Host string
+
+	// ExtraParams are the extra parameters, such as "version=2".
+	ExtraParams []string
+}
+
+// ParseGitRequest parses the pkt-line containing a Git daemon request.
+func ParseGitRequest(pkt []byte) (*GitRequest, error) {
+	if len(pkt) < 4 {
+		return nil, errors.New("git: pkt-line too short")
+	}
+
+	length, err := strconv.ParseUint(string(pkt[:4]), 16, 16)
+	if err != nil || length <= 4 || length > GitMaxPktLineLength {
+		return nil, errors.New("git: invalid pkt-line length")
+	}
+	if uint64(len(pkt)) < length {
+		return nil, errors.New("git: pkt-line truncated")
+	}
+
+	fields := bytes.Split(pkt[4:length], []byte{0})
+	command := strings.TrimSuffix(string(fields[0]), "\n")
+
+	sp := strings.IndexByte(command, ' ')
+	if sp == -1 || !containsString(GitServices, command[:sp]) {
+		return nil, fmt.Errorf("git: invalid request %q", command)
+	}
+
+	req := &GitRequest{
+		Service: command[:sp],
+		Path:    command[sp+1:],
+	}
+	if req.Path == "" {
+		return nil, errors.New("git: missing repository path")
+	}
+
+	// Extra parameters follow an empty field.
+	extra := false
+	for _, f := range fields[1:] {
+		switch {
+		case len(f) == 0:
+			extra = true
+		case extra:
+			req.ExtraParams = append(req.ExtraParams, string(f))
+		case bytes.HasPrefix(f, []byte("host=")):
+			req.Host = string(f[len("host="):])
+		}
+	}
+
+	return req, nil
+}
+
+// GitMatch is a RouteMatcher for Git requests with matching repository paths,
+// hosts and services. Empty lists match everything.
+type GitMatch struct {
+	PathPrefixes []string
+	Hosts        []string
+	Services     []string
+}
+
+// Matches checks if the route applies to the request. Hosts are compared
+// without the port.
+func (r *GitMatch) Matches(hint interface{}) bool {
+	req, ok := hint.(*GitRequest)
+	if !ok {
+		return false
+	}
+
+	if len(r.Services) > 0 && !containsString(r.Services, req.Service) {
+		return false
+	}
+
+	if len(r.Hosts) > 0 {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !containsFold(r.Hosts, host) {
+			return false
+		}
+	}
+
+	if len(r.PathPrefixes) > 0 {
+		for _, prefix := range r.PathPrefixes {
+			if strings.HasPrefix(req.Path, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// Git detects requests to a Git daemon (git://) by validating the pkt-line
+// they start with, and routes them by repository path, host and service. The
+// *GitRequest is added as a hint to the connection given to the handler.
+//
+// Git over SSH is encrypted, and can only be detected and routed as SSH.
+type Git struct {
+	RouteTable
+
+	Description string
+}
+
+func (g *Git) String() string {
+	return g.Description
+}
+
+// Check validates the pkt-line length and the requested service.
+func (g *Git) Check(header []byte, hints []interface{}) (bool, int) {
+	if len(header) < 4 {
+		for _, c := range header {
+			if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+				return false, 0
+			}
+		}
+		return false, 4
+	}
+
+	length, err := strconv.ParseUint(string(header[:4]), 16, 16)
+	if err != nil || length <= 4 || length > GitMaxPktLineLength {
+		return false, 0
+	}
+
+	ok, needed := gitServiceMatcher.Check(header[4:], hints)
+	switch {
+	case ok:
+		// The service, a space and at least one byte of path
+		return int(length) > 4+bytes.IndexByte(header[4:], ' ')+1, 0
+	case needed == 0:
+		return false, 0
+	default:
+		return false, 4 + needed
+	}
+}
+
+// checkPktLine requires the complete pkt-line.
+func (g *Git) checkPktLine(header []byte, hints []interface{}) (bool, int) {
+	ok, needed := g.Check(header, hints)
+	if !ok {
+		return ok, needed
+	}
+
+	length, _ := strconv.ParseUint(string(header[:4]), 16, 16)
+	if len(header) < int(length) {
+		return false, int(length)
+	}
+	return true, 0
+}
+
+// Handle parses the request and calls the handler of the first matching route.
+func (g *Git) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, GitMaxLookahead, g.checkPktLine)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	req, err := ParseGitRequest(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(req))
+
+	return g.Route(pc, req)
+}
+
+// NewGit returns a Git with the provided handler as fallback.
+func NewGit(handler func(net.Conn) (net.Conn, error)) *Git {
+	return &Git{
+		RouteTable:  RouteTable{Handler: handler},
+		Description: "Git",
+	}
+}
+
+// NewGitProxy returns a Git set up to call DialAndProxy if no routes match.
+func NewGitProxy(proto, dest string) *Git {
+	g := NewGit(ProxyHandler(proto, dest))
+	g.Description = fmt.Sprintf("Git [dest: %s]", dest)
+	return g
+}
@@ -0,0 +1,84 @@
+package proto
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func gitPktLine(s string) []byte {
+	return []byte(fmt.Sprintf("%04x%s", len(s)+4, s))
+}
+
+func TestGit(t *testing.T) {
+	h := NewGit(nil)
+
+	request := gitPktLine("git-upload-pack /project.git\x00host=example.com\x00")
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 4},
+		{[]byte("00"), false, 4},
+		{[]byte("GET "), false, 0},
+		{[]byte("0000"), false, 0},
+		{[]byte("0004"), false, 0},
+		{[]byte("fff1"), false, 0},
+		{request[:4], false, 20},
+		{request[:8], false, 20},
+		{request[:20], true, 0},
+		{request, true, 0},
+		{gitPktLine("git-receive-pack /x\x00"), true, 0},
+		{gitPktLine("git-upload-archive /x\x00"), true, 0},
+		{gitPktLine("git-upload-pack "), false, 0},
+		{gitPktLine("git-frobnicate /x\x00"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestParseGitRequest(t *testing.T) {
+	req, err := ParseGitRequest(gitPktLine("git-upload-pack /project.git\x00host=example.com:9418\x00\x00version=2\x00"))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	expected := GitRequest{
+		Service:     "git-upload-pack",
+		Path:        "/project.git",
+		Host:        "example.com:9418",
+		ExtraParams: []string{"version=2"},
+	}
+	if !reflect.DeepEqual(*req, expected) {
+		t.Errorf("request was %+v, expected %+v", *req, expected)
+	}
+}
+
+func TestGitRoutes(t *testing.T) {
+	r := newRouteRecorder(t, (*GitRequest)(nil))
+
+	h := NewGit(r.handler("default"))
+	h.Routes = []Route{
+		{Matcher: &GitMatch{PathPrefixes: []string{"/mirrors/"}, Services: []string{"git-upload-pack"}}, Handler: r.handler("mirrors")},
+		{Matcher: &GitMatch{Hosts: []string{"git.internal"}}, Handler: r.handler("internal")},
+	}
+
+	r.check(h.Handle, []routeTest{
+		{gitPktLine("git-upload-pack /project.git\x00host=example.com\x00"), "default"},
+		{gitPktLine("git-upload-pack /mirrors/linux.git\x00host=example.com\x00"), "mirrors"},
+		{gitPktLine("git-receive-pack /mirrors/linux.git\x00host=example.com\x00"), "default"},
+		{gitPktLine("git-receive-pack /project.git\x00host=git.internal:9418\x00"), "internal"},
+	})
+}
@@ -0,0 +1,36 @@
+package grpc_test
+
+import (
+	"net"
+
+	"github.com/kennylevinsen/serve2"
+	"github.com/kennylevinsen/serve2/proto"
+	"github.com/kennylevinsen/serve2/proto/grpc"
+)
+
+func ExampleNewProxy() {
+	server := serve2.New()
+
+	tls, err := proto.NewTLS([]string{"h2"}, "cert.pem", "key.pem")
+	if err != nil {
+		panic(err)
+	}
+
+	// Route gRPC services to their backends, and everything else on HTTP/2 to
+	// the default backend.
+	router := grpc.NewProxy("tcp", "localhost:8443")
+	router.Routes = []proto.Route{
+		{
+			Matcher: &grpc.Match{Services: []string{"helloworld.Greeter"}},
+			Handler: proto.ProxyHandler("tcp", "greeter:50051"),
+		},
+	}
+
+	server.AddHandlers(tls, router)
+	l, err := net.Listen("tcp", ":443")
+	if err != nil {
+		panic(err)
+	}
+
+	server.Serve(l)
+}
@@ -0,0 +1,347 @@
+// Package grpc routes HTTP/2 connections by the service of their first gRPC
+// request. It is kept apart from package proto, as it depends on
+// golang.org/x/net/http2/hpack for decoding the request headers.
+package grpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/kennylevinsen/serve2/proto"
+	"github.com/kennylevinsen/serve2/utils"
+	"golang.org/x/net/http2/hpack"
+)
+
+// HTTP/2 field constants
+const (
+	HTTP2Preface         = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	HTTP2FrameHeaderLen  = 9
+	HTTP2MaxFrameSize    = 16384 // Default SETTINGS_MAX_FRAME_SIZE
+	MaxLookahead         = 64 * 1024
+	http2FrameHeaders    = 0x1
+	http2FrameSettings   = 0x4
+	http2FrameContinue   = 0x9
+	http2FlagAck         = 0x1
+	http2FlagEndHeaders  = 0x4
+	http2FlagPadded      = 0x8
+	http2FlagPriority    = 0x20
+	http2HeaderTableSize = 4096
+)
+
+var (
+	http2Preface        = []byte(HTTP2Preface)
+	http2ServerSettings = []byte{0x00, 0x00, 0x00, http2FrameSettings, 0x00, 0x00, 0x00, 0x00, 0x00}
+)
+
+// Request describes the first request on an HTTP/2 connection handled by
+// Router. It is added as a hint to the connection given to the handler.
+type Request struct {
+	Path        string
+	ContentType string
+
+	// Service and Method are only set for gRPC requests.
+	Service string
+	Method  string
+}
+
+// IsGRPC checks if the request is a gRPC request by its content-type.
+func (r *Request) IsGRPC() bool {
+	return r.ContentType == "application/grpc" || strings.HasPrefix(r.ContentType, "application/grpc+")
+}
+
+// http2Frame is a raw HTTP/2 frame.
+type http2Frame struct {
+	Type    byte
+	Flags   byte
+	Stream  uint32
+	Payload []byte
+	Raw     []byte
+}
+
+// readHTTP2Frame reads a single frame, refusing frames larger than the default
+// maximum frame size.
+func readHTTP2Frame(r io.Reader) (*http2Frame, error) {
+	header := make([]byte, HTTP2FrameHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+	if length > HTTP2MaxFrameSize {
+		return nil, errors.New("http2: frame too large")
+	}
+
+	raw := make([]byte, HTTP2FrameHeaderLen+length)
+	copy(raw, header)
+	if _, err := io.ReadFull(r, raw[HTTP2FrameHeaderLen:]); err != nil {
+		return nil, err
+	}
+
+	return &http2Frame{
+		Type:    header[3],
+		Flags:   header[4],
+		Stream:  binary.BigEndian.Uint32(header[5:9]) & 0x7FFFFFFF,
+		Payload: raw[HTTP2FrameHeaderLen:],
+		Raw:     raw,
+	}, nil
+}
+
+// headerBlockFragment strips padding and priority from a HEADERS frame.
+func headerBlockFragment(f *http2Frame) ([]byte, error) {
+	p := f.Payload
+	pad := 0
+	if f.Flags&http2FlagPadded != 0 {
+		if len(p) < 1 {
+			return nil, errors.New("http2: invalid padding")
+		}
+		pad = int(p[0])
+		p = p[1:]
+	}
+	if f.Flags&http2FlagPriority != 0 {
+		if len(p) < 5 {
+			return nil, errors.New("http2: invalid priority")
+		}
+		p = p[5:]
+	}
+	if pad > len(p) {
+		return nil, errors.New("http2: invalid padding")
+	}
+	return p[:len(p)-pad], nil
+}
+
+// ParseRequest decodes an HPACK encoded header block of the first request
+// on a connection.
+func ParseRequest(block []byte) (*Request, error) {
+	fields, err := hpack.NewDecoder(http2HeaderTableSize, nil).DecodeFull(block)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &Request{}
+	for _, f := range fields {
+		switch f.Name {
+		case ":path":
+			req.Path = f.Value
+		case "content-type":
+			req.ContentType = f.Value
+		}
+	}
+
+	if req.Path == "" {
+		return nil, errors.New("grpc: request without :path")
+	}
+
+	if req.IsGRPC() {
+		// /package.Service/Method
+		parts := strings.Split(req.Path, "/")
+		if len(parts) == 3 && parts[0] == "" {
+			req.Service = parts[1]
+			req.Method = parts[2]
+		}
+	}
+
+	return req, nil
+}
+
+// http2AckFilter drops the first SETTINGS ACK frame read from the connection,
+// acknowledging the SETTINGS frame sent by Router rather than the backend.
+type http2AckFilter struct {
+	*utils.ProxyConn
+	buffer []byte
+	done   bool
+}
+
+func (f *http2AckFilter) Read(p []byte) (int, error) {
+	for !f.done && len(f.buffer) == 0 {
+		frame, err := readHTTP2Frame(f.ProxyConn)
+		if err != nil {
+			return 0, err
+		}
+		if frame.Type == http2FrameSettings && frame.Flags&http2FlagAck != 0 {
+			f.done = true
+			continue
+		}
+		f.buffer = frame.Raw
+	}
+
+	if len(f.buffer) > 0 {
+		n := copy(p, f.buffer)
+		f.buffer = f.buffer[n:]
+		return n, nil
+	}
+
+	return f.ProxyConn.Read(p)
+}
+
+// Match is a proto.RouteMatcher for gRPC requests to the listed services, such
+// as "helloworld.Greeter". An empty list matches every gRPC request, while
+// other requests are never matched.
+type Match struct {
+	Services []string
+}
+
+// Matches checks if the route applies to the request.
+func (r *Match) Matches(hint interface{}) bool {
+	req, ok := hint.(*Request)
+	if !ok || !req.IsGRPC() {
+		return false
+	}
+
+	return len(r.Services) == 0 || containsString(r.Services, req.Service)
+}
+
+// Router detects HTTP/2 connections by their connection preface, and routes
+// them by the service of the first gRPC request. Non-gRPC requests and gRPC
+// requests matching no route are given to Handler. The *Request is added as a
+// hint to the connection given to the handler.
+//
+// As HTTP/2 clients may wait for the server SETTINGS frame before sending any
+// requests, Router sends an empty SETTINGS frame, and removes the
+// acknowledgement from the client before it reaches the backend. The first
+// request must be sent within MaxLookahead bytes.
+//
+// All requests on the connection go to the same backend, so clients should use
+// separate connections for services on different backends.
+type Router struct {
+	proto.RouteTable
+
+	Description string
+}
+
+func (g *Router) String() string {
+	return g.Description
+}
+
+// Check verifies the HTTP/2 connection preface.
+func (g *Router) Check(header []byte, _ []interface{}) (bool, int) {
+	if len(header) < len(http2Preface) {
+		if !bytes.HasPrefix(http2Preface, header) {
+			return false, 0
+		}
+		return false, len(http2Preface)
+	}
+
+	return bytes.HasPrefix(header, http2Preface), 0
+}
+
+// Handle reads frames until the first request, and calls the handler of the
+// first matching route.
+func (g *Router) Handle(c net.Conn) (net.Conn, error) {
+	req, pc, err := g.readRequest(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return g.Route(pc, req)
+}
+
+// readRequest reads the preface and frames up to and including the header
+// block of the first request, returning the decoded request and a connection
+// replaying everything but the SETTINGS ACK.
+func (g *Router) readRequest(c net.Conn) (*Request, net.Conn, error) {
+	preface := make([]byte, len(http2Preface))
+	if _, err := io.ReadFull(c, preface); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(preface, http2Preface) {
+		return nil, nil, proto.ErrNoMatch
+	}
+
+	if _, err := c.Write(http2ServerSettings); err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		replay = preface
+		block  []byte
+		stream uint32
+		acked  bool
+	)
+
+	for {
+		f, err := readHTTP2Frame(c)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(replay)+len(f.Raw) > MaxLookahead {
+			return nil, nil, proto.ErrTooLarge
+		}
+
+		if !acked && f.Type == http2FrameSettings && f.Flags&http2FlagAck != 0 {
+			acked = true
+			continue
+		}
+
+		replay = append(replay, f.Raw...)
+
+		switch {
+		case stream == 0 && f.Type == http2FrameHeaders:
+			stream = f.Stream
+			fragment, err := headerBlockFragment(f)
+			if err != nil {
+				return nil, nil, err
+			}
+			block = append(block, fragment...)
+		case stream != 0 && f.Type == http2FrameContinue && f.Stream == stream:
+			block = append(block, f.Payload...)
+		case stream != 0:
+			return nil, nil, errors.New("http2: expected CONTINUATION frame")
+		default:
+			continue
+		}
+
+		if f.Flags&http2FlagEndHeaders != 0 {
+			break
+		}
+	}
+
+	req, err := ParseRequest(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pc := utils.NewProxyConn(c, replay, nil)
+	pc.SetHints(utils.HintsOf(c).Add(req))
+
+	if acked {
+		return req, pc, nil
+	}
+
+	// The filter reads frames, so the preface must be passed on as is.
+	buffer := make([]byte, len(http2Preface))
+	if _, err = io.ReadFull(pc, buffer); err != nil {
+		return nil, nil, err
+	}
+	return req, &http2AckFilter{ProxyConn: pc, buffer: buffer}, nil
+}
+
+// New returns a Router with the provided handler as fallback.
+func New(handler func(net.Conn) (net.Conn, error)) *Router {
+	return &Router{
+		RouteTable:  proto.RouteTable{Handler: handler},
+		Description: "gRPC",
+	}
+}
+
+// NewProxy returns a Router set up to call DialAndProxy if no routes match.
+func NewProxy(network, dest string) *Router {
+	g := New(proto.ProxyHandler(network, dest))
+	g.Description = fmt.Sprintf("gRPC [dest: %s]", dest)
+	return g
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
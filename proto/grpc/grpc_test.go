@@ -0,0 +1,232 @@
+package grpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/serve2/proto"
+	"github.com/kennylevinsen/serve2/utils"
+	"golang.org/x/net/http2/hpack"
+)
+
+func http2TestFrame(typ, flags byte, stream uint32, payload []byte) []byte {
+	f := make([]byte, HTTP2FrameHeaderLen, HTTP2FrameHeaderLen+len(payload))
+	f[0], f[1], f[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	f[3], f[4] = typ, flags
+	binary.BigEndian.PutUint32(f[5:], stream)
+	return append(f, payload...)
+}
+
+func http2TestHeaders(fields ...string) []byte {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	for i := 0; i+1 < len(fields); i += 2 {
+		enc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return buf.Bytes()
+}
+
+// readServerSettings reads the SETTINGS frame sent by Router in the
+// background, as net.Pipe has no buffering.
+func readServerSettings(c net.Conn) chan struct{} {
+	got := make(chan struct{})
+	go func() {
+		io.ReadFull(c, make([]byte, len(http2ServerSettings)))
+		close(got)
+	}()
+	return got
+}
+
+func TestRouter(t *testing.T) {
+	h := New(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 24},
+		{[]byte("PRI"), false, 24},
+		{[]byte("PRI * HTTP/1.1"), false, 0},
+		{[]byte("GET / HTTP/1.1\r\n"), false, 0},
+		{[]byte(HTTP2Preface), true, 0},
+		{append([]byte(HTTP2Preface), http2TestFrame(http2FrameSettings, 0, 0, nil)...), true, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	req, err := ParseRequest(http2TestHeaders(
+		":method", "POST",
+		":scheme", "https",
+		":path", "/helloworld.Greeter/SayHello",
+		":authority", "localhost",
+		"content-type", "application/grpc+proto",
+		"te", "trailers",
+	))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	expected := Request{
+		Path:        "/helloworld.Greeter/SayHello",
+		ContentType: "application/grpc+proto",
+		Service:     "helloworld.Greeter",
+		Method:      "SayHello",
+	}
+	if *req != expected || !req.IsGRPC() {
+		t.Errorf("request was %+v, expected %+v", *req, expected)
+	}
+
+	req, err = ParseRequest(http2TestHeaders(":method", "GET", ":path", "/index.html"))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if req.IsGRPC() || req.Service != "" {
+		t.Errorf("plain request parsed as gRPC: %+v", *req)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	type result struct {
+		name   string
+		stream []byte
+	}
+
+	routed := make(chan result, 1)
+	handler := func(name string) func(net.Conn) (net.Conn, error) {
+		return func(c net.Conn) (net.Conn, error) {
+			hints := utils.GetHints(c)
+			if _, ok := hints[len(hints)-1].(*Request); !ok {
+				t.Errorf("request hint missing")
+			}
+			go func() {
+				stream, _ := ioutil.ReadAll(c)
+				routed <- result{name, stream}
+			}()
+			return nil, nil
+		}
+	}
+
+	h := New(handler("default"))
+	h.Routes = []proto.Route{
+		{Matcher: &Match{Services: []string{"helloworld.Greeter"}}, Handler: handler("greeter")},
+		{Matcher: &Match{Services: []string{"grpc.health.v1.Health"}}, Handler: handler("health")},
+	}
+
+	settings := http2TestFrame(http2FrameSettings, 0, 0, []byte{0x00, 0x04, 0x00, 0x01, 0x00, 0x00})
+	windowUpdate := http2TestFrame(0x8, 0, 0, []byte{0x00, 0x0f, 0x00, 0x01})
+	ack := http2TestFrame(http2FrameSettings, http2FlagAck, 0, nil)
+
+	tests := []struct {
+		headers []byte
+		route   string
+	}{
+		{http2TestHeaders(":method", "POST", ":path", "/helloworld.Greeter/SayHello", "content-type", "application/grpc"), "greeter"},
+		{http2TestHeaders(":method", "POST", ":path", "/grpc.health.v1.Health/Check", "content-type", "application/grpc"), "health"},
+		{http2TestHeaders(":method", "POST", ":path", "/other.Service/Call", "content-type", "application/grpc"), "default"},
+		{http2TestHeaders(":method", "GET", ":path", "/helloworld.Greeter/SayHello"), "default"},
+	}
+
+	for _, test := range tests {
+		server, client := net.Pipe()
+
+		// Split the header block over HEADERS and CONTINUATION frames
+		half := len(test.headers) / 2
+		headers := http2TestFrame(http2FrameHeaders, 0, 1, test.headers[:half])
+		continuation := http2TestFrame(http2FrameContinue, http2FlagEndHeaders, 1, test.headers[half:])
+
+		go func() {
+			got := readServerSettings(client)
+			client.Write([]byte(HTTP2Preface))
+			client.Write(settings)
+			client.Write(windowUpdate)
+
+			// Wait for the server SETTINGS before acknowledging and sending
+			// the request, as a real client would.
+			<-got
+			client.Write(ack)
+			client.Write(headers)
+			client.Write(continuation)
+			client.Close()
+		}()
+
+		if _, err := h.Handle(server); err != nil {
+			t.Errorf("handle failed: %v", err)
+		}
+
+		select {
+		case r := <-routed:
+			if r.name != test.route {
+				t.Errorf("%q routed to %s, expected %s", test.headers, r.name, test.route)
+			}
+
+			var expected []byte
+			expected = append(expected, HTTP2Preface...)
+			expected = append(expected, settings...)
+			expected = append(expected, windowUpdate...)
+			expected = append(expected, headers...)
+			expected = append(expected, continuation...)
+			if !bytes.Equal(r.stream, expected) {
+				t.Errorf("backend stream was %q, expected %q", r.stream, expected)
+			}
+		case <-time.After(300 * time.Millisecond):
+			t.Errorf("timed out waiting for %q to be routed", test.headers)
+		}
+
+		server.Close()
+	}
+}
+
+func TestLateAck(t *testing.T) {
+	stream := make(chan []byte, 1)
+	h := New(func(c net.Conn) (net.Conn, error) {
+		go func() {
+			b, _ := ioutil.ReadAll(c)
+			stream <- b
+		}()
+		return nil, nil
+	})
+
+	server, client := net.Pipe()
+	defer server.Close()
+
+	headers := http2TestFrame(http2FrameHeaders, http2FlagEndHeaders, 1,
+		http2TestHeaders(":method", "POST", ":path", "/a.B/C", "content-type", "application/grpc"))
+	data := http2TestFrame(0x0, 0x1, 1, []byte("hello"))
+
+	go func() {
+		got := readServerSettings(client)
+		client.Write([]byte(HTTP2Preface))
+		client.Write(headers)
+		<-got
+		client.Write(http2TestFrame(http2FrameSettings, http2FlagAck, 0, nil))
+		client.Write(data)
+		client.Close()
+	}()
+
+	if _, err := h.Handle(server); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+
+	expected := append(append([]byte(HTTP2Preface), headers...), data...)
+	if b := <-stream; !bytes.Equal(b, expected) {
+		t.Errorf("backend stream was %q, expected %q", b, expected)
+	}
+}
@@ -0,0 +1,189 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// Kafka field constants
+const (
+	KafkaAPIVersions    = 18
+	KafkaMaxAPIKey      = 74
+	KafkaMaxAPIVersion  = 20
+	KafkaMaxRequestSize = 1 << 20 // Bound for the first request
+	KafkaMaxLookahead   = 1024
+	kafkaHeaderLen      = 4 + 2 + 2 + 4 + 2
+
+	// kafkaPostgresStartup is the API key and version of Metadata v0, which
+	// is also the protocol version of a PostgreSQL StartupMessage.
+	kafkaPostgresStartup = PostgresProtocolMajor << 16
+)
+
+var errKafka = errors.New("kafka: invalid request header")
+
+// KafkaRequest is the parsed header of the first request sent by a Kafka
+// client. It is added as a hint to connections handled by Kafka. ClientID is
+// only available if it was within the first KafkaMaxLookahead bytes.
+type KafkaRequest struct {
+	APIKey        int16
+	APIVersion    int16
+	CorrelationID int32
+	ClientID      string
+}
+
+// ParseKafkaRequest parses the size and request header of a request. If more
+// data is needed, the amount of bytes is returned as needed, with a nil request
+// and error.
+func ParseKafkaRequest(header []byte) (req *KafkaRequest, needed int, err error) {
+	// Checked field by field as they arrive, starting with the high byte of
+	// the size.
+	if len(header) >= 1 && header[0] != 0 {
+		return nil, 0, errKafka
+	}
+
+	var size int
+	if len(header) >= 4 {
+		size = int(binary.BigEndian.Uint32(header))
+		if size < kafkaHeaderLen-4 || size > KafkaMaxRequestSize {
+			return nil, 0, errKafka
+		}
+	}
+
+	if len(header) >= 6 {
+		key := int16(binary.BigEndian.Uint16(header[4:]))
+		if key < 0 || key > KafkaMaxAPIKey {
+			return nil, 0, errKafka
+		}
+	}
+
+	if len(header) >= 8 {
+		version := int16(binary.BigEndian.Uint16(header[6:]))
+		if version < 0 || version > KafkaMaxAPIVersion {
+			return nil, 0, errKafka
+		}
+	}
+
+	if len(header) < kafkaHeaderLen {
+		return nil, kafkaHeaderLen, nil
+	}
+
+	clientIDLength := int(int16(binary.BigEndian.Uint16(header[12:])))
+	if clientIDLength < -1 || clientIDLength > size-(kafkaHeaderLen-4) {
+		return nil, 0, errKafka
+	}
+
+	// A PostgreSQL StartupMessage parses as a Metadata v0 request, with its
+	// startup parameters in place of the client ID. Such requests are only
+	// accepted once the client ID is available and has none of the NUL bytes
+	// terminating the parameters.
+	if binary.BigEndian.Uint32(header[4:]) == kafkaPostgresStartup && clientIDLength > 0 {
+		end := kafkaHeaderLen + clientIDLength
+		switch {
+		case end > KafkaMaxLookahead:
+			return nil, 0, errKafka
+		case len(header) < end:
+			return nil, end, nil
+		case bytes.IndexByte(header[kafkaHeaderLen:end], 0) != -1:
+			return nil, 0, errKafka
+		}
+	}
+
+	req = &KafkaRequest{
+		APIKey:        int16(binary.BigEndian.Uint16(header[4:])),
+		APIVersion:    int16(binary.BigEndian.Uint16(header[6:])),
+		CorrelationID: int32(binary.BigEndian.Uint32(header[8:])),
+	}
+
+	if clientIDLength > 0 && len(header) >= kafkaHeaderLen+clientIDLength {
+		req.ClientID = string(header[kafkaHeaderLen : kafkaHeaderLen+clientIDLength])
+	}
+
+	return req, 0, nil
+}
+
+// Kafka detects Kafka clients by the size and request header of their first
+// request, which is usually ApiVersions. The *KafkaRequest is added as a hint
+// to the connection given to the handler.
+//
+// A PostgreSQL StartupMessage has the layout of a Metadata v0 request, so the
+// client ID of such requests is checked for the NUL bytes of startup
+// parameters, letting Kafka and Postgres be served in any order.
+type Kafka struct {
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (k *Kafka) String() string {
+	return k.Description
+}
+
+// MaxLookahead returns KafkaMaxLookahead.
+func (k *Kafka) MaxLookahead() int {
+	return KafkaMaxLookahead
+}
+
+// Check validates the request size, API key, API version and client ID length.
+func (k *Kafka) Check(header []byte, _ []interface{}) (bool, int) {
+	req, needed, err := ParseKafkaRequest(header)
+	if err != nil || req == nil {
+		return false, needed
+	}
+	return true, 0
+}
+
+// checkClientID requires the client ID if it is within KafkaMaxLookahead.
+func (k *Kafka) checkClientID(header []byte, hints []interface{}) (bool, int) {
+	ok, needed := k.Check(header, hints)
+	if !ok {
+		return ok, needed
+	}
+
+	total := kafkaHeaderLen + int(int16(binary.BigEndian.Uint16(header[12:])))
+	if total > KafkaMaxLookahead {
+		return true, 0
+	}
+	if len(header) < total {
+		return false, total
+	}
+	return true, 0
+}
+
+// Handle parses the request header, adds it as a hint and calls the handler.
+func (k *Kafka) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, KafkaMaxLookahead, k.checkClientID)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	req, _, err := ParseKafkaRequest(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(req))
+	return k.Handler(pc)
+}
+
+// NewKafka returns a Kafka with the provided handler.
+func NewKafka(handler func(net.Conn) (net.Conn, error)) *Kafka {
+	return &Kafka{
+		Handler:     handler,
+		Description: "Kafka",
+	}
+}
+
+// NewKafkaProxy returns a Kafka set up to call DialAndProxy. As brokers
+// advertise their own addresses to clients, the destination should advertise
+// the address of the serve2 listener.
+func NewKafkaProxy(proto, dest string) *Kafka {
+	k := NewKafka(ProxyHandler(proto, dest))
+	k.Description = fmt.Sprintf("Kafka [dest: %s]", dest)
+	return k
+}
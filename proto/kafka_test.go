@@ -0,0 +1,82 @@
+package proto
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func kafkaRequest(key, version int16, clientID string, body string) []byte {
+	req := make([]byte, kafkaHeaderLen)
+	binary.BigEndian.PutUint16(req[4:], uint16(key))
+	binary.BigEndian.PutUint16(req[6:], uint16(version))
+	binary.BigEndian.PutUint32(req[8:], 1)
+	binary.BigEndian.PutUint16(req[12:], uint16(len(clientID)))
+	req = append(req, clientID...)
+	req = append(req, body...)
+	binary.BigEndian.PutUint32(req, uint32(len(req)-4))
+	return req
+}
+
+func TestKafka(t *testing.T) {
+	h := NewKafka(nil)
+
+	apiVersions := kafkaRequest(KafkaAPIVersions, 3, "adminclient-1", "\x00\x12apache-kafka-java\x063.6.1\x00")
+	metadata := kafkaRequest(3, 0, "consumer-1", "\x00\x00\x00\x00")
+	startup := postgresMessage(3<<16, "user", "postgres", "database", "postgres",
+		"application_name", "psql", "client_encoding", "UTF8", "options", "-c search_path=public,extensions -c statement_timeout=0")
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, kafkaHeaderLen},
+		{apiVersions[:4], false, kafkaHeaderLen},
+		{apiVersions[:8], false, kafkaHeaderLen},
+		{apiVersions, true, 0},
+		{kafkaRequest(3, 0, "", ""), true, 0},
+		{metadata[:kafkaHeaderLen], false, kafkaHeaderLen + len("consumer-1")},
+		{metadata, true, 0},
+		{startup[:kafkaHeaderLen], false, kafkaHeaderLen + int(startup[13])},
+		{startup, false, 0},
+		{[]byte("\x00\x00\x00\x0a\x00\x12\x00\x00\x00\x00\x00\x01\xff\xff"), true, 0},
+		{[]byte("\x01"), false, 0},
+		{[]byte("\x00\x00\x00\x09"), false, 0},
+		{[]byte("\x00\x20\x00\x00"), false, 0},
+		{[]byte("\x00\x00\x00\x20\x00\x4b"), false, 0},
+		{[]byte("\x00\x00\x00\x20\xff\xff"), false, 0},
+		{[]byte("\x00\x00\x00\x20\x00\x12\x00\x15"), false, 0},
+		{[]byte("\x00\x00\x00\x0a\x00\x12\x00\x00\x00\x00\x00\x01\x00\x01"), false, 0},
+		{[]byte("\x00\x00\x00\x0a\x00\x12\x00\x00\x00\x00\x00\x01\xff\xfe"), false, 0},
+		{[]byte("GET / HTTP/1.1"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestParseKafkaRequest(t *testing.T) {
+	req, _, err := ParseKafkaRequest(kafkaRequest(KafkaAPIVersions, 3, "adminclient-1", "\x00"))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	expected := KafkaRequest{
+		APIKey:        KafkaAPIVersions,
+		APIVersion:    3,
+		CorrelationID: 1,
+		ClientID:      "adminclient-1",
+	}
+	if *req != expected {
+		t.Errorf("request was %+v, expected %+v", *req, expected)
+	}
+}
@@ -0,0 +1,262 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// LDAP field constants
+const (
+	LDAPBindRequest     = 0x60
+	LDAPSearchRequest   = 0x63
+	LDAPExtendedRequest = 0x77
+	LDAPStartTLSOID     = "1.3.6.1.4.1.1466.20037"
+	LDAPMaxLookahead    = 4096
+	ldapMaxLength       = 1 << 24
+	berSequence         = 0x30
+	berInteger          = 0x02
+	ldapRequestName     = 0x80
+	ldapResponseName    = 0x8A
+	ldapExtendedResp    = 0x78
+)
+
+var errLDAP = errors.New("ldap: invalid message")
+
+// LDAPMessage describes the first message sent by an LDAP client. It is added
+// as a hint to connections handled by LDAP.
+type LDAPMessage struct {
+	MessageID int
+
+	// Operation is the tag of the request, such as LDAPBindRequest.
+	Operation byte
+
+	// RequestName is the OID of an ExtendedRequest, if it was within the
+	// first LDAPMaxLookahead bytes.
+	RequestName string
+
+	// Length is the length of the message, including the tag and length.
+	Length int
+
+	// id is the encoded message ID, used for replies.
+	id []byte
+}
+
+// IsStartTLS checks if the message is a StartTLS ExtendedRequest.
+func (m *LDAPMessage) IsStartTLS() bool {
+	return m.Operation == LDAPExtendedRequest && m.RequestName == LDAPStartTLSOID
+}
+
+// berLength decodes a definite BER length at pos, returning the length and the
+// position after it. If more data is needed, the amount of bytes is returned
+// as needed.
+func berLength(b []byte, pos int) (length, next, needed int, err error) {
+	if len(b) <= pos {
+		return 0, 0, pos + 1, nil
+	}
+	if b[pos] < 0x80 {
+		return int(b[pos]), pos + 1, 0, nil
+	}
+
+	n := int(b[pos] & 0x7F)
+	if n == 0 || n > 4 {
+		return 0, 0, 0, errLDAP
+	}
+	if len(b) < pos+1+n {
+		return 0, 0, pos + 1 + n, nil
+	}
+
+	for _, c := range b[pos+1 : pos+1+n] {
+		length = length<<8 | int(c)
+	}
+	if length > ldapMaxLength {
+		return 0, 0, 0, errLDAP
+	}
+	return length, pos + 1 + n, 0, nil
+}
+
+// ParseLDAPMessage parses the envelope of an LDAPMessage up to the tag and
+// length of the request, which must be a BindRequest, SearchRequest or
+// ExtendedRequest. If more data is needed, the amount of bytes is returned as
+// needed, with a nil message and error.
+func ParseLDAPMessage(header []byte) (msg *LDAPMessage, needed int, err error) {
+	if len(header) >= 1 && header[0] != berSequence {
+		return nil, 0, errLDAP
+	}
+
+	length, pos, needed, err := berLength(header, 1)
+	if needed > 0 || err != nil {
+		return nil, needed, err
+	}
+
+	// messageID INTEGER (1..4 bytes, positive)
+	if len(header) >= pos+1 && header[pos] != berInteger {
+		return nil, 0, errLDAP
+	}
+	if len(header) >= pos+2 && (header[pos+1] < 1 || header[pos+1] > 4) {
+		return nil, 0, errLDAP
+	}
+	if len(header) < pos+3 {
+		return nil, pos + 3, nil
+	}
+	if header[pos+2]&0x80 != 0 {
+		return nil, 0, errLDAP
+	}
+
+	idEnd := pos + 2 + int(header[pos+1])
+	if len(header) < idEnd+2 {
+		return nil, idEnd + 2, nil
+	}
+
+	op := header[idEnd]
+	switch op {
+	case LDAPBindRequest, LDAPSearchRequest, LDAPExtendedRequest:
+	default:
+		return nil, 0, errLDAP
+	}
+
+	opLength, opPos, needed, err := berLength(header, idEnd+1)
+	if needed > 0 || err != nil {
+		return nil, needed, err
+	}
+	if opPos+opLength > pos+length {
+		return nil, 0, errLDAP
+	}
+
+	msg = &LDAPMessage{
+		Operation: op,
+		Length:    pos + length,
+		id:        header[pos:idEnd],
+	}
+	for _, c := range header[pos+2 : idEnd] {
+		msg.MessageID = msg.MessageID<<8 | int(c)
+	}
+
+	// requestName [0] LDAPOID
+	if op == LDAPExtendedRequest && len(header) >= opPos+2 && header[opPos] == ldapRequestName {
+		nameLength := int(header[opPos+1])
+		if nameLength < 0x80 && len(header) >= opPos+2+nameLength {
+			msg.RequestName = string(header[opPos+2 : opPos+2+nameLength])
+		}
+	}
+
+	return msg, 0, nil
+}
+
+// ldapStartTLSResponse returns a successful ExtendedResponse to a StartTLS
+// request.
+func ldapStartTLSResponse(msg *LDAPMessage) []byte {
+	// resultCode success, empty matchedDN and diagnosticMessage
+	op := []byte{0x0A, 0x01, 0x00, 0x04, 0x00, 0x04, 0x00, ldapResponseName, byte(len(LDAPStartTLSOID))}
+	op = append(op, LDAPStartTLSOID...)
+
+	resp := []byte{berSequence, byte(len(msg.id) + 2 + len(op))}
+	resp = append(resp, msg.id...)
+	resp = append(resp, ldapExtendedResp, byte(len(op)))
+	return append(resp, op...)
+}
+
+// LDAP detects LDAP clients by the BER envelope of their first message, which
+// must be a BindRequest, SearchRequest or ExtendedRequest. The *LDAPMessage is
+// added as a hint to the connection given to the handler.
+//
+// StartTLS is answered by LDAP itself if TLS is set, after which TLS is
+// terminated using the TLS configuration and the connection is returned as a
+// transport. Otherwise, StartTLS is passed on to the handler.
+type LDAP struct {
+	// TLS is used to terminate TLS on StartTLS if set.
+	TLS *TLS
+
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (l *LDAP) String() string {
+	return l.Description
+}
+
+// Check validates the message envelope and the request tag.
+func (l *LDAP) Check(header []byte, _ []interface{}) (bool, int) {
+	msg, needed, err := ParseLDAPMessage(header)
+	if err != nil || msg == nil {
+		return false, needed
+	}
+	return true, 0
+}
+
+// checkLookahead requires as much of the message as possible within
+// LDAPMaxLookahead.
+func (l *LDAP) checkLookahead(header []byte, hints []interface{}) (bool, int) {
+	msg, needed, err := ParseLDAPMessage(header)
+	if err != nil || msg == nil {
+		return false, needed
+	}
+
+	total := msg.Length
+	if total > LDAPMaxLookahead {
+		total = LDAPMaxLookahead
+	}
+	if len(header) < total {
+		return false, total
+	}
+	return true, 0
+}
+
+// Handle parses the first message, answering StartTLS if TLS is set, and
+// otherwise calls the handler.
+func (l *LDAP) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, LDAPMaxLookahead, l.checkLookahead)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	msg, _, err := ParseLDAPMessage(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if msg.IsStartTLS() && l.TLS != nil {
+		for _, h := range pc.Hints() {
+			if x, ok := h.(*LDAPMessage); ok && x.IsStartTLS() {
+				c.Close()
+				return nil, errors.New("ldap: repeated StartTLS")
+			}
+		}
+
+		// Consume the request, as it is answered here.
+		if _, err = io.ReadFull(pc, make([]byte, msg.Length)); err != nil {
+			c.Close()
+			return nil, err
+		}
+		pc.SetHints(utils.HintsOf(pc).Add(msg))
+
+		if _, err = pc.Write(ldapStartTLSResponse(msg)); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return l.TLS.Handle(pc)
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(msg))
+	return l.Handler(pc)
+}
+
+// NewLDAP returns an LDAP with the provided handler.
+func NewLDAP(handler func(net.Conn) (net.Conn, error)) *LDAP {
+	return &LDAP{
+		Handler:     handler,
+		Description: "LDAP",
+	}
+}
+
+// NewLDAPProxy returns an LDAP set up to call DialAndProxy.
+func NewLDAPProxy(proto, dest string) *LDAP {
+	l := NewLDAP(ProxyHandler(proto, dest))
+	l.Description = fmt.Sprintf("LDAP [dest: %s]", dest)
+	return l
+}
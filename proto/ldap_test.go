@@ -0,0 +1,138 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+var (
+	// Anonymous simple bind, version 3
+	ldapBind = []byte("\x30\x0c\x02\x01\x01\x60\x07\x02\x01\x03\x04\x00\x80\x00")
+
+	// Root DSE search for objectClass
+	ldapSearch = []byte("\x30\x25\x02\x01\x01\x63\x20\x04\x00\x0a\x01\x00\x0a\x01\x00\x02\x01\x00\x02\x01\x00\x01\x01\x00\x87\x0bobjectclass\x30\x00")
+
+	ldapStartTLS = []byte("\x30\x1d\x02\x01\x01\x77\x18\x80\x16" + LDAPStartTLSOID)
+)
+
+func TestLDAP(t *testing.T) {
+	h := NewLDAP(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 2},
+		{[]byte("\x30"), false, 2},
+		{[]byte("\x30\x0c"), false, 5},
+		{[]byte("\x30\x0c\x02\x01\x01"), false, 7},
+		{[]byte("\x30\x84\x00\x00"), false, 6},
+		{ldapBind, true, 0},
+		{ldapBind[:7], true, 0},
+		{ldapSearch, true, 0},
+		{ldapStartTLS, true, 0},
+		{[]byte("\x30\x84\x00\x00\x00\x0c\x02\x01\x01\x60\x07"), true, 0},
+		{[]byte("\x30\x0c\x02\x02\x01\x00\x60\x06"), true, 0},
+		{[]byte("\x31"), false, 0},
+		{[]byte("\x30\x80"), false, 0},
+		{[]byte("\x30\x85"), false, 0},
+		{[]byte("\x30\x0c\x04"), false, 0},
+		{[]byte("\x30\x0c\x02\x05"), false, 0},
+		{[]byte("\x30\x0c\x02\x01\xff"), false, 0},
+		{[]byte("\x30\x0c\x02\x01\x01\x42\x00"), false, 0},
+		{[]byte("\x30\x0c\x02\x01\x01\x60\x20"), false, 0},
+		{[]byte("\x16\x03\x01\x00\xa5\x01"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestParseLDAPMessage(t *testing.T) {
+	tests := []struct {
+		payload []byte
+		id      int
+		op      byte
+		name    string
+	}{
+		{ldapBind, 1, LDAPBindRequest, ""},
+		{ldapSearch, 1, LDAPSearchRequest, ""},
+		{ldapStartTLS, 1, LDAPExtendedRequest, LDAPStartTLSOID},
+		{[]byte("\x30\x0d\x02\x02\x01\x00\x60\x07\x02\x01\x03\x04\x00\x80\x00"), 256, LDAPBindRequest, ""},
+	}
+
+	for _, test := range tests {
+		msg, _, err := ParseLDAPMessage(test.payload)
+		if err != nil {
+			t.Errorf("parse failed for %q: %v", test.payload, err)
+			continue
+		}
+		if msg.MessageID != test.id || msg.Operation != test.op || msg.RequestName != test.name {
+			t.Errorf("%q parsed as %+v", test.payload, msg)
+		}
+		if msg.Length != len(test.payload) {
+			t.Errorf("length of %q was %d, expected %d", test.payload, msg.Length, len(test.payload))
+		}
+	}
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	h := NewLDAP(nil)
+	h.TLS = &TLS{}
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go client.Write(ldapStartTLS)
+
+	result := make(chan net.Conn, 1)
+	go func() {
+		transport, err := h.Handle(server)
+		if err != nil {
+			t.Errorf("handle failed: %v", err)
+		}
+		result <- transport
+	}()
+
+	msg, _, _ := ParseLDAPMessage(ldapStartTLS)
+	expected := ldapStartTLSResponse(msg)
+	reply := make([]byte, len(expected))
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Equal(reply, expected) {
+		t.Errorf("reply was %q, expected %q", reply, expected)
+	}
+	if _, _, err := ParseLDAPMessage(append([]byte{}, reply...)); err != errLDAP {
+		t.Errorf("reply parsed as a request: %v", err)
+	}
+
+	transport := <-result
+	if transport == nil {
+		t.Fatalf("no transport returned")
+	}
+
+	found := false
+	for _, hint := range utils.GetHints(transport) {
+		if m, ok := hint.(*LDAPMessage); ok && m.IsStartTLS() {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("StartTLS hint missing")
+	}
+}
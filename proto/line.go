@@ -0,0 +1,186 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// Line field constants
+const (
+	DefaultLineMaxLength = 512
+)
+
+// TextLine is the parsed first line of a line-oriented protocol. It is added as
+// a hint to connections handled by Line.
+type TextLine struct {
+	// Protocol is the name of the protocol that matched the line.
+	Protocol string
+
+	// Command is the first word of the line, and Args the remaining words
+	// separated by spaces.
+	Command string
+	Args    []string
+
+	// Raw is the line without the line ending.
+	Raw string
+}
+
+// Line detects line-oriented protocols by the grammar of the first line. The
+// first word must be one of Commands, and once the line is complete, Validate
+// must accept it. Lines are terminated by LF, optionally preceded by CR, and
+// may only contain printable characters and tabs.
+//
+// Unknown commands are dismissed as soon as the first word can no longer
+// match, so that Line does not hold up other protocols while waiting for the
+// end of the line.
+//
+// As the whole line is validated, Line declares MaxLength as its lookahead,
+// which the server reads up to if needed.
+type Line struct {
+	Protocol string
+	Commands []string
+
+	// FoldCase makes the command comparison case-insensitive.
+	FoldCase bool
+
+	// MaxLength is the maximum length of the line, including the line ending.
+	MaxLength int
+
+	// Validate checks the complete line, and may be nil.
+	Validate func(*TextLine) bool
+
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (l *Line) String() string {
+	return l.Description
+}
+
+func (l *Line) maxLength() int {
+	if l.MaxLength == 0 {
+		return DefaultLineMaxLength
+	}
+	return l.MaxLength
+}
+
+// MaxLookahead returns the maximum length of the line.
+func (l *Line) MaxLookahead() int {
+	return l.maxLength()
+}
+
+// commandPrefix checks if word is a prefix of one of the commands, or if
+// complete is set, one of the commands.
+func (l *Line) commandPrefix(word []byte, complete bool) bool {
+	for _, cmd := range l.Commands {
+		if complete && len(cmd) != len(word) || len(cmd) < len(word) {
+			continue
+		}
+		if l.FoldCase && strings.EqualFold(cmd[:len(word)], string(word)) ||
+			!l.FoldCase && cmd[:len(word)] == string(word) {
+			return true
+		}
+	}
+	return false
+}
+
+// parse parses the first line. If more data is needed, the amount of bytes is
+// returned as needed, with a nil line and error.
+func (l *Line) parse(header []byte) (*TextLine, int, error) {
+	max := l.maxLength()
+
+	end := bytes.IndexByte(header, '\n')
+	line := header
+	if end != -1 {
+		line = bytes.TrimSuffix(header[:end], []byte("\r"))
+	}
+
+	for i, c := range line {
+		if c < 0x20 && c != '\t' || c == 0x7F {
+			// A CR is only allowed before the LF, which may not be here yet
+			if c == '\r' && end == -1 && i == len(line)-1 {
+				continue
+			}
+			return nil, 0, errors.New("line: invalid character")
+		}
+	}
+
+	sp := bytes.IndexByte(line, ' ')
+	word := line
+	if sp != -1 {
+		word = line[:sp]
+	}
+	if !l.commandPrefix(word, sp != -1 || end != -1) {
+		return nil, 0, errors.New("line: unknown command")
+	}
+
+	if end == -1 {
+		if len(header) >= max {
+			return nil, 0, errors.New("line: line too long")
+		}
+		return nil, len(header) + 1, nil
+	}
+
+	if end+1 > max {
+		return nil, 0, errors.New("line: line too long")
+	}
+
+	fields := strings.Split(string(line), " ")
+	tl := &TextLine{
+		Protocol: l.Protocol,
+		Command:  fields[0],
+		Args:     fields[1:],
+		Raw:      string(line),
+	}
+
+	if l.Validate != nil && !l.Validate(tl) {
+		return nil, 0, fmt.Errorf("line: invalid %s line", l.Protocol)
+	}
+
+	return tl, 0, nil
+}
+
+// Check validates the first line.
+func (l *Line) Check(header []byte, _ []interface{}) (bool, int) {
+	tl, needed, err := l.parse(header)
+	if err != nil || tl == nil {
+		return false, needed
+	}
+	return true, 0
+}
+
+// Handle parses the first line, adds it as a hint and calls the handler.
+func (l *Line) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, l.maxLength(), l.Check)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	tl, _, err := l.parse(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(tl))
+	return l.Handler(pc)
+}
+
+// NewLine returns a Line for the protocol and its commands, with the provided
+// handler.
+func NewLine(protocol string, commands []string, validate func(*TextLine) bool, handler func(net.Conn) (net.Conn, error)) *Line {
+	return &Line{
+		Protocol:    protocol,
+		Commands:    commands,
+		MaxLength:   DefaultLineMaxLength,
+		Validate:    validate,
+		Handler:     handler,
+		Description: protocol,
+	}
+}
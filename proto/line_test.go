@@ -0,0 +1,112 @@
+package proto
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+func TestLine(t *testing.T) {
+	h := NewLine("test", []string{"HELO", "HELP"}, nil, nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 1},
+		{[]byte("H"), false, 2},
+		{[]byte("HEL"), false, 4},
+		{[]byte("HELO"), false, 5},
+		{[]byte("HELO "), false, 6},
+		{[]byte("HELO x\r"), false, 8},
+		{[]byte("HELO x\r\n"), true, 0},
+		{[]byte("HELO x\n"), true, 0},
+		{[]byte("HELP\r\n"), true, 0},
+		{[]byte("HELLO"), false, 0},
+		{[]byte("HELOS x\r\n"), false, 0},
+		{[]byte("helo x\r\n"), false, 0},
+		{[]byte("HELO \x00"), false, 0},
+		{[]byte("HELO x\ry\r\n"), false, 0},
+		{[]byte(" HELO\r\n"), false, 0},
+		{[]byte("GET / HTTP/1.1"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestLineLimits(t *testing.T) {
+	h := NewLine("test", []string{"helo"}, nil, nil)
+	h.FoldCase = true
+	h.MaxLength = 10
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{[]byte("HeLo x\r\n"), true, 0},
+		{[]byte("HELO 1234"), false, 10},
+		{[]byte("HELO 12345"), false, 0},
+		{[]byte("HELO 1234\n"), true, 0},
+		{[]byte("HELO 12345\n"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestLineHint(t *testing.T) {
+	lines := make(chan *TextLine, 1)
+	h := NewLine("test", []string{"HELO"}, nil, func(c net.Conn) (net.Conn, error) {
+		hints := utils.GetHints(c)
+		tl, _ := hints[len(hints)-1].(*TextLine)
+		lines <- tl
+		return nil, nil
+	})
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("HELO a  b\r\n"))
+	if _, err := h.Handle(server); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+
+	expected := &TextLine{
+		Protocol: "test",
+		Command:  "HELO",
+		Args:     []string{"a", "", "b"},
+		Raw:      "HELO a  b",
+	}
+
+	select {
+	case tl := <-lines:
+		if !reflect.DeepEqual(tl, expected) {
+			t.Errorf("line parsed as %+v, expected %+v", tl, expected)
+		}
+	case <-time.After(300 * time.Millisecond):
+		t.Errorf("no hint added")
+	}
+}
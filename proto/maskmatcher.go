@@ -0,0 +1,123 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errMaskPattern = errors.New("mask: invalid pattern")
+
+// ParseMaskPattern parses a pattern of space separated bytes in hex, such as
+// "16 03 ?? ?? ?? 01". A byte may be "??" to match anything, have a nibble
+// replaced by "?", such as "0?", or be followed by an explicit mask, such as
+// "40/c0". It returns the values and masks of the bytes.
+func ParseMaskPattern(pattern string) (value, mask []byte, err error) {
+	for _, field := range strings.Fields(pattern) {
+		v, m, masked := field, "", false
+		if i := strings.IndexByte(field, '/'); i != -1 {
+			v, m, masked = field[:i], field[i+1:], true
+		}
+		if len(v) != 2 || masked && len(m) != 2 {
+			return nil, nil, fmt.Errorf("%v: %q", errMaskPattern, field)
+		}
+
+		var b, bm byte
+		for i := 0; i < 2; i++ {
+			b, bm = b<<4, bm<<4
+			if v[i] == '?' {
+				continue
+			}
+			n, err := strconv.ParseUint(v[i:i+1], 16, 8)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%v: %q", errMaskPattern, field)
+			}
+			b, bm = b|byte(n), bm|0xF
+		}
+
+		if masked {
+			n, err := strconv.ParseUint(m, 16, 8)
+			if err != nil || bm != 0xFF {
+				return nil, nil, fmt.Errorf("%v: %q", errMaskPattern, field)
+			}
+			bm = byte(n)
+		}
+
+		value = append(value, b&bm)
+		mask = append(mask, bm)
+	}
+
+	if len(value) == 0 {
+		return nil, nil, fmt.Errorf("%v: empty", errMaskPattern)
+	}
+	return value, mask, nil
+}
+
+// MaskMatcher matches header bytes from Offset against Value, only comparing
+// the bits set in Mask. Bytes of Value without a corresponding byte in Mask
+// are compared in full. The header is dismissed as soon as a byte does not
+// match.
+type MaskMatcher struct {
+	Offset int
+	Value  []byte
+	Mask   []byte
+
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (m *MaskMatcher) String() string {
+	return m.Description
+}
+
+// MaxLookahead returns the end of the pattern.
+func (m *MaskMatcher) MaxLookahead() int {
+	return m.Offset + len(m.Value)
+}
+
+// Check compares the available bytes of the pattern.
+func (m *MaskMatcher) Check(header []byte, _ []interface{}) (bool, int) {
+	if len(header) > m.Offset {
+		for i, b := range header[m.Offset:] {
+			if i == len(m.Value) {
+				break
+			}
+			mask := byte(0xFF)
+			if i < len(m.Mask) {
+				mask = m.Mask[i]
+			}
+			if b&mask != m.Value[i]&mask {
+				return false, 0
+			}
+		}
+	}
+
+	if end := m.Offset + len(m.Value); len(header) < end {
+		return false, end
+	}
+	return true, 0
+}
+
+// Handle calls the provided handler.
+func (m *MaskMatcher) Handle(c net.Conn) (net.Conn, error) {
+	return m.Handler(c)
+}
+
+// NewMaskMatcher returns a MaskMatcher for the pattern, as parsed by
+// ParseMaskPattern, at the offset with the provided handler.
+func NewMaskMatcher(offset int, pattern string, handler func(net.Conn) (net.Conn, error)) (*MaskMatcher, error) {
+	value, mask, err := ParseMaskPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MaskMatcher{
+		Offset:      offset,
+		Value:       value,
+		Mask:        mask,
+		Handler:     handler,
+		Description: fmt.Sprintf("MaskMatcher [%s]", pattern),
+	}, nil
+}
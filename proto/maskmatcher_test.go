@@ -0,0 +1,100 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseMaskPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   []byte
+		mask    []byte
+		fail    bool
+	}{
+		{"16 03 ?? ?? ?? 01", []byte{0x16, 0x03, 0, 0, 0, 0x01}, []byte{0xFF, 0xFF, 0, 0, 0, 0xFF}, false},
+		{"0? ?f", []byte{0x00, 0x0F}, []byte{0xF0, 0x0F}, false},
+		{"4F/c0", []byte{0x40}, []byte{0xC0}, false},
+		{"", nil, nil, true},
+		{"1", nil, nil, true},
+		{"123", nil, nil, true},
+		{"zz", nil, nil, true},
+		{"1?/f0", nil, nil, true},
+		{"10/", nil, nil, true},
+	}
+
+	for _, test := range tests {
+		value, mask, err := ParseMaskPattern(test.pattern)
+		if test.fail {
+			if err == nil {
+				t.Errorf("parsing %q did not fail", test.pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsing %q failed: %v", test.pattern, err)
+			continue
+		}
+		if !bytes.Equal(value, test.value) || !bytes.Equal(mask, test.mask) {
+			t.Errorf("parsing %q returned %x/%x, expected %x/%x", test.pattern, value, mask, test.value, test.mask)
+		}
+	}
+}
+
+func TestMaskMatcher(t *testing.T) {
+	h, err := NewMaskMatcher(0, "16 03 ?? ?? ?? 01", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := NewMaskMatcher(4, "ff 5?", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Missing mask bytes compare the value in full
+	u := &MaskMatcher{Value: []byte{0x16, 0x03}, Mask: []byte{0xFF}}
+	n := &MaskMatcher{Value: []byte{0x16, 0x03}}
+
+	tests := []struct {
+		m        *MaskMatcher
+		payload  string
+		match    bool
+		required int
+	}{
+		{h, "", false, 6},
+		{h, "\x16", false, 6},
+		{h, "\x17", false, 0},
+		{h, "\x16\x03\x01\x02", false, 6},
+		{h, "\x16\x04", false, 0},
+		{h, "\x16\x03\x01\x02\x00\x01", true, 0},
+		{h, "\x16\x03\x01\x02\x00\x02", false, 0},
+		{h, "\x16\x03\x03\x00\x00\x01\x00", true, 0},
+		{o, "abc", false, 6},
+		{o, "abcd\xff", false, 6},
+		{o, "abcd\xfe", false, 0},
+		{o, "abcd\xff\x5a", true, 0},
+		{o, "abcd\xff\x6a", false, 0},
+		{u, "\x16\x03", true, 0},
+		{u, "\x16\x13", false, 0},
+		{n, "\x16", false, 2},
+		{n, "\x16\x03", true, 0},
+		{n, "\x17\x03", false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := test.m.Check([]byte(test.payload), nil)
+		if test.match != match {
+			t.Errorf("%v: match not correct for %q: was %t, expected %t",
+				test.m, test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("%v: required not correct for %q: was %d, expected %d",
+				test.m, test.payload, required, test.required)
+		}
+	}
+
+	// Both can be used as checkers
+	cm := NewChain(nil, h.Check, Not(AtOffset(0, o.Check)))
+	if match, _ := cm.Check([]byte("\x16\x03\x01\x02\x00\x01"), nil); !match {
+		t.Errorf("chain did not match")
+	}
+}
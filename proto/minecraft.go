@@ -0,0 +1,218 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// Minecraft field constants
+const (
+	MinecraftStateStatus   = 1
+	MinecraftStateLogin    = 2
+	MinecraftStateTransfer = 3
+	MinecraftMaxLookahead  = 1024
+	minecraftMaxAddress    = 255 * 4 // 255 UTF-8 characters
+	minecraftMinPacket     = 1 + 1 + 1 + 1 + 2 + 1
+)
+
+var errMinecraft = errors.New("minecraft: invalid handshake")
+
+// MinecraftHandshake is the parsed Handshake packet sent by a Minecraft Java
+// Edition client. It is added as a hint to connections handled by Minecraft.
+type MinecraftHandshake struct {
+	ProtocolVersion int32
+
+	// ServerAddress is the address as sent by the client, which may carry
+	// markers appended by mod loaders, such as "\x00FML\x00". Hostname is the
+	// address without these and any trailing dot.
+	ServerAddress string
+	Hostname      string
+
+	Port uint16
+
+	// NextState is MinecraftStateStatus for server list pings, and
+	// MinecraftStateLogin or MinecraftStateTransfer for players joining.
+	NextState int
+}
+
+// minecraftVarint decodes a VarInt at pos, returning the value and the
+// position after it. If more data is needed, the amount of bytes is returned
+// as needed.
+func minecraftVarint(b []byte, pos int) (val, next, needed int, err error) {
+	var v uint32
+	for i := 0; i < 5; i++ {
+		if len(b) <= pos+i {
+			return 0, 0, pos + i + 1, nil
+		}
+		v |= uint32(b[pos+i]&0x7F) << (7 * uint(i))
+		if b[pos+i]&0x80 == 0 {
+			return int(int32(v)), pos + i + 1, 0, nil
+		}
+	}
+	return 0, 0, 0, errMinecraft
+}
+
+// ParseMinecraftHandshake parses a length-prefixed Handshake packet. If more
+// data is needed, the amount of bytes is returned as needed, with a nil
+// handshake and error.
+func ParseMinecraftHandshake(header []byte) (hs *MinecraftHandshake, needed int, err error) {
+	length, pos, needed, err := minecraftVarint(header, 0)
+	if needed > 0 || err != nil {
+		return nil, needed, err
+	}
+	if length < minecraftMinPacket || pos+length > MinecraftMaxLookahead {
+		return nil, 0, errMinecraft
+	}
+	end := pos + length
+
+	// Packet ID
+	if len(header) > pos && header[pos] != 0x00 {
+		return nil, 0, errMinecraft
+	}
+
+	version, pos, needed, err := minecraftVarint(header, pos+1)
+	if needed > 0 || err != nil {
+		return nil, needed, err
+	}
+
+	addressLength, pos, needed, err := minecraftVarint(header, pos)
+	if needed > 0 || err != nil {
+		return nil, needed, err
+	}
+	if addressLength < 1 || addressLength > minecraftMaxAddress || pos+addressLength+2+1 > end {
+		return nil, 0, errMinecraft
+	}
+
+	if len(header) < end {
+		return nil, end, nil
+	}
+
+	hs = &MinecraftHandshake{
+		ProtocolVersion: int32(version),
+		ServerAddress:   string(header[pos : pos+addressLength]),
+	}
+	pos += addressLength
+	hs.Port = binary.BigEndian.Uint16(header[pos:])
+
+	hs.NextState, pos, _, err = minecraftVarint(header[:end], pos+2)
+	if err != nil || pos != end {
+		return nil, 0, errMinecraft
+	}
+	switch hs.NextState {
+	case MinecraftStateStatus, MinecraftStateLogin, MinecraftStateTransfer:
+	default:
+		return nil, 0, errMinecraft
+	}
+
+	hs.Hostname = hs.ServerAddress
+	if i := strings.IndexByte(hs.Hostname, 0); i != -1 {
+		hs.Hostname = hs.Hostname[:i]
+	}
+	hs.Hostname = strings.TrimSuffix(hs.Hostname, ".")
+
+	return hs, 0, nil
+}
+
+// MinecraftMatch is a RouteMatcher for Minecraft clients connecting to the
+// listed hostnames, compared case-insensitively, and for the listed next
+// states. Empty lists match everything.
+type MinecraftMatch struct {
+	Hostnames []string
+	States    []int
+}
+
+// Matches checks if the route applies to the handshake.
+func (r *MinecraftMatch) Matches(hint interface{}) bool {
+	hs, ok := hint.(*MinecraftHandshake)
+	if !ok {
+		return false
+	}
+
+	if len(r.Hostnames) > 0 && !containsFold(r.Hostnames, hs.Hostname) {
+		return false
+	}
+
+	if len(r.States) > 0 {
+		for _, state := range r.States {
+			if state == hs.NextState {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// Minecraft detects Minecraft Java Edition clients by their Handshake packet,
+// and routes them by the hostname they connect to, much like SNI for TLS. The
+// *MinecraftHandshake is added as a hint to the connection given to the
+// handler.
+//
+// As the whole packet is validated, Minecraft declares MinecraftMaxLookahead as
+// its lookahead. The legacy server list ping of clients older than 1.7 is not
+// detected.
+type Minecraft struct {
+	RouteTable
+
+	Description string
+}
+
+func (m *Minecraft) String() string {
+	return m.Description
+}
+
+// MaxLookahead returns MinecraftMaxLookahead.
+func (m *Minecraft) MaxLookahead() int {
+	return MinecraftMaxLookahead
+}
+
+// Check validates the complete Handshake packet.
+func (m *Minecraft) Check(header []byte, _ []interface{}) (bool, int) {
+	hs, needed, err := ParseMinecraftHandshake(header)
+	if err != nil || hs == nil {
+		return false, needed
+	}
+	return true, 0
+}
+
+// Handle parses the handshake and calls the handler of the first matching
+// route.
+func (m *Minecraft) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, MinecraftMaxLookahead, m.Check)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	hs, _, err := ParseMinecraftHandshake(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(hs))
+
+	return m.Route(pc, hs)
+}
+
+// NewMinecraft returns a Minecraft with the provided handler as fallback.
+func NewMinecraft(handler func(net.Conn) (net.Conn, error)) *Minecraft {
+	return &Minecraft{
+		RouteTable:  RouteTable{Handler: handler},
+		Description: "Minecraft",
+	}
+}
+
+// NewMinecraftProxy returns a Minecraft set up to call DialAndProxy if no
+// routes match.
+func NewMinecraftProxy(proto, dest string) *Minecraft {
+	m := NewMinecraft(ProxyHandler(proto, dest))
+	m.Description = fmt.Sprintf("Minecraft [dest: %s]", dest)
+	return m
+}
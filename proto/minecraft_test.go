@@ -0,0 +1,103 @@
+package proto
+
+import (
+	"testing"
+)
+
+func minecraftHandshake(version int, address string, port uint16, state byte) []byte {
+	varint := func(b []byte, v int) []byte {
+		u := uint32(v)
+		for u >= 0x80 {
+			b = append(b, byte(u)|0x80)
+			u >>= 7
+		}
+		return append(b, byte(u))
+	}
+
+	pkt := []byte{0x00}
+	pkt = varint(pkt, version)
+	pkt = varint(pkt, len(address))
+	pkt = append(pkt, address...)
+	pkt = append(pkt, byte(port>>8), byte(port), state)
+	return append(varint(nil, len(pkt)), pkt...)
+}
+
+func TestMinecraft(t *testing.T) {
+	h := NewMinecraft(nil)
+
+	// 1.20.4 status ping, followed by the status request
+	status := append(minecraftHandshake(765, "mc.example.com", 25565, MinecraftStateStatus), 0x01, 0x00)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 1},
+		{[]byte("\x15"), false, 3},
+		{[]byte("\x15\x00"), false, 3},
+		{[]byte("\x15\x00\xfd"), false, 4},
+		{[]byte("\x15\x00\xfd\x05"), false, 5},
+		{[]byte("\x15\x00\xfd\x05\x0e"), false, 22},
+		{status, true, 0},
+		{minecraftHandshake(765, "mc.example.com", 25565, MinecraftStateLogin), true, 0},
+		{minecraftHandshake(-1, "localhost", 25565, MinecraftStateStatus), true, 0},
+		{minecraftHandshake(765, "mc.example.com\x00FML3\x00", 25565, MinecraftStateLogin), true, 0},
+		{minecraftHandshake(765, "mc.example.com", 25565, 4), false, 0},
+		{[]byte("\x15\x01"), false, 0},
+		{[]byte("\x03\x00"), false, 0},
+		{[]byte("\xff\xff\x7f"), false, 0},
+		{[]byte("\x15\x00\xfd\x05\x20"), false, 0},
+		{[]byte("\x06\x00\x00\x00\x00\x00\x01\x00"), false, 0},
+		{[]byte("\xfe\x01\xfa"), false, 0},
+		{[]byte("GET / HTTP/1.1"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestParseMinecraftHandshake(t *testing.T) {
+	hs, _, err := ParseMinecraftHandshake(minecraftHandshake(765, "MC.example.com.\x00FML3\x00", 25566, MinecraftStateLogin))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	expected := MinecraftHandshake{
+		ProtocolVersion: 765,
+		ServerAddress:   "MC.example.com.\x00FML3\x00",
+		Hostname:        "MC.example.com",
+		Port:            25566,
+		NextState:       MinecraftStateLogin,
+	}
+	if *hs != expected {
+		t.Errorf("handshake was %+v, expected %+v", *hs, expected)
+	}
+}
+
+func TestMinecraftRoutes(t *testing.T) {
+	r := newRouteRecorder(t, (*MinecraftHandshake)(nil))
+
+	h := NewMinecraft(r.handler("default"))
+	h.Routes = []Route{
+		{Matcher: &MinecraftMatch{Hostnames: []string{"survival.example.com"}}, Handler: r.handler("survival")},
+		{Matcher: &MinecraftMatch{Hostnames: []string{"creative.example.com"}, States: []int{MinecraftStateLogin}}, Handler: r.handler("creative")},
+	}
+
+	r.check(h.Handle, []routeTest{
+		{minecraftHandshake(765, "survival.example.com", 25565, MinecraftStateStatus), "survival"},
+		{minecraftHandshake(765, "Survival.Example.com.", 25565, MinecraftStateLogin), "survival"},
+		{minecraftHandshake(765, "creative.example.com", 25565, MinecraftStateLogin), "creative"},
+		{minecraftHandshake(765, "creative.example.com", 25565, MinecraftStateStatus), "default"},
+		{minecraftHandshake(765, "example.com", 25565, MinecraftStateLogin), "default"},
+	})
+}
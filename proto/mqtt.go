@@ -0,0 +1,338 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// MQTT field constants
+const (
+	MQTTConnect      = 0x10
+	MQTTLevel31      = 3
+	MQTTLevel311     = 4
+	MQTTLevel50      = 5
+	MQTTMaxLookahead = 1024
+	mqttMaxRemaining = 268435455
+	mqttFlagReserved = 0x01
+	mqttFlagWill     = 0x04
+	mqttFlagWillQoS  = 0x18
+	mqttFlagUsername = 0x80
+)
+
+var errMQTT = errors.New("mqtt: invalid CONNECT packet")
+
+// MQTTConnectPacket is the parsed CONNECT packet sent by an MQTT client. It is
+// added as a hint to connections handled by MQTT. ClientID and Username are
+// only available if they were within the first MQTTMaxLookahead bytes of the
+// packet.
+type MQTTConnectPacket struct {
+	ProtocolName  string
+	ProtocolLevel byte
+	Flags         byte
+	KeepAlive     uint16
+	ClientID      string
+	Username      string
+}
+
+// mqttVarint decodes a variable byte integer at pos, returning the value and
+// the position after it. If more data is needed, the amount of bytes is
+// returned as needed.
+func mqttVarint(b []byte, pos int) (val, next, needed int, err error) {
+	for i := 0; i < 4; i++ {
+		if len(b) <= pos+i {
+			return 0, 0, pos + i + 1, nil
+		}
+		val |= int(b[pos+i]&0x7F) << (7 * uint(i))
+		if b[pos+i]&0x80 == 0 {
+			return val, pos + i + 1, 0, nil
+		}
+	}
+	return 0, 0, 0, errMQTT
+}
+
+// mqttReader reads fields from the payload of a possibly truncated CONNECT
+// packet. Once out of data, all reads fail.
+type mqttReader struct {
+	b   []byte
+	pos int
+	ok  bool
+}
+
+func (r *mqttReader) skip(n int) {
+	if !r.ok || len(r.b)-r.pos < n {
+		r.ok = false
+		return
+	}
+	r.pos += n
+}
+
+func (r *mqttReader) uint16() uint16 {
+	if !r.ok || len(r.b)-r.pos < 2 {
+		r.ok = false
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b[r.pos:])
+	r.pos += 2
+	return v
+}
+
+func (r *mqttReader) bytes() []byte {
+	n := int(r.uint16())
+	if !r.ok || len(r.b)-r.pos < n {
+		r.ok = false
+		return nil
+	}
+	v := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return v
+}
+
+func (r *mqttReader) properties() {
+	if !r.ok {
+		return
+	}
+	n, next, needed, err := mqttVarint(r.b, r.pos)
+	if needed > 0 || err != nil {
+		r.ok = false
+		return
+	}
+	r.pos = next
+	r.skip(n)
+}
+
+// ParseMQTTConnect parses a CONNECT packet. The fixed header, protocol name,
+// protocol level and connect flags must be present, while the remaining fields
+// are parsed as far as possible. If more data is needed, the amount of bytes is
+// returned as needed, with a nil packet and error.
+func ParseMQTTConnect(header []byte) (packet *MQTTConnectPacket, needed int, err error) {
+	if len(header) < 1 {
+		return nil, 1, nil
+	}
+	if header[0] != MQTTConnect {
+		return nil, 0, errMQTT
+	}
+
+	remaining, pos, needed, err := mqttVarint(header, 1)
+	if needed > 0 || err != nil {
+		return nil, needed, err
+	}
+	if remaining > mqttMaxRemaining {
+		return nil, 0, errMQTT
+	}
+
+	if len(header) < pos+2 {
+		if len(header) > pos && header[pos] != 0 {
+			return nil, 0, errMQTT
+		}
+		return nil, pos + 2, nil
+	}
+
+	nameLength := int(binary.BigEndian.Uint16(header[pos:]))
+	if nameLength != 4 && nameLength != 6 {
+		return nil, 0, errMQTT
+	}
+
+	// Protocol name, level, flags and keep alive
+	if remaining < 2+nameLength+2+2 {
+		return nil, 0, errMQTT
+	}
+
+	end := pos + 2 + nameLength + 2
+	if len(header) < end {
+		candidate := "MQTT"
+		if nameLength == 6 {
+			candidate = "MQIsdp"
+		}
+		name := header[pos+2:]
+		if len(name) > nameLength {
+			// Only compare the name, not the level following it
+			name = name[:nameLength]
+		}
+		if !strings.HasPrefix(candidate, string(name)) {
+			return nil, 0, errMQTT
+		}
+		return nil, end, nil
+	}
+
+	packet = &MQTTConnectPacket{
+		ProtocolName:  string(header[pos+2 : pos+2+nameLength]),
+		ProtocolLevel: header[end-2],
+		Flags:         header[end-1],
+	}
+
+	switch {
+	case packet.ProtocolName == "MQTT" && (packet.ProtocolLevel == MQTTLevel311 || packet.ProtocolLevel == MQTTLevel50):
+	case packet.ProtocolName == "MQIsdp" && packet.ProtocolLevel == MQTTLevel31:
+	default:
+		return nil, 0, errMQTT
+	}
+
+	if packet.Flags&mqttFlagReserved != 0 || packet.Flags&mqttFlagWillQoS == mqttFlagWillQoS {
+		return nil, 0, errMQTT
+	}
+
+	// The rest is parsed on a best-effort basis.
+	limit := pos + remaining
+	if limit > len(header) {
+		limit = len(header)
+	}
+
+	r := &mqttReader{b: header[:limit], pos: end, ok: true}
+	packet.KeepAlive = r.uint16()
+	if packet.ProtocolLevel == MQTTLevel50 {
+		r.properties()
+	}
+
+	clientID := r.bytes()
+	if !r.ok {
+		return packet, 0, nil
+	}
+	packet.ClientID = string(clientID)
+
+	if packet.Flags&mqttFlagWill != 0 {
+		if packet.ProtocolLevel == MQTTLevel50 {
+			r.properties()
+		}
+		r.bytes()
+		r.bytes()
+	}
+
+	if packet.Flags&mqttFlagUsername != 0 {
+		username := r.bytes()
+		if r.ok {
+			packet.Username = string(username)
+		}
+	}
+
+	return packet, 0, nil
+}
+
+// MQTTMatch is a RouteMatcher for MQTT clients with matching CONNECT
+// packets. Empty lists match everything.
+type MQTTMatch struct {
+	ProtocolLevels   []byte
+	ClientIDPrefixes []string
+	Usernames        []string
+}
+
+// Matches checks if the route applies to the CONNECT packet.
+func (r *MQTTMatch) Matches(hint interface{}) bool {
+	packet, ok := hint.(*MQTTConnectPacket)
+	if !ok {
+		return false
+	}
+
+	if len(r.ProtocolLevels) > 0 {
+		found := false
+		for _, level := range r.ProtocolLevels {
+			if level == packet.ProtocolLevel {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.ClientIDPrefixes) > 0 {
+		found := false
+		for _, prefix := range r.ClientIDPrefixes {
+			if strings.HasPrefix(packet.ClientID, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return len(r.Usernames) == 0 || containsString(r.Usernames, packet.Username)
+}
+
+// MQTT detects MQTT 3.1, 3.1.1 and 5.0 clients by their CONNECT packet, and
+// routes them based on the protocol level, client ID and username. The
+// *MQTTConnectPacket is added as a hint to the connection given to the
+// handler.
+//
+// MQTT only needs a net.Conn carrying the MQTT byte stream, so MQTT over TLS or
+// WebSocket works by adding MQTT alongside a transport that unwraps these.
+type MQTT struct {
+	RouteTable
+
+	Description string
+}
+
+func (m *MQTT) String() string {
+	return m.Description
+}
+
+// Check validates the fixed header, protocol name, protocol level and connect
+// flags.
+func (m *MQTT) Check(header []byte, _ []interface{}) (bool, int) {
+	packet, needed, err := ParseMQTTConnect(header)
+	if err != nil || packet == nil {
+		return false, needed
+	}
+	return true, 0
+}
+
+// checkLookahead requires as much of the CONNECT packet as possible within
+// MQTTMaxLookahead.
+func (m *MQTT) checkLookahead(header []byte, hints []interface{}) (bool, int) {
+	ok, needed := m.Check(header, hints)
+	if !ok {
+		return ok, needed
+	}
+
+	remaining, pos, _, _ := mqttVarint(header, 1)
+	total := pos + remaining
+	if total > MQTTMaxLookahead {
+		total = MQTTMaxLookahead
+	}
+	if len(header) < total {
+		return false, total
+	}
+	return true, 0
+}
+
+// Handle parses the CONNECT packet and calls the handler of the first matching
+// route.
+func (m *MQTT) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, MQTTMaxLookahead, m.checkLookahead)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	packet, _, err := ParseMQTTConnect(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(packet))
+
+	return m.Route(pc, packet)
+}
+
+// NewMQTT returns an MQTT with the provided handler as fallback.
+func NewMQTT(handler func(net.Conn) (net.Conn, error)) *MQTT {
+	return &MQTT{
+		RouteTable:  RouteTable{Handler: handler},
+		Description: "MQTT",
+	}
+}
+
+// NewMQTTProxy returns an MQTT set up to call DialAndProxy if no routes match.
+func NewMQTTProxy(proto, dest string) *MQTT {
+	m := NewMQTT(ProxyHandler(proto, dest))
+	m.Description = fmt.Sprintf("MQTT [dest: %s]", dest)
+	return m
+}
@@ -0,0 +1,152 @@
+package proto
+
+import (
+	"testing"
+)
+
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func mqttConnect(name string, level, flags byte, fields ...string) []byte {
+	body := mqttString(name)
+	body = append(body, level, flags, 0x00, 0x3c)
+	if level == MQTTLevel50 {
+		body = append(body, 0x00) // No properties
+	}
+	for _, f := range fields {
+		body = append(body, mqttString(f)...)
+	}
+	return append([]byte{MQTTConnect, byte(len(body))}, body...)
+}
+
+func TestMQTT(t *testing.T) {
+	h := NewMQTT(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 1},
+		{[]byte{0x10}, false, 2},
+		{[]byte{0x10, 0x80}, false, 3},
+		{[]byte{0x10, 0x80, 0x80, 0x80, 0x80}, false, 0},
+		{[]byte{0x10, 0x10}, false, 4},
+		{[]byte{0x10, 0x10, 0x00, 0x04}, false, 10},
+		{[]byte{0x10, 0x10, 0x00, 0x04, 'M', 'Q'}, false, 10},
+		{[]byte{0x10, 0x10, 0x00, 0x04, 'M', 'X'}, false, 0},
+		{[]byte{0x10, 0x10, 0x00, 0x05}, false, 0},
+		{[]byte{0x20, 0x02, 0x00, 0x00}, false, 0},
+		{[]byte("GET /"), false, 0},
+		{mqttConnect("MQTT", MQTTLevel311, 0x02, "client"), true, 0},
+		{mqttConnect("MQTT", MQTTLevel50, 0x02, "client"), true, 0},
+		{mqttConnect("MQIsdp", MQTTLevel31, 0x02, "client"), true, 0},
+		{mqttConnect("MQIsdp", MQTTLevel311, 0x02, "client"), false, 0},
+		{mqttConnect("MQTT", MQTTLevel31, 0x02, "client"), false, 0},
+		{mqttConnect("MQTT", MQTTLevel311, 0x03, "client"), false, 0},
+		{mqttConnect("MQTT", MQTTLevel311, 0x1A, "client"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+
+	// Prefixes of a valid CONNECT must ask for more until it matches
+	payloads := [][]byte{
+		mqttConnect("MQTT", MQTTLevel311, 0x02, "client"),
+		mqttConnect("MQTT", MQTTLevel50, 0x02, "client"),
+		mqttConnect("MQIsdp", MQTTLevel31, 0x02, "client"),
+	}
+
+	for _, payload := range payloads {
+		for i := 0; i <= len(payload); i++ {
+			match, required := h.Check(payload[:i], nil)
+			if !match && (required <= i || required > len(payload)) {
+				t.Errorf("prefix %q of %q was rejected: required %d", payload[:i], payload, required)
+				break
+			}
+			if match {
+				break
+			}
+		}
+	}
+}
+
+func TestParseMQTTConnect(t *testing.T) {
+	// MQTT 5.0 with will properties, will topic and will payload
+	will := mqttString("MQTT")
+	will = append(will, MQTTLevel50, 0xC6, 0x00, 0x3c, 0x00)
+	will = append(will, mqttString("sensor-2")...)
+	will = append(will, 0x00)
+	will = append(will, mqttString("status")...)
+	will = append(will, mqttString("gone")...)
+	will = append(will, mqttString("alice")...)
+	will = append(will, mqttString("secret")...)
+	will = append([]byte{MQTTConnect, byte(len(will))}, will...)
+
+	tests := []struct {
+		payload []byte
+		packet  MQTTConnectPacket
+	}{
+		{
+			mqttConnect("MQTT", MQTTLevel311, 0x02, "sensor-1"),
+			MQTTConnectPacket{"MQTT", MQTTLevel311, 0x02, 60, "sensor-1", ""},
+		},
+		{
+			will,
+			MQTTConnectPacket{"MQTT", MQTTLevel50, 0xC6, 60, "sensor-2", "alice"},
+		},
+		{
+			mqttConnect("MQIsdp", MQTTLevel31, 0xC2, "sensor-3", "bob", "secret"),
+			MQTTConnectPacket{"MQIsdp", MQTTLevel31, 0xC2, 60, "sensor-3", "bob"},
+		},
+	}
+
+	for _, test := range tests {
+		packet, _, err := ParseMQTTConnect(test.payload)
+		if err != nil {
+			t.Errorf("parse failed for %q: %v", test.payload, err)
+			continue
+		}
+		if *packet != test.packet {
+			t.Errorf("packet was %+v, expected %+v", *packet, test.packet)
+		}
+	}
+
+	// Truncated packets still yield what is available
+	full := mqttConnect("MQTT", MQTTLevel311, 0x82, "sensor-4", "carol")
+	packet, _, err := ParseMQTTConnect(full[:len(full)-2])
+	if err != nil {
+		t.Fatalf("parse of truncated packet failed: %v", err)
+	}
+	if packet.ClientID != "sensor-4" || packet.Username != "" {
+		t.Errorf("truncated packet was %+v", *packet)
+	}
+}
+
+func TestMQTTRoutes(t *testing.T) {
+	r := newRouteRecorder(t, (*MQTTConnectPacket)(nil))
+
+	h := NewMQTT(r.handler("default"))
+	h.Routes = []Route{
+		{Matcher: &MQTTMatch{ProtocolLevels: []byte{MQTTLevel50}}, Handler: r.handler("v5")},
+		{Matcher: &MQTTMatch{ClientIDPrefixes: []string{"meter-"}}, Handler: r.handler("meters")},
+		{Matcher: &MQTTMatch{Usernames: []string{"fleet"}}, Handler: r.handler("fleet")},
+	}
+
+	r.check(h.Handle, []routeTest{
+		{mqttConnect("MQTT", MQTTLevel311, 0x02, "sensor"), "default"},
+		{mqttConnect("MQTT", MQTTLevel50, 0x02, "sensor"), "v5"},
+		{mqttConnect("MQTT", MQTTLevel311, 0x02, "meter-17"), "meters"},
+		{mqttConnect("MQTT", MQTTLevel311, 0x82, "truck", "fleet"), "fleet"},
+	})
+}
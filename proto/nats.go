@@ -0,0 +1,225 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// NATS field constants
+const (
+	NATSMaxLookahead = 4096
+)
+
+var (
+	natsConnect = []byte("CONNECT")
+	natsInfo    = []byte("INFO")
+)
+
+// NATSConnect is the parsed CONNECT command sent by a NATS client. It is added
+// as a hint to connections handled by NATS.
+type NATSConnect struct {
+	Verbose      bool   `json:"verbose"`
+	Pedantic     bool   `json:"pedantic"`
+	TLSRequired  bool   `json:"tls_required"`
+	Name         string `json:"name"`
+	Lang         string `json:"lang"`
+	Version      string `json:"version"`
+	Protocol     int    `json:"protocol"`
+	User         string `json:"user"`
+	Headers      bool   `json:"headers"`
+	NoResponders bool   `json:"no_responders"`
+}
+
+// ParseNATSConnect parses a CONNECT command line, including the terminating
+// CR LF.
+func ParseNATSConnect(line []byte) (*NATSConnect, error) {
+	end := bytes.Index(line, []byte("\r\n"))
+	if end == -1 {
+		return nil, errors.New("nats: command not terminated")
+	}
+	line = line[:end]
+
+	if len(line) < len(natsConnect) || !bytes.EqualFold(line[:len(natsConnect)], natsConnect) {
+		return nil, errors.New("nats: not a CONNECT command")
+	}
+
+	args := bytes.TrimLeft(line[len(natsConnect):], " \t")
+	if len(args) == len(line)-len(natsConnect) {
+		return nil, errors.New("nats: missing CONNECT arguments")
+	}
+
+	nc := &NATSConnect{}
+	if err := json.Unmarshal(args, nc); err != nil {
+		return nil, fmt.Errorf("nats: invalid CONNECT arguments: %v", err)
+	}
+	return nc, nil
+}
+
+// NATS detects NATS clients by their CONNECT command, which unlike a HTTP
+// CONNECT request takes a JSON object as argument. The *NATSConnect is added as
+// a hint to the connection given to the handler.
+//
+// NATS servers speak first by sending INFO, which most clients wait for before
+// sending CONNECT. NATS only detects clients that send CONNECT right away, so
+// NATSGreeting should be set as the IdleProtocol of the server for the rest.
+type NATS struct {
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (n *NATS) String() string {
+	return n.Description
+}
+
+// Check verifies the CONNECT command up to the start of the JSON object. The
+// operation name is case-insensitive.
+func (n *NATS) Check(header []byte, _ []interface{}) (bool, int) {
+	l := len(header)
+	if l > len(natsConnect) {
+		l = len(natsConnect)
+	}
+	if !bytes.EqualFold(header[:l], natsConnect[:l]) {
+		return false, 0
+	}
+
+	for i := len(natsConnect); i < len(header); i++ {
+		switch {
+		case header[i] == ' ' || header[i] == '\t':
+		case header[i] == '{' && i > len(natsConnect):
+			return true, 0
+		default:
+			return false, 0
+		}
+	}
+
+	if len(header) >= NATSMaxLookahead {
+		return false, 0
+	}
+
+	// CONNECT, a space and a brace
+	if len(header) < len(natsConnect)+2 {
+		return false, len(natsConnect) + 2
+	}
+	return false, len(header) + 1
+}
+
+// checkLine requires the complete CONNECT command.
+func (n *NATS) checkLine(header []byte, hints []interface{}) (bool, int) {
+	ok, needed := n.Check(header, hints)
+	if !ok {
+		return ok, needed
+	}
+
+	if bytes.Contains(header, []byte("\r\n")) {
+		return true, 0
+	}
+	return false, len(header) + 1
+}
+
+// Handle parses the CONNECT command, adds it as a hint and calls the handler.
+func (n *NATS) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, NATSMaxLookahead, n.checkLine)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	nc, err := ParseNATSConnect(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(nc))
+	return n.Handler(pc)
+}
+
+// NewNATS returns a NATS with the provided handler.
+func NewNATS(handler func(net.Conn) (net.Conn, error)) *NATS {
+	return &NATS{
+		Handler:     handler,
+		Description: "NATS",
+	}
+}
+
+// NewNATSProxy returns a NATS set up to call DialAndProxy.
+func NewNATSProxy(proto, dest string) *NATS {
+	n := NewNATS(ProxyHandler(proto, dest))
+	n.Description = fmt.Sprintf("NATS [dest: %s]", dest)
+	return n
+}
+
+// NATSGreeting handles NATS clients waiting for the INFO of the server. As
+// such clients send nothing to detect, NATSGreeting is meant to be used as the
+// IdleProtocol of the server, like VNC, and never matches in Check. It dials
+// the NATS server and relays its INFO, and once the client has replied with a
+// CONNECT command, proxies the connection.
+type NATSGreeting struct {
+	Proto       string
+	Dest        string
+	Description string
+}
+
+func (n *NATSGreeting) String() string {
+	return n.Description
+}
+
+// Check never matches, as the clients send nothing to detect.
+func (n *NATSGreeting) Check(header []byte, _ []interface{}) (bool, int) {
+	return false, 0
+}
+
+// Handle relays the INFO of the server, verifies the CONNECT command of the
+// client and proxies the connection.
+func (n *NATSGreeting) Handle(c net.Conn) (net.Conn, error) {
+	server, err := net.Dial(n.Proto, n.Dest)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	r := bufio.NewReaderSize(server, NATSMaxLookahead)
+	info, err := r.ReadSlice('\n')
+	if err == nil && (len(info) < len(natsInfo) || !bytes.EqualFold(info[:len(natsInfo)], natsInfo)) {
+		err = errors.New("nats: server did not send INFO")
+	}
+	if err == nil {
+		_, err = c.Write(info)
+	}
+	if err != nil {
+		c.Close()
+		server.Close()
+		return nil, err
+	}
+
+	header, pc, err := peek(c, NATSMaxLookahead, (&NATS{}).checkLine)
+	if err == nil {
+		_, err = ParseNATSConnect(header)
+	}
+	if err != nil {
+		c.Close()
+		server.Close()
+		return nil, err
+	}
+
+	// Anything the server sent after INFO is replayed.
+	buffered, _ := r.Peek(r.Buffered())
+	utils.Proxy(pc, utils.NewProxyConn(server, buffered, nil))
+	return nil, nil
+}
+
+// NewNATSGreetingProxy returns a NATSGreeting set up to proxy to the provided
+// NATS server.
+func NewNATSGreetingProxy(proto, dest string) *NATSGreeting {
+	return &NATSGreeting{
+		Proto:       proto,
+		Dest:        dest,
+		Description: fmt.Sprintf("NATS greeting [dest: %s]", dest),
+	}
+}
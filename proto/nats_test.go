@@ -0,0 +1,133 @@
+package proto
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+func TestNATS(t *testing.T) {
+	h := NewNATS(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 9},
+		{[]byte("CON"), false, 9},
+		{[]byte("CONNECT"), false, 9},
+		{[]byte("CONNECT "), false, 9},
+		{[]byte("CONNECT  "), false, 10},
+		{[]byte("CONNECT {"), true, 0},
+		{[]byte("connect\t{\"verbose\":false}\r\n"), true, 0},
+		{[]byte("CONNECT{"), false, 0},
+		{[]byte("CONNECT example.com:443 HTTP/1.1\r\n"), false, 0},
+		{[]byte("PUB foo 0\r\n"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestNATSHandle(t *testing.T) {
+	hinted := make(chan *NATSConnect, 1)
+	h := NewNATS(func(c net.Conn) (net.Conn, error) {
+		hints := utils.GetHints(c)
+		nc, _ := hints[len(hints)-1].(*NATSConnect)
+		hinted <- nc
+		return nil, nil
+	})
+
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte("CONNECT {\"lang\":\"go\",\"version\":\"1.31.0\",\"protocol\":1,\"name\":\"orders\"}\r\nPING\r\n"))
+
+	if _, err := h.Handle(server); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+
+	select {
+	case nc := <-hinted:
+		if nc == nil {
+			t.Fatalf("connect hint missing")
+		}
+		if nc.Lang != "go" || nc.Version != "1.31.0" || nc.Protocol != 1 || nc.Name != "orders" {
+			t.Errorf("unexpected connect: %+v", nc)
+		}
+	case <-time.After(300 * time.Millisecond):
+		t.Errorf("timed out waiting for handler")
+	}
+}
+
+func TestNATSGreeting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	info := "INFO {\"server_id\":\"test\",\"version\":\"2.10.0\",\"proto\":1}\r\n"
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		io.WriteString(c, info)
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		received <- line
+		io.WriteString(c, "PONG\r\n")
+	}()
+
+	h := NewNATSGreetingProxy("tcp", l.Addr().String())
+
+	if match, required := h.Check(nil, nil); match || required != 0 {
+		t.Errorf("NATSGreeting matched silent connection")
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		if _, err := h.Handle(server); err != nil {
+			t.Errorf("handle failed: %v", err)
+		}
+	}()
+
+	r := bufio.NewReader(client)
+	greeting, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if greeting != info {
+		t.Errorf("greeting was %q, expected %q", greeting, info)
+	}
+
+	connect := "CONNECT {\"lang\":\"go\",\"version\":\"1.31.0\",\"protocol\":1}\r\n"
+	io.WriteString(client, connect+"PING\r\n")
+	if line := <-received; line != connect {
+		t.Errorf("server received %q, expected %q", line, connect)
+	}
+
+	if pong, err := r.ReadString('\n'); err != nil || pong != "PONG\r\n" {
+		t.Errorf("reply was %q (%v), expected PONG", pong, err)
+	}
+}
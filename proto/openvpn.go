@@ -0,0 +1,120 @@
+package proto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// OpenVPN field constants
+const (
+	OpenVPNHardResetClientV1 = 1
+	OpenVPNHardResetClientV2 = 7
+	OpenVPNHardResetClientV3 = 10 // tls-crypt-v2
+	OpenVPNMinResetLength    = 14
+	OpenVPNMaxResetLength    = 2048
+	openVPNSessionEnd        = 2 + 1 + 8
+)
+
+// OpenVPNReset describes the hard reset a TCP OpenVPN client starts with. It
+// is added as a hint to connections handled by OpenVPN.
+type OpenVPNReset struct {
+	// Opcode is one of the OpenVPNHardResetClient opcodes.
+	Opcode byte
+	KeyID  byte
+
+	// SessionID is the session ID chosen by the client.
+	SessionID uint64
+
+	// Length is the length of the packet, excluding the length prefix.
+	Length int
+}
+
+// TLSCryptV2 checks if the client uses tls-crypt-v2. Plain, tls-auth and
+// tls-crypt resets cannot be told apart reliably, as the latter two only add
+// authenticated or encrypted data.
+func (r *OpenVPNReset) TLSCryptV2() bool {
+	return r.Opcode == OpenVPNHardResetClientV3
+}
+
+// OpenVPN detects OpenVPN over TCP by the length prefix and the opcode and key
+// ID of the P_CONTROL_HARD_RESET_CLIENT packet the client starts with. The
+// *OpenVPNReset is added as a hint to the connection given to the handler.
+type OpenVPN struct {
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (o *OpenVPN) String() string {
+	return o.Description
+}
+
+// Check validates the length prefix, and that the packet is an initial hard
+// reset from a client, being a v1, v2 or v3 opcode with key ID 0.
+func (o *OpenVPN) Check(header []byte, _ []interface{}) (bool, int) {
+	if len(header) >= 1 && int(header[0])<<8 > OpenVPNMaxResetLength {
+		return false, 0
+	}
+	if len(header) >= 2 {
+		length := int(binary.BigEndian.Uint16(header))
+		if length < OpenVPNMinResetLength || length > OpenVPNMaxResetLength {
+			return false, 0
+		}
+	}
+	if len(header) < 3 {
+		return false, 3
+	}
+
+	switch header[2] {
+	case OpenVPNHardResetClientV1 << 3, OpenVPNHardResetClientV2 << 3, OpenVPNHardResetClientV3 << 3:
+		return true, 0
+	}
+	return false, 0
+}
+
+// checkSession requires the session ID.
+func (o *OpenVPN) checkSession(header []byte, hints []interface{}) (bool, int) {
+	ok, needed := o.Check(header, hints)
+	if !ok {
+		return ok, needed
+	}
+	if len(header) < openVPNSessionEnd {
+		return false, openVPNSessionEnd
+	}
+	return true, 0
+}
+
+// Handle adds the reset as a hint and calls the handler.
+func (o *OpenVPN) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, openVPNSessionEnd, o.checkSession)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(&OpenVPNReset{
+		Opcode:    header[2] >> 3,
+		KeyID:     header[2] & 0x07,
+		SessionID: binary.BigEndian.Uint64(header[3:11]),
+		Length:    int(binary.BigEndian.Uint16(header)),
+	}))
+
+	return o.Handler(pc)
+}
+
+// NewOpenVPN returns an OpenVPN with the provided handler.
+func NewOpenVPN(handler func(net.Conn) (net.Conn, error)) *OpenVPN {
+	return &OpenVPN{
+		Handler:     handler,
+		Description: "OpenVPN",
+	}
+}
+
+// NewOpenVPNProxy returns an OpenVPN set up to call DialAndProxy.
+func NewOpenVPNProxy(proto, dest string) *OpenVPN {
+	o := NewOpenVPN(ProxyHandler(proto, dest))
+	o.Description = fmt.Sprintf("OpenVPN [dest: %s]", dest)
+	return o
+}
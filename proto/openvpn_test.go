@@ -0,0 +1,95 @@
+package proto
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// Initial packets as sent by OpenVPN clients over TCP.
+var (
+	// 2.4, no tls-auth or tls-crypt
+	openVPNPlainReset = []byte("\x00\x0e\x38\x4f\x6c\x1a\x92\x3d\xe0\x77\x15\x00\x00\x00\x00\x00")
+
+	// 2.6, with the early negotiation TLV
+	openVPNEarlyNegReset = []byte("\x00\x14\x38\xa1\x02\x5c\x9e\x44\x17\xb3\x6d\x00\x00\x00\x00\x00\x00\x01\x00\x02\x00\x01")
+
+	// 2.4, tls-auth with SHA1
+	openVPNTLSAuthReset = []byte("\x00\x2a\x38\x0c\x8e\x21\x77\xd4\x5b\x09\xfa" +
+		"\x63\x1e\x9a\x54\x02\xbf\x7d\x88\x11\x4c\xe5\x30\x9b\x6a\x27\xd1\xf8\x05\x4e\x93" +
+		"\x00\x00\x00\x01\x5f\x3a\x6c\x21\x00\x00\x00\x00\x00")
+
+	// 2.4, version 1 reset
+	openVPNV1Reset = []byte("\x00\x0e\x08\x9b\x30\x4a\xe2\x17\x6c\xd5\x81\x00\x00\x00\x00\x00")
+)
+
+func TestOpenVPN(t *testing.T) {
+	h := NewOpenVPN(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 3},
+		{[]byte("\x00"), false, 3},
+		{[]byte("\x00\x0e"), false, 3},
+		{openVPNPlainReset, true, 0},
+		{openVPNEarlyNegReset, true, 0},
+		{openVPNTLSAuthReset, true, 0},
+		{openVPNV1Reset, true, 0},
+		{[]byte("\x01\x20\x50"), true, 0},
+		{[]byte("\x00\x0e\x39"), false, 0},
+		{[]byte("\x00\x0e\x20"), false, 0},
+		{[]byte("\x00\x0d\x38"), false, 0},
+		{[]byte("\x08\x01\x38"), false, 0},
+		{[]byte("\x09"), false, 0},
+		{[]byte("\x16\x03\x01\x00\xa5\x01"), false, 0},
+		{[]byte("GET / HTTP/1.1"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestOpenVPNHint(t *testing.T) {
+	resets := make(chan *OpenVPNReset, 1)
+	h := NewOpenVPN(func(c net.Conn) (net.Conn, error) {
+		hints := utils.GetHints(c)
+		r, _ := hints[len(hints)-1].(*OpenVPNReset)
+		resets <- r
+		return nil, nil
+	})
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go client.Write(openVPNTLSAuthReset)
+	if _, err := h.Handle(server); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+
+	select {
+	case r := <-resets:
+		expected := OpenVPNReset{
+			Opcode:    OpenVPNHardResetClientV2,
+			SessionID: 0x0c8e2177d45b09fa,
+			Length:    42,
+		}
+		if r == nil || *r != expected {
+			t.Errorf("reset parsed as %+v, expected %+v", r, expected)
+		}
+	case <-time.After(300 * time.Millisecond):
+		t.Errorf("no hint added")
+	}
+}
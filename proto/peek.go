@@ -0,0 +1,80 @@
+package proto
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// Errors
+var (
+	ErrNoRoute  = errors.New("no route matched the connection")
+	ErrNoMatch  = errors.New("header did not match the protocol")
+	ErrTooLarge = errors.New("header exceeded the maximum length")
+)
+
+// peek reads from c until check accepts the read data, returning the data and
+// a ProxyConn that will replay it. The hints of c are copied to the ProxyConn,
+// so that the caller can append its own without affecting c.
+//
+// This is used by Protocols that need the header again in Handle, as Check
+// has no place to store its findings.
+func peek(c net.Conn, max int, check func([]byte, []interface{}) (bool, int)) ([]byte, *utils.ProxyConn, error) {
+	var (
+		err    error
+		n      int
+		header = make([]byte, 0, max)
+		old    = utils.GetHints(c)
+		hints  = make([]interface{}, len(old))
+	)
+
+	copy(hints, old)
+
+	for {
+		ok, needed := check(header, hints)
+		if ok {
+			break
+		}
+
+		if needed == 0 || needed <= len(header) {
+			err = ErrNoMatch
+			break
+		}
+
+		if needed > max {
+			err = ErrTooLarge
+			break
+		}
+
+		n, err = io.ReadFull(c, header[len(header):needed])
+		header = header[:len(header)+n]
+		if err != nil {
+			break
+		}
+	}
+
+	pc := utils.NewProxyConn(c, header, nil)
+	pc.SetHints(hints)
+	return header, pc, err
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, x := range list {
+		if strings.EqualFold(x, s) {
+			return true
+		}
+	}
+	return false
+}
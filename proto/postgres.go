@@ -0,0 +1,283 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// Postgres field constants
+const (
+	PostgresProtocolMajor    = 3
+	PostgresCancelRequest    = 80877102
+	PostgresSSLRequest       = 80877103
+	PostgresGSSENCRequest    = 80877104
+	PostgresMaxStartupLength = 10000 // As enforced by the PostgreSQL server
+)
+
+// PostgresMessageType is the type of the initial message sent by a PostgreSQL
+// client.
+type PostgresMessageType int
+
+// PostgreSQL initial message types.
+const (
+	PostgresStartupType PostgresMessageType = iota
+	PostgresSSLRequestType
+	PostgresGSSENCRequestType
+	PostgresCancelRequestType
+)
+
+func (t PostgresMessageType) String() string {
+	switch t {
+	case PostgresStartupType:
+		return "StartupMessage"
+	case PostgresSSLRequestType:
+		return "SSLRequest"
+	case PostgresGSSENCRequestType:
+		return "GSSENCRequest"
+	case PostgresCancelRequestType:
+		return "CancelRequest"
+	default:
+		return fmt.Sprintf("PostgresMessageType(%d)", int(t))
+	}
+}
+
+// PostgresStartup is the parsed initial message sent by a PostgreSQL client. It
+// is added as a hint to connections handled by Postgres. The version and
+// Parameters are only set for StartupMessage.
+type PostgresStartup struct {
+	Type       PostgresMessageType
+	Major      uint16
+	Minor      uint16
+	Parameters map[string]string
+}
+
+// User returns the user startup parameter.
+func (ps *PostgresStartup) User() string {
+	return ps.Parameters["user"]
+}
+
+// Database returns the database startup parameter, which like in PostgreSQL
+// defaults to the user name.
+func (ps *PostgresStartup) Database() string {
+	if db, ok := ps.Parameters["database"]; ok {
+		return db
+	}
+	return ps.User()
+}
+
+// postgresType returns the message type and whether the length is valid for
+// the message.
+func postgresType(length, code uint32) (PostgresMessageType, bool) {
+	switch {
+	case code == PostgresSSLRequest:
+		return PostgresSSLRequestType, length == 8
+	case code == PostgresGSSENCRequest:
+		return PostgresGSSENCRequestType, length == 8
+	case code == PostgresCancelRequest:
+		// Protocol 3.2 allows secret keys of up to 256 bytes.
+		return PostgresCancelRequestType, length >= 16 && length <= 8+256
+	case code>>16 == PostgresProtocolMajor:
+		return PostgresStartupType, length > 8 && length <= PostgresMaxStartupLength
+	default:
+		return 0, false
+	}
+}
+
+// ParsePostgresStartup parses a complete initial message.
+func ParsePostgresStartup(msg []byte) (*PostgresStartup, error) {
+	if len(msg) < 8 {
+		return nil, errors.New("postgres: message too short")
+	}
+
+	length := binary.BigEndian.Uint32(msg[0:4])
+	code := binary.BigEndian.Uint32(msg[4:8])
+
+	t, ok := postgresType(length, code)
+	if !ok {
+		return nil, errors.New("postgres: invalid message")
+	}
+	if uint32(len(msg)) < length {
+		return nil, errors.New("postgres: message truncated")
+	}
+
+	ps := &PostgresStartup{Type: t}
+	if t != PostgresStartupType {
+		return ps, nil
+	}
+
+	ps.Major = uint16(code >> 16)
+	ps.Minor = uint16(code)
+	ps.Parameters = make(map[string]string)
+
+	body := msg[8:length]
+	for {
+		end := bytes.IndexByte(body, 0)
+		if end == -1 {
+			return nil, errors.New("postgres: unterminated parameter")
+		}
+		if end == 0 {
+			break
+		}
+
+		key := string(body[:end])
+		body = body[end+1:]
+
+		end = bytes.IndexByte(body, 0)
+		if end == -1 {
+			return nil, errors.New("postgres: unterminated parameter value")
+		}
+
+		ps.Parameters[key] = string(body[:end])
+		body = body[end+1:]
+	}
+
+	return ps, nil
+}
+
+// PostgresMatch is a RouteMatcher for PostgreSQL clients with matching
+// startup parameters. Empty lists match every StartupMessage, while
+// CancelRequest is never matched.
+type PostgresMatch struct {
+	Databases []string
+	Users     []string
+}
+
+// Matches checks if the route applies to the startup message.
+func (r *PostgresMatch) Matches(hint interface{}) bool {
+	ps, ok := hint.(*PostgresStartup)
+	if !ok || ps.Type != PostgresStartupType {
+		return false
+	}
+
+	if len(r.Databases) > 0 && !containsString(r.Databases, ps.Database()) {
+		return false
+	}
+	if len(r.Users) > 0 && !containsString(r.Users, ps.User()) {
+		return false
+	}
+	return true
+}
+
+// Postgres detects the PostgreSQL wire protocol by its initial message, being
+// either a StartupMessage, SSLRequest, GSSENCRequest or CancelRequest.
+//
+// SSLRequest is answered by Postgres itself. If TLS is set, it is accepted and
+// TLS is terminated using the TLS configuration, otherwise it is declined.
+// GSSENCRequest is always declined. In both cases, the connection is returned
+// as a transport, so that the following StartupMessage is detected anew.
+//
+// StartupMessage is routed by its database and user parameters, while
+// CancelRequest, carrying no parameters, is given to Handler. The
+// *PostgresStartup is added as a hint to the connection given to the handler.
+type Postgres struct {
+	RouteTable
+
+	// TLS is used to terminate TLS if set.
+	TLS *TLS
+
+	Description string
+}
+
+func (p *Postgres) String() string {
+	return p.Description
+}
+
+// Check verifies the length and protocol code of the initial message.
+func (p *Postgres) Check(header []byte, _ []interface{}) (bool, int) {
+	if len(header) < 8 {
+		// The length is never above 10000, so the first byte must be zero
+		if len(header) >= 1 && header[0] != 0 {
+			return false, 0
+		}
+		return false, 8
+	}
+
+	_, ok := postgresType(binary.BigEndian.Uint32(header[0:4]), binary.BigEndian.Uint32(header[4:8]))
+	return ok, 0
+}
+
+// checkComplete requires the complete initial message.
+func (p *Postgres) checkComplete(header []byte, hints []interface{}) (bool, int) {
+	ok, needed := p.Check(header, hints)
+	if !ok {
+		return ok, needed
+	}
+
+	length := int(binary.BigEndian.Uint32(header[0:4]))
+	if len(header) < length {
+		return false, length
+	}
+	return true, 0
+}
+
+// Handle answers SSLRequest and GSSENCRequest, and routes StartupMessage and
+// CancelRequest.
+func (p *Postgres) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, PostgresMaxStartupLength, p.checkComplete)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	ps, err := ParsePostgresStartup(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if ps.Type == PostgresSSLRequestType || ps.Type == PostgresGSSENCRequestType {
+		for _, h := range pc.Hints() {
+			if x, ok := h.(*PostgresStartup); ok && x.Type == ps.Type {
+				c.Close()
+				return nil, fmt.Errorf("postgres: repeated %v", ps.Type)
+			}
+		}
+
+		// Consume the request, as it is answered here.
+		if _, err = io.ReadFull(pc, make([]byte, len(header))); err != nil {
+			c.Close()
+			return nil, err
+		}
+		pc.SetHints(utils.HintsOf(pc).Add(ps))
+
+		if ps.Type == PostgresSSLRequestType && p.TLS != nil {
+			if _, err = pc.Write([]byte{'S'}); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return p.TLS.Handle(pc)
+		}
+
+		if _, err = pc.Write([]byte{'N'}); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return pc, nil
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(ps))
+
+	return p.Route(pc, ps)
+}
+
+// NewPostgres returns a Postgres with the provided handler as fallback.
+func NewPostgres(handler func(net.Conn) (net.Conn, error)) *Postgres {
+	return &Postgres{
+		RouteTable:  RouteTable{Handler: handler},
+		Description: "Postgres",
+	}
+}
+
+// NewPostgresProxy returns a Postgres set up to call DialAndProxy if no routes
+// match.
+func NewPostgresProxy(proto, dest string) *Postgres {
+	p := NewPostgres(ProxyHandler(proto, dest))
+	p.Description = fmt.Sprintf("Postgres [dest: %s]", dest)
+	return p
+}
@@ -0,0 +1,133 @@
+package proto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func postgresMessage(code uint32, body ...string) []byte {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint32(msg[4:], code)
+	for _, s := range body {
+		msg = append(msg, s...)
+		msg = append(msg, 0)
+	}
+	if code>>16 == PostgresProtocolMajor {
+		msg = append(msg, 0)
+	}
+	binary.BigEndian.PutUint32(msg[0:], uint32(len(msg)))
+	return msg
+}
+
+func TestPostgres(t *testing.T) {
+	h := NewPostgres(nil)
+
+	cancel := make([]byte, 16)
+	binary.BigEndian.PutUint32(cancel[0:], 16)
+	binary.BigEndian.PutUint32(cancel[4:], PostgresCancelRequest)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 8},
+		{[]byte{0x00, 0x00}, false, 8},
+		{[]byte("GET"), false, 0},
+		{postgresMessage(PostgresSSLRequest), true, 0},
+		{postgresMessage(PostgresGSSENCRequest), true, 0},
+		{postgresMessage(3<<16, "user", "postgres"), true, 0},
+		{postgresMessage(3<<16|2, "user", "postgres"), true, 0},
+		{postgresMessage(2<<16, "user", "postgres"), false, 0},
+		{cancel, true, 0},
+		{[]byte{0x00, 0x00, 0x00, 0x09, 0x04, 0xd2, 0x16, 0x2f}, false, 0},
+		{[]byte{0x00, 0x00, 0x30, 0x00, 0x00, 0x03, 0x00, 0x00}, false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestParsePostgresStartup(t *testing.T) {
+	ps, err := ParsePostgresStartup(postgresMessage(3<<16, "user", "alice", "application_name", "psql"))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	if ps.Type != PostgresStartupType || ps.Major != 3 || ps.Minor != 0 {
+		t.Errorf("unexpected message: %+v", ps)
+	}
+	if ps.User() != "alice" || ps.Database() != "alice" {
+		t.Errorf("user/database was %s/%s, expected alice/alice", ps.User(), ps.Database())
+	}
+
+	truncated := postgresMessage(3<<16, "user", "alice")
+	truncated = truncated[:len(truncated)-3]
+	if _, err = ParsePostgresStartup(truncated); err == nil {
+		t.Errorf("parse of truncated message did not fail")
+	}
+}
+
+func TestPostgresRoutes(t *testing.T) {
+	r := newRouteRecorder(t, (*PostgresStartup)(nil))
+
+	h := NewPostgres(r.handler("default"))
+	h.Routes = []Route{
+		{Matcher: &PostgresMatch{Databases: []string{"billing"}}, Handler: r.handler("billing")},
+		{Matcher: &PostgresMatch{Users: []string{"analyst"}}, Handler: r.handler("replica")},
+	}
+
+	r.check(h.Handle, []routeTest{
+		{postgresMessage(3<<16, "user", "alice"), "default"},
+		{postgresMessage(3<<16, "user", "billing"), "billing"},
+		{postgresMessage(3<<16, "user", "alice", "database", "billing"), "billing"},
+		{postgresMessage(3<<16, "user", "analyst", "database", "web"), "replica"},
+	})
+}
+
+func TestPostgresDeclineSSL(t *testing.T) {
+	h := NewPostgres(nil)
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go client.Write(postgresMessage(PostgresSSLRequest))
+
+	result := make(chan net.Conn, 1)
+	go func() {
+		transport, err := h.Handle(server)
+		if err != nil {
+			t.Errorf("handle failed: %v", err)
+		}
+		result <- transport
+	}()
+
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if reply[0] != 'N' {
+		t.Errorf("reply was %q, expected 'N'", reply[0])
+	}
+
+	transport := <-result
+	if transport == nil {
+		t.Fatalf("no transport returned")
+	}
+
+	// A second SSLRequest on the same connection is refused
+	go client.Write(postgresMessage(PostgresSSLRequest))
+	if _, err := h.Handle(transport); err == nil {
+		t.Errorf("repeated SSLRequest was accepted")
+	}
+}
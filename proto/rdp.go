@@ -0,0 +1,203 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// RDP field constants
+const (
+	TPKTVersion             = 0x03
+	X224ConnectionRequest   = 0xE0
+	RDPNegotiationRequest   = 0x01
+	RDPMaxLookahead         = 512
+	rdpConnectionRequestLen = 4 + 7
+)
+
+var (
+	rdpCookiePrefix       = []byte("Cookie: mstshash=")
+	rdpRoutingTokenPrefix = []byte("Cookie: msts=")
+)
+
+// RDPConnectionRequest is the parsed X.224 Connection Request sent by an RDP
+// client. It is added as a hint to connections handled by RDP.
+type RDPConnectionRequest struct {
+	// Cookie is the value of the mstshash cookie, usually the user name.
+	Cookie string
+
+	// RoutingToken is the value of the msts routing token, as issued by a
+	// connection broker.
+	RoutingToken string
+
+	// Negotiation is set if the request carries an RDP Negotiation Request,
+	// in which case RequestedProtocols holds the requested security
+	// protocols.
+	Negotiation        bool
+	RequestedProtocols uint32
+}
+
+// ParseRDPConnectionRequest parses a complete TPKT packet containing an X.224
+// Connection Request.
+func ParseRDPConnectionRequest(packet []byte) (*RDPConnectionRequest, error) {
+	if len(packet) < rdpConnectionRequestLen {
+		return nil, errors.New("rdp: packet too short")
+	}
+
+	length := int(binary.BigEndian.Uint16(packet[2:4]))
+	if length < rdpConnectionRequestLen {
+		return nil, errors.New("rdp: invalid packet length")
+	}
+	if len(packet) < length {
+		return nil, errors.New("rdp: packet truncated")
+	}
+
+	req := &RDPConnectionRequest{}
+	data := packet[rdpConnectionRequestLen:length]
+
+	var prefix []byte
+	switch {
+	case bytes.HasPrefix(data, rdpCookiePrefix):
+		prefix = rdpCookiePrefix
+	case bytes.HasPrefix(data, rdpRoutingTokenPrefix):
+		prefix = rdpRoutingTokenPrefix
+	}
+
+	if prefix != nil {
+		end := bytes.Index(data, []byte("\r\n"))
+		if end == -1 {
+			return nil, errors.New("rdp: unterminated cookie")
+		}
+
+		value := string(data[len(prefix):end])
+		if bytes.Equal(prefix, rdpCookiePrefix) {
+			req.Cookie = value
+		} else {
+			req.RoutingToken = value
+		}
+		data = data[end+2:]
+	}
+
+	if len(data) >= 8 && data[0] == RDPNegotiationRequest {
+		if binary.LittleEndian.Uint16(data[2:4]) != 8 {
+			return nil, errors.New("rdp: invalid negotiation request")
+		}
+		req.Negotiation = true
+		req.RequestedProtocols = binary.LittleEndian.Uint32(data[4:8])
+	}
+
+	return req, nil
+}
+
+// RDPMatch is a RouteMatcher for RDP clients with matching cookies or
+// routing tokens. Cookies are compared case-insensitively. Empty lists match
+// everything.
+type RDPMatch struct {
+	Cookies       []string
+	RoutingTokens []string
+}
+
+// Matches checks if the route applies to the connection request.
+func (r *RDPMatch) Matches(hint interface{}) bool {
+	req, ok := hint.(*RDPConnectionRequest)
+	if !ok {
+		return false
+	}
+
+	if len(r.Cookies) > 0 && !containsFold(r.Cookies, req.Cookie) {
+		return false
+	}
+	return len(r.RoutingTokens) == 0 || containsString(r.RoutingTokens, req.RoutingToken)
+}
+
+// RDP detects RDP clients by the TPKT header and X.224 Connection Request
+// they start with, and routes them based on the mstshash cookie or routing
+// token. The *RDPConnectionRequest is added as a hint to the connection given
+// to the handler.
+type RDP struct {
+	RouteTable
+
+	Description string
+}
+
+func (r *RDP) String() string {
+	return r.Description
+}
+
+// Check validates the TPKT header and the fixed part of the X.224 Connection
+// Request.
+func (r *RDP) Check(header []byte, _ []interface{}) (bool, int) {
+	if len(header) < rdpConnectionRequestLen {
+		if len(header) >= 1 && header[0] != TPKTVersion {
+			return false, 0
+		}
+		if len(header) >= 2 && header[1] != 0 {
+			return false, 0
+		}
+		return false, rdpConnectionRequestLen
+	}
+
+	length := int(binary.BigEndian.Uint16(header[2:4]))
+
+	return header[0] == TPKTVersion &&
+		header[1] == 0 &&
+		length >= rdpConnectionRequestLen &&
+		length <= RDPMaxLookahead &&
+		int(header[4]) == length-5 &&
+		header[5] == X224ConnectionRequest &&
+		header[6] == 0 && header[7] == 0 && // DST-REF
+		header[10]&0xF0 == 0, 0 // Class 0
+}
+
+// checkPacket requires the complete TPKT packet.
+func (r *RDP) checkPacket(header []byte, hints []interface{}) (bool, int) {
+	ok, needed := r.Check(header, hints)
+	if !ok {
+		return ok, needed
+	}
+
+	length := int(binary.BigEndian.Uint16(header[2:4]))
+	if len(header) < length {
+		return false, length
+	}
+	return true, 0
+}
+
+// Handle parses the connection request and calls the handler of the first
+// matching route.
+func (r *RDP) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, RDPMaxLookahead, r.checkPacket)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	req, err := ParseRDPConnectionRequest(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(req))
+
+	return r.Route(pc, req)
+}
+
+// NewRDP returns an RDP with the provided handler as fallback.
+func NewRDP(handler func(net.Conn) (net.Conn, error)) *RDP {
+	return &RDP{
+		RouteTable:  RouteTable{Handler: handler},
+		Description: "RDP",
+	}
+}
+
+// NewRDPProxy returns an RDP set up to call DialAndProxy if no routes match.
+func NewRDPProxy(proto, dest string) *RDP {
+	r := NewRDP(ProxyHandler(proto, dest))
+	r.Description = fmt.Sprintf("RDP [dest: %s]", dest)
+	return r
+}
@@ -0,0 +1,101 @@
+package proto
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func rdpRequest(cookie string, negotiate bool) []byte {
+	data := []byte(cookie)
+	if negotiate {
+		data = append(data, RDPNegotiationRequest, 0x00, 0x08, 0x00, 0x03, 0x00, 0x00, 0x00)
+	}
+
+	length := 4 + 7 + len(data)
+	packet := []byte{TPKTVersion, 0x00, 0x00, 0x00, byte(length - 5), X224ConnectionRequest, 0x00, 0x00, 0x00, 0x00, 0x00}
+	binary.BigEndian.PutUint16(packet[2:], uint16(length))
+	return append(packet, data...)
+}
+
+func TestRDP(t *testing.T) {
+	h := NewRDP(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 11},
+		{[]byte{0x03}, false, 11},
+		{[]byte{0x03, 0x01}, false, 0},
+		{[]byte{0x16, 0x03}, false, 0},
+		{rdpRequest("", false), true, 0},
+		{rdpRequest("Cookie: mstshash=alice\r\n", true), true, 0},
+		{rdpRequest("Cookie: msts=3640205228.15629.0000\r\n", false)[:11], true, 0},
+		{[]byte{0x03, 0x00, 0x00, 0x13, 0x0e, 0xd0, 0x00, 0x00, 0x12, 0x34, 0x00}, false, 0},
+		{[]byte{0x03, 0x00, 0x00, 0x13, 0x0d, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00}, false, 0},
+		{[]byte{0x03, 0x00, 0x00, 0x13, 0x0e, 0xe0, 0x00, 0x01, 0x00, 0x00, 0x00}, false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestParseRDPConnectionRequest(t *testing.T) {
+	tests := []struct {
+		payload []byte
+		req     RDPConnectionRequest
+	}{
+		{rdpRequest("", false), RDPConnectionRequest{}},
+		{rdpRequest("", true), RDPConnectionRequest{Negotiation: true, RequestedProtocols: 3}},
+		{rdpRequest("Cookie: mstshash=alice\r\n", true), RDPConnectionRequest{"alice", "", true, 3}},
+		{rdpRequest("Cookie: msts=3640205228.15629.0000\r\n", false), RDPConnectionRequest{"", "3640205228.15629.0000", false, 0}},
+	}
+
+	for _, test := range tests {
+		req, err := ParseRDPConnectionRequest(test.payload)
+		if err != nil {
+			t.Errorf("parse failed for %q: %v", test.payload, err)
+			continue
+		}
+		if *req != test.req {
+			t.Errorf("request was %+v, expected %+v", *req, test.req)
+		}
+	}
+
+	if _, err := ParseRDPConnectionRequest(rdpRequest("Cookie: mstshash=alice", false)); err == nil {
+		t.Errorf("parse of unterminated cookie did not fail")
+	}
+
+	short := rdpRequest("", false)
+	short[3] = 4
+	if _, err := ParseRDPConnectionRequest(short); err == nil {
+		t.Errorf("parse of short length did not fail")
+	}
+}
+
+func TestRDPRoutes(t *testing.T) {
+	r := newRouteRecorder(t, (*RDPConnectionRequest)(nil))
+
+	h := NewRDP(r.handler("default"))
+	h.Routes = []Route{
+		{Matcher: &RDPMatch{Cookies: []string{"Alice"}}, Handler: r.handler("alice")},
+		{Matcher: &RDPMatch{RoutingTokens: []string{"3640205228.15629.0000"}}, Handler: r.handler("broker")},
+	}
+
+	r.check(h.Handle, []routeTest{
+		{rdpRequest("", true), "default"},
+		{rdpRequest("Cookie: mstshash=alice\r\n", true), "alice"},
+		{rdpRequest("Cookie: mstshash=bob\r\n", true), "default"},
+		{rdpRequest("Cookie: msts=3640205228.15629.0000\r\n", true), "broker"},
+	})
+}
@@ -0,0 +1,260 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// Redis field constants
+const (
+	RedisMaxArgs          = 1024 * 1024 // As enforced by the Redis server
+	RedisMaxCommandLength = 64
+	RedisMaxLookahead     = 128
+)
+
+var (
+	// RedisHandshakeCommands are the commands a Redis client commonly starts
+	// a connection with. They are the default for inline command detection.
+	RedisHandshakeCommands = []string{"HELLO", "AUTH", "PING"}
+)
+
+var errRESP = errors.New("redis: invalid RESP framing")
+
+// RedisCommand is the parsed first command sent by a Redis client. It is added
+// as a hint to connections handled by Redis.
+type RedisCommand struct {
+	// Name is the upper-cased command name.
+	Name string
+
+	// Args is the number of arguments following the command name. It is not
+	// known for inline commands, and is set to -1.
+	Args int
+
+	// Inline is set if the command was sent as an inline command rather than
+	// a RESP array.
+	Inline bool
+}
+
+// IsHandshake checks if the command is one of RedisHandshakeCommands.
+func (rc *RedisCommand) IsHandshake() bool {
+	return containsString(RedisHandshakeCommands, rc.Name)
+}
+
+// respLine parses a RESP line of the form "<prefix><digits>\r\n" at pos,
+// returning the value and the position after the line. If more data is needed,
+// the amount of bytes is returned as needed.
+func respLine(b []byte, pos int, prefix byte, max int) (val, next, needed int, err error) {
+	if len(b) <= pos {
+		return 0, 0, pos + 1, nil
+	}
+	if b[pos] != prefix {
+		return 0, 0, 0, errRESP
+	}
+
+	i := pos + 1
+	for ; i < len(b) && b[i] >= '0' && b[i] <= '9'; i++ {
+		val = val*10 + int(b[i]-'0')
+		if val > max {
+			return 0, 0, 0, errRESP
+		}
+	}
+
+	switch {
+	case i == len(b):
+		return 0, 0, i + 1, nil
+	case i == pos+1 || b[i] != '\r':
+		return 0, 0, 0, errRESP
+	case i+1 == len(b):
+		return 0, 0, i + 2, nil
+	case b[i+1] != '\n':
+		return 0, 0, 0, errRESP
+	}
+
+	return val, i + 2, 0, nil
+}
+
+// validCommandName checks that the command name only contains the characters
+// used by Redis commands.
+func validCommandName(name []byte) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '|') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseRESPCommand parses the RESP array header and the command name of the
+// first command. If more data is needed, the amount of bytes is returned as
+// needed, with a nil command and error.
+func ParseRESPCommand(header []byte) (cmd *RedisCommand, needed int, err error) {
+	count, pos, needed, err := respLine(header, 0, '*', RedisMaxArgs)
+	if needed > 0 || err != nil {
+		return nil, needed, err
+	}
+	if count < 1 {
+		return nil, 0, errRESP
+	}
+
+	length, pos, needed, err := respLine(header, pos, '$', RedisMaxCommandLength)
+	if needed > 0 || err != nil {
+		return nil, needed, err
+	}
+
+	end := pos + length
+	if len(header) < end+2 {
+		partial := header[pos:]
+		if len(partial) > length {
+			partial = partial[:length]
+		}
+		if len(partial) > 0 && !validCommandName(partial) {
+			return nil, 0, errRESP
+		}
+		return nil, end + 2, nil
+	}
+
+	if !validCommandName(header[pos:end]) || header[end] != '\r' || header[end+1] != '\n' {
+		return nil, 0, errRESP
+	}
+
+	return &RedisCommand{
+		Name: strings.ToUpper(string(header[pos:end])),
+		Args: count - 1,
+	}, 0, nil
+}
+
+// RedisMatch is a RouteMatcher for Redis clients starting with one of the
+// listed commands. An empty list matches everything.
+type RedisMatch struct {
+	Commands []string
+}
+
+// Matches checks if the route applies to the command.
+func (r *RedisMatch) Matches(hint interface{}) bool {
+	cmd, ok := hint.(*RedisCommand)
+	if !ok {
+		return false
+	}
+
+	return len(r.Commands) == 0 || containsFold(r.Commands, cmd.Name)
+}
+
+// Redis detects Redis clients by validating the RESP framing of the first
+// command and its name. If Inline is set, inline commands are also detected,
+// but only for the listed Commands, defaulting to RedisHandshakeCommands, as
+// they are otherwise indistinguishable from other text protocols. The
+// *RedisCommand is added as a hint to the connection given to the handler.
+type Redis struct {
+	// Commands, if set, restricts detection to clients starting with one of
+	// the listed commands.
+	Commands []string
+
+	// Inline enables detection of inline commands.
+	Inline bool
+
+	RouteTable
+
+	Description string
+}
+
+func (r *Redis) String() string {
+	return r.Description
+}
+
+// parse parses the first command as either RESP or, if enabled, inline.
+func (r *Redis) parse(header []byte) (*RedisCommand, int, error) {
+	if len(header) == 0 {
+		return nil, 1, nil
+	}
+
+	if header[0] == '*' {
+		return ParseRESPCommand(header)
+	}
+
+	if !r.Inline {
+		return nil, 0, errRESP
+	}
+
+	commands := r.Commands
+	if len(commands) == 0 {
+		commands = RedisHandshakeCommands
+	}
+
+	end := bytes.IndexAny(header, " \r\n")
+	if end == -1 {
+		if len(header) >= RedisMaxCommandLength || !validCommandName(header) {
+			return nil, 0, errRESP
+		}
+		return nil, len(header) + 1, nil
+	}
+
+	name := string(header[:end])
+	if !validCommandName(header[:end]) || !containsFold(commands, name) {
+		return nil, 0, errRESP
+	}
+
+	return &RedisCommand{
+		Name:   strings.ToUpper(name),
+		Args:   -1,
+		Inline: true,
+	}, 0, nil
+}
+
+// Check validates the framing of the first command.
+func (r *Redis) Check(header []byte, _ []interface{}) (bool, int) {
+	cmd, needed, err := r.parse(header)
+	switch {
+	case err != nil:
+		return false, 0
+	case cmd == nil:
+		return false, needed
+	case len(r.Commands) > 0 && !containsFold(r.Commands, cmd.Name):
+		return false, 0
+	default:
+		return true, 0
+	}
+}
+
+// Handle parses the first command and calls the handler of the first matching
+// route.
+func (r *Redis) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, RedisMaxLookahead, r.Check)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	cmd, _, err := r.parse(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(cmd))
+
+	return r.Route(pc, cmd)
+}
+
+// NewRedis returns a Redis with the provided handler as fallback.
+func NewRedis(handler func(net.Conn) (net.Conn, error)) *Redis {
+	return &Redis{
+		RouteTable:  RouteTable{Handler: handler},
+		Description: "Redis",
+	}
+}
+
+// NewRedisProxy returns a Redis set up to call DialAndProxy with the first
+// available of the provided backends if no routes match.
+func NewRedisProxy(proto string, dests ...string) *Redis {
+	r := NewRedis(FailoverHandler(proto, dests...))
+	r.Description = fmt.Sprintf("Redis [dest: %s]", strings.Join(dests, ", "))
+	return r
+}
@@ -0,0 +1,108 @@
+package proto
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+func TestRedis(t *testing.T) {
+	h := NewRedis(nil)
+	inline := NewRedis(nil)
+	inline.Inline = true
+
+	tests := []struct {
+		h        *Redis
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{h, nil, false, 1},
+		{h, []byte("*"), false, 2},
+		{h, []byte("*1"), false, 3},
+		{h, []byte("*1\r"), false, 4},
+		{h, []byte("*1\r\n"), false, 5},
+		{h, []byte("*1\r\n$4\r\n"), false, 14},
+		{h, []byte("*1\r\n$4\r\nPI"), false, 14},
+		{h, []byte("*1\r\n$4\r\nPING\r\n"), true, 0},
+		{h, []byte("*2\r\n$5\r\nhello\r\n$1\r\n3\r\n"), true, 0},
+		{h, []byte("*0\r\n"), false, 0},
+		{h, []byte("*1\n"), false, 0},
+		{h, []byte("*1\r\n$4\r\nP NG\r\n"), false, 0},
+		{h, []byte("*1\r\n$4\r\nPINGX\r\n"), false, 0},
+		{h, []byte("*1\r\n$999\r\n"), false, 0},
+		{h, []byte("PING\r\n"), false, 0},
+		{inline, []byte("PING\r\n"), true, 0},
+		{inline, []byte("ping"), false, 5},
+		{inline, []byte("AUTH secret\r\n"), true, 0},
+		{inline, []byte("GET / HTTP/1.1\r\n"), false, 0},
+		{inline, []byte("*1\r\n$4\r\nPING\r\n"), true, 0},
+	}
+
+	for _, test := range tests {
+		match, required := test.h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestRedisCommands(t *testing.T) {
+	h := NewRedis(nil)
+	h.Commands = []string{"HELLO"}
+
+	if match, _ := h.Check([]byte("*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n"), nil); !match {
+		t.Errorf("HELLO did not match when it should")
+	}
+	if match, _ := h.Check([]byte("*1\r\n$4\r\nPING\r\n"), nil); match {
+		t.Errorf("PING matched when it shouldn't")
+	}
+}
+
+func TestRedisRoutes(t *testing.T) {
+	routed := make(chan *RedisCommand, 1)
+	h := NewRedis(func(c net.Conn) (net.Conn, error) {
+		hints := utils.GetHints(c)
+		cmd, _ := hints[len(hints)-1].(*RedisCommand)
+		routed <- cmd
+		return nil, nil
+	})
+	h.Inline = true
+
+	tests := []struct {
+		payload string
+		cmd     RedisCommand
+	}{
+		{"*2\r\n$4\r\nauth\r\n$6\r\nsecret\r\n", RedisCommand{Name: "AUTH", Args: 1}},
+		{"*1\r\n$7\r\nCOMMAND\r\n", RedisCommand{Name: "COMMAND", Args: 0}},
+		{"ping\r\n", RedisCommand{Name: "PING", Args: -1, Inline: true}},
+	}
+
+	for _, test := range tests {
+		server, client := net.Pipe()
+		go client.Write([]byte(test.payload))
+
+		if _, err := h.Handle(server); err != nil {
+			t.Errorf("handle failed for %q: %v", test.payload, err)
+		}
+
+		select {
+		case cmd := <-routed:
+			if cmd == nil || *cmd != test.cmd {
+				t.Errorf("%q hinted %+v, expected %+v", test.payload, cmd, test.cmd)
+			}
+		case <-time.After(300 * time.Millisecond):
+			t.Errorf("timed out waiting for %q to be routed", test.payload)
+		}
+
+		server.Close()
+		client.Close()
+	}
+}
@@ -0,0 +1,224 @@
+package proto
+
+import (
+	"net"
+	"regexp/syntax"
+	"unicode/utf8"
+)
+
+// DefaultRegexMaxLength is the default lookahead of RegexMatcher.
+const DefaultRegexMaxLength = 256
+
+// RegexMatcher matches a regular expression anchored at the start of the
+// header, using the syntax of the regexp package. The header matches as soon
+// as a prefix of it matches the expression, and more data is requested as
+// long as a longer header could still match, up to MaxLength bytes.
+//
+// The header is read as UTF-8 like the regexp package does, so bytes above
+// 0x7F only match as part of valid UTF-8 sequences. Use MaskMatcher for
+// binary headers. As the rest of the stream is unknown, $, \z and \b are only
+// satisfied once the byte after them has been read.
+//
+// A RegexMatcher must be created with NewRegexMatcher.
+type RegexMatcher struct {
+	// MaxLength is the amount of bytes the expression is run over.
+	MaxLength int
+
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+
+	prog      *syntax.Prog
+	minLength int
+}
+
+func (m *RegexMatcher) String() string {
+	return m.Description
+}
+
+func (m *RegexMatcher) maxLength() int {
+	if m.MaxLength == 0 {
+		return DefaultRegexMaxLength
+	}
+	return m.MaxLength
+}
+
+// MaxLookahead returns MaxLength.
+func (m *RegexMatcher) MaxLookahead() int {
+	return m.maxLength()
+}
+
+// regexMinLength returns the minimum amount of bytes matched by the
+// expression, counting a byte per rune outside of literals.
+func regexMinLength(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			// Folded runes may be shorter
+			return len(re.Rune)
+		}
+		var n int
+		for _, r := range re.Rune {
+			n += utf8.RuneLen(r)
+		}
+		return n
+	case syntax.OpCharClass, syntax.OpAnyCharNotNL, syntax.OpAnyChar:
+		return 1
+	case syntax.OpCapture, syntax.OpPlus:
+		return regexMinLength(re.Sub[0])
+	case syntax.OpRepeat:
+		return re.Min * regexMinLength(re.Sub[0])
+	case syntax.OpConcat:
+		var n int
+		for _, sub := range re.Sub {
+			n += regexMinLength(sub)
+		}
+		return n
+	case syntax.OpAlternate:
+		n := -1
+		for _, sub := range re.Sub {
+			if l := regexMinLength(sub); n == -1 || l < n {
+				n = l
+			}
+		}
+		return n
+	}
+	return 0
+}
+
+// run runs the program over the header, reporting if a prefix of it matches,
+// or if a longer header could match.
+func (m *RegexMatcher) run(header []byte) (matched, possible bool) {
+	var (
+		visited = make([]bool, len(m.prog.Inst))
+		current = []uint32{uint32(m.prog.Start)}
+		prev    = rune(-1)
+		pending bool
+	)
+
+	for pos := 0; ; {
+		// The next rune is unknown at the end of the header, or if it is
+		// not complete.
+		next, width := rune(-1), 0
+		known := pos < len(header) && utf8.FullRune(header[pos:])
+		if known {
+			next, width = utf8.DecodeRune(header[pos:])
+		}
+
+		// Follow the instructions not consuming runes.
+		for i := range visited {
+			visited[i] = false
+		}
+		var runes []uint32
+		stack := append([]uint32(nil), current...)
+		for len(stack) > 0 {
+			pc := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if visited[pc] {
+				continue
+			}
+			visited[pc] = true
+
+			inst := &m.prog.Inst[pc]
+			switch inst.Op {
+			case syntax.InstMatch:
+				return true, true
+			case syntax.InstAlt, syntax.InstAltMatch:
+				stack = append(stack, inst.Arg, inst.Out)
+			case syntax.InstCapture, syntax.InstNop:
+				stack = append(stack, inst.Out)
+			case syntax.InstEmptyWidth:
+				if !known {
+					pending = true
+				} else if syntax.EmptyOp(inst.Arg)&^syntax.EmptyOpContext(prev, next) == 0 {
+					stack = append(stack, inst.Out)
+				}
+			case syntax.InstRune, syntax.InstRune1, syntax.InstRuneAny, syntax.InstRuneAnyNotNL:
+				runes = append(runes, pc)
+			}
+		}
+
+		if !known {
+			return false, pending || len(runes) > 0
+		}
+
+		// Consume the next rune.
+		current = current[:0]
+		for _, pc := range runes {
+			inst := &m.prog.Inst[pc]
+			var ok bool
+			switch inst.Op {
+			case syntax.InstRune:
+				ok = inst.MatchRune(next)
+			case syntax.InstRune1:
+				ok = inst.Rune[0] == next
+			case syntax.InstRuneAny:
+				ok = true
+			case syntax.InstRuneAnyNotNL:
+				ok = next != '\n'
+			}
+			if ok {
+				current = append(current, inst.Out)
+			}
+		}
+
+		if len(current) == 0 {
+			return false, false
+		}
+
+		prev = next
+		pos += width
+	}
+}
+
+// Check runs the expression over the header.
+func (m *RegexMatcher) Check(header []byte, _ []interface{}) (bool, int) {
+	max := m.maxLength()
+	if len(header) > max {
+		header = header[:max]
+	}
+
+	matched, possible := m.run(header)
+	switch {
+	case matched:
+		return true, 0
+	case !possible, len(header) >= max, m.minLength > max:
+		return false, 0
+	case len(header) < m.minLength:
+		return false, m.minLength
+	default:
+		return false, len(header) + 1
+	}
+}
+
+// Handle calls the provided handler.
+func (m *RegexMatcher) Handle(c net.Conn) (net.Conn, error) {
+	return m.Handler(c)
+}
+
+// NewRegexMatcher returns a RegexMatcher for the expression, using the Perl
+// syntax of the regexp package, and the provided handler.
+func NewRegexMatcher(expr string, handler func(net.Conn) (net.Conn, error)) (*RegexMatcher, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	re = re.Simplify()
+
+	prog, err := syntax.Compile(re)
+	if err != nil {
+		return nil, err
+	}
+
+	minLength := regexMinLength(re)
+	if minLength == 0 {
+		minLength = 1
+	}
+
+	return &RegexMatcher{
+		MaxLength:   DefaultRegexMaxLength,
+		Handler:     handler,
+		Description: "RegexMatcher [" + expr + "]",
+		prog:        prog,
+		minLength:   minLength,
+	}, nil
+}
@@ -0,0 +1,78 @@
+package proto
+
+import (
+	"testing"
+)
+
+func TestRegexMatcher(t *testing.T) {
+	tests := []struct {
+		expr     string
+		payload  string
+		match    bool
+		required int
+	}{
+		{`GET|POST`, "", false, 3},
+		{`GET|POST`, "G", false, 3},
+		{`GET|POST`, "GE", false, 3},
+		{`GET|POST`, "GET", true, 0},
+		{`GET|POST`, "GETTING", true, 0},
+		{`GET|POST`, "POS", false, 4},
+		{`GET|POST`, "PUT", false, 0},
+		{`GET|POST`, " GET", false, 0},
+		{`(?i)helo `, "HeLo ", true, 0},
+		{`(?i)helo `, "hel", false, 5},
+		{`[A-Z]+ /`, "OPTIONS", false, 8},
+		{`[A-Z]+ /`, "OPTIONS /", true, 0},
+		{`[A-Z]+ /`, "OPTIONS *", false, 0},
+		{`SSH-2\.0-\S+\r?\n`, "SSH-2.0-Go", false, 11},
+		{`SSH-2\.0-\S+\r?\n`, "SSH-2.0-Go\r", false, 12},
+		{`SSH-2\.0-\S+\r?\n`, "SSH-2.0-Go\r\n", true, 0},
+		{`SSH-2\.0-\S+\r?\n`, "SSH-2.0-Go \n", false, 0},
+		{`GET$`, "GET", false, 4},
+		{`(?m)GET$`, "GET\n", true, 0},
+		{`GET$`, "GET\n", false, 0},
+		{`ab\b`, "ab", false, 3},
+		{`ab\b`, "ab ", true, 0},
+		{`ab\b`, "abc", false, 0},
+		{`\x16\x03`, "\x16\x03", true, 0},
+		{`é`, "\xc3", false, 2},
+		{`é`, "\xc3\xa9", true, 0},
+		{`a*`, "", true, 0},
+		{`x{300}`, "xxx", false, 0},
+	}
+
+	for _, test := range tests {
+		m, err := NewRegexMatcher(test.expr, nil)
+		if err != nil {
+			t.Fatalf("compiling %q failed: %v", test.expr, err)
+		}
+
+		match, required := m.Check([]byte(test.payload), nil)
+		if test.match != match {
+			t.Errorf("%q: match not correct for %q: was %t, expected %t",
+				test.expr, test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("%q: required not correct for %q: was %d, expected %d",
+				test.expr, test.payload, required, test.required)
+		}
+	}
+}
+
+func TestRegexMatcherMaxLength(t *testing.T) {
+	m, err := NewRegexMatcher(`A+B`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.MaxLength = 4
+
+	if match, required := m.Check([]byte("AAA"), nil); match || required != 4 {
+		t.Errorf("check of AAA returned %t, %d, expected false, 4", match, required)
+	}
+	if match, required := m.Check([]byte("AAAAB"), nil); match || required != 0 {
+		t.Errorf("check of AAAAB returned %t, %d, expected false, 0", match, required)
+	}
+	if _, err := NewRegexMatcher(`(`, nil); err == nil {
+		t.Errorf("invalid expression compiled")
+	}
+}
@@ -0,0 +1,288 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// Request line field constants
+const (
+	RequestLineMaxLength = 4096
+	requestLineMaxMethod = 32
+)
+
+var (
+	// HTTPVersions are the version tokens of HTTP/1.x request lines.
+	HTTPVersions = []string{"HTTP/1.0", "HTTP/1.1"}
+
+	// RTSPVersions are the version tokens of RTSP request lines.
+	RTSPVersions = []string{"RTSP/1.0", "RTSP/2.0"}
+
+	// SIPVersions are the version tokens of SIP request lines.
+	SIPVersions = []string{"SIP/2.0"}
+
+	// ICAPVersions are the version tokens of ICAP request lines.
+	ICAPVersions = []string{"ICAP/1.0"}
+)
+
+// RequestLine is a parsed "METHOD SP URI SP VERSION" line, as used by HTTP/1.x,
+// RTSP, SIP and ICAP. It is added as a hint to connections handled by
+// RequestLineMatcher.
+type RequestLine struct {
+	Method  string
+	URI     string
+	Version string
+
+	// Raw is the line without the line ending.
+	Raw string
+}
+
+// Scheme returns the scheme of the URI, such as "rtsp" or "sip", or an empty
+// string for URIs without one, such as "*", "/path" or the authority of a
+// CONNECT request.
+func (rl *RequestLine) Scheme() string {
+	if rl.Method == "CONNECT" {
+		return ""
+	}
+
+	i := strings.IndexByte(rl.URI, ':')
+	if i <= 0 {
+		return ""
+	}
+
+	for j, c := range rl.URI[:i] {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case j > 0 && (c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.'):
+		default:
+			return ""
+		}
+	}
+	return strings.ToLower(rl.URI[:i])
+}
+
+// isTokenChar checks if c may be part of a method name.
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
+
+// RequestLineMatch is a RouteMatcher for request lines with matching
+// versions, URI schemes and methods. Versions and methods are compared
+// exactly, and schemes case-insensitively, with the empty scheme matching URIs
+// without a scheme. Empty lists match everything.
+type RequestLineMatch struct {
+	Versions []string
+	Schemes  []string
+	Methods  []string
+}
+
+// matchesPartial checks if the route may apply to a request line of which the
+// first fields fields are complete. If the version is not complete, it only
+// needs to be a prefix of one of the versions.
+func (r *RequestLineMatch) matchesPartial(rl *RequestLine, fields int, complete bool) bool {
+	if fields > 1 && len(r.Methods) > 0 && !containsString(r.Methods, rl.Method) {
+		return false
+	}
+
+	if fields > 2 && len(r.Schemes) > 0 && !containsFold(r.Schemes, rl.Scheme()) {
+		return false
+	}
+
+	if fields > 2 && len(r.Versions) > 0 {
+		if complete {
+			return containsString(r.Versions, rl.Version)
+		}
+		for _, version := range r.Versions {
+			if strings.HasPrefix(version, rl.Version) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// Matches checks if the route applies to the request line.
+func (r *RequestLineMatch) Matches(hint interface{}) bool {
+	rl, ok := hint.(*RequestLine)
+	return ok && r.matchesPartial(rl, 3, true)
+}
+
+// RequestLineMatcher detects text protocols sharing the request line grammar
+// of HTTP/1.x, and routes them by version, URI scheme and method. This makes
+// the choice between protocols sharing methods deterministic, such as between
+// "OPTIONS * HTTP/1.1" and "OPTIONS rtsp://example.com RTSP/1.0", which a
+// SimpleMatcher for HTTPMethods cannot tell apart. The *RequestLine is added
+// as a hint to the connection given to the handler.
+//
+// Only lines claimed by a route are matched, unless Handler is set. Lines are
+// dismissed as soon as no route can match them, but matching requires the
+// complete line, so MaxLength is declared as the lookahead of the matcher.
+type RequestLineMatcher struct {
+	RouteTable
+
+	// MaxLength is the maximum length of the line, including the line ending.
+	MaxLength int
+
+	Description string
+}
+
+func (m *RequestLineMatcher) String() string {
+	return m.Description
+}
+
+func (m *RequestLineMatcher) maxLength() int {
+	if m.MaxLength == 0 {
+		return RequestLineMaxLength
+	}
+	return m.MaxLength
+}
+
+// MaxLookahead returns the maximum length of the line.
+func (m *RequestLineMatcher) MaxLookahead() int {
+	return m.maxLength()
+}
+
+// possible checks if a route may still apply to the partial request line.
+// Routes with other matchers than *RequestLineMatch may apply to any line.
+func (m *RequestLineMatcher) possible(rl *RequestLine, fields int, complete bool) bool {
+	if m.Handler != nil {
+		return true
+	}
+	for i := range m.Routes {
+		r, ok := m.Routes[i].Matcher.(*RequestLineMatch)
+		if !ok || r.matchesPartial(rl, fields, complete) {
+			return true
+		}
+	}
+	return false
+}
+
+// parse parses the request line. If more data is needed, the amount of bytes
+// is returned as needed, with a nil line and error.
+func (m *RequestLineMatcher) parse(header []byte) (*RequestLine, int, error) {
+	max := m.maxLength()
+
+	end := bytes.IndexByte(header, '\n')
+	line := header
+	if end != -1 {
+		line = bytes.TrimSuffix(header[:end], []byte("\r"))
+	}
+
+	for i, c := range line {
+		if c < 0x20 || c == 0x7F {
+			// A CR is only allowed before the LF, which may not be here yet
+			if c == '\r' && end == -1 && i == len(line)-1 {
+				continue
+			}
+			return nil, 0, errors.New("requestline: invalid character")
+		}
+	}
+	line = bytes.TrimSuffix(line, []byte("\r"))
+
+	fields := strings.Split(string(line), " ")
+	if len(fields) > 3 {
+		return nil, 0, errors.New("requestline: too many fields")
+	}
+
+	rl := &RequestLine{Method: fields[0]}
+	if len(rl.Method) > requestLineMaxMethod {
+		return nil, 0, errors.New("requestline: method too long")
+	}
+	for i := 0; i < len(rl.Method); i++ {
+		if !isTokenChar(rl.Method[i]) {
+			return nil, 0, errors.New("requestline: invalid method")
+		}
+	}
+	if len(fields) > 1 {
+		rl.URI = fields[1]
+		if rl.Method == "" {
+			return nil, 0, errors.New("requestline: empty method")
+		}
+	}
+	if len(fields) > 2 {
+		rl.Version = fields[2]
+		if rl.URI == "" {
+			return nil, 0, errors.New("requestline: empty URI")
+		}
+	}
+
+	if !m.possible(rl, len(fields), end != -1) {
+		return nil, 0, ErrNoRoute
+	}
+
+	if end == -1 {
+		if len(header) >= max {
+			return nil, 0, errors.New("requestline: line too long")
+		}
+		return nil, len(header) + 1, nil
+	}
+
+	if end+1 > max {
+		return nil, 0, errors.New("requestline: line too long")
+	}
+	if len(fields) != 3 || rl.Version == "" {
+		return nil, 0, errors.New("requestline: malformed line")
+	}
+
+	rl.Raw = string(line)
+	return rl, 0, nil
+}
+
+// Check parses the request line, matching if a route claims it.
+func (m *RequestLineMatcher) Check(header []byte, _ []interface{}) (bool, int) {
+	rl, needed, err := m.parse(header)
+	if err != nil || rl == nil {
+		return false, needed
+	}
+	return true, 0
+}
+
+// Handle parses the request line and calls the handler of the first matching
+// route.
+func (m *RequestLineMatcher) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, m.maxLength(), m.Check)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	rl, _, err := m.parse(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(rl))
+
+	return m.Route(pc, rl)
+}
+
+// NewRequestLineMatcher returns a RequestLineMatcher with the provided routes
+// and no fallback.
+func NewRequestLineMatcher(routes ...Route) *RequestLineMatcher {
+	return &RequestLineMatcher{
+		RouteTable:  RouteTable{Routes: routes},
+		MaxLength:   RequestLineMaxLength,
+		Description: "RequestLine",
+	}
+}
+
+// NewRequestLineProxy returns a RequestLineMatcher set up to call DialAndProxy
+// for request lines matching no route.
+func NewRequestLineProxy(proto, dest string, routes ...Route) *RequestLineMatcher {
+	m := NewRequestLineMatcher(routes...)
+	m.Handler = ProxyHandler(proto, dest)
+	m.Description = fmt.Sprintf("RequestLine [dest: %s]", dest)
+	return m
+}
@@ -0,0 +1,102 @@
+package proto
+
+import (
+	"testing"
+)
+
+func TestRequestLineMatcher(t *testing.T) {
+	h := NewRequestLineMatcher(
+		Route{Matcher: &RequestLineMatch{Versions: HTTPVersions}},
+		Route{Matcher: &RequestLineMatch{Versions: RTSPVersions, Schemes: []string{"rtsp", "rtsps", ""}}},
+		Route{Matcher: &RequestLineMatch{Versions: SIPVersions, Schemes: []string{"sip", "sips"}}},
+	)
+
+	tests := []struct {
+		payload  string
+		match    bool
+		required int
+	}{
+		{"", false, 1},
+		{"OPT", false, 4},
+		{"OPTIONS * ", false, 11},
+		{"OPTIONS * RTSP", false, 15},
+		{"OPTIONS * RTSP/1.0\r", false, 20},
+		{"OPTIONS * RTSP/1.0\r\n", true, 0},
+		{"OPTIONS * HTTP/1.1\r\n", true, 0},
+		{"OPTIONS rtsp://example.com/stream RTSP/1.0\r\n", true, 0},
+		{"OPTIONS sip:bob@example.com SIP/2.0\r\n", true, 0},
+		{"GET / HTTP/1.1\r\n", true, 0},
+		{"CONNECT example.com:443 HTTP/1.1\r\n", true, 0},
+		{"GET / HTTP/1.1\n", true, 0},
+		{"OPTIONS * SIP/2.0\r\n", false, 0},
+		{"OPTIONS * ICAP", false, 0},
+		{"OPTIONS icap://example.com/ ", false, 29},
+		{"INVITE tel:+4512345678 SIP/2.0\r\n", false, 0},
+		{"OPTIONS * HTTP/2.0\r\n", false, 0},
+		{"GET / HTTP/1.1 x\r\n", false, 0},
+		{"GET  HTTP/1.1\r\n", false, 0},
+		{" / HTTP/1.1\r\n", false, 0},
+		{"G(T / HTTP/1.1\r\n", false, 0},
+		{"GET /\x00", false, 0},
+		{"SSH-2.0-OpenSSH_7.4\r\n", false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check([]byte(test.payload), nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestRequestLineScheme(t *testing.T) {
+	tests := []struct {
+		method string
+		uri    string
+		scheme string
+	}{
+		{"GET", "/", ""},
+		{"OPTIONS", "*", ""},
+		{"GET", "http://example.com/", "http"},
+		{"DESCRIBE", "RTSP://example.com/", "rtsp"},
+		{"INVITE", "sip:bob@example.com", "sip"},
+		{"CONNECT", "example.com:443", ""},
+		{"GET", "/a:b", ""},
+		{"GET", "1a:b", ""},
+	}
+
+	for _, test := range tests {
+		rl := &RequestLine{Method: test.method, URI: test.uri}
+		if scheme := rl.Scheme(); scheme != test.scheme {
+			t.Errorf("scheme of %s %s was %q, expected %q", test.method, test.uri, scheme, test.scheme)
+		}
+	}
+}
+
+func TestRequestLineRoutes(t *testing.T) {
+	r := newRouteRecorder(t, (*RequestLine)(nil))
+
+	h := NewRequestLineMatcher(
+		Route{Matcher: &RequestLineMatch{Versions: RTSPVersions}, Handler: r.handler("rtsp")},
+		Route{Matcher: &RequestLineMatch{Versions: SIPVersions}, Handler: r.handler("sip")},
+		Route{Matcher: &RequestLineMatch{Versions: ICAPVersions, Schemes: []string{"icap"}}, Handler: r.handler("icap")},
+		Route{Matcher: &RequestLineMatch{Versions: HTTPVersions, Methods: []string{"CONNECT"}}, Handler: r.handler("connect")},
+		Route{Matcher: &RequestLineMatch{Versions: HTTPVersions}, Handler: r.handler("http")},
+	)
+	h.Handler = r.handler("default")
+
+	r.check(h.Handle, []routeTest{
+		{[]byte("OPTIONS * HTTP/1.1\r\n"), "http"},
+		{[]byte("OPTIONS * RTSP/1.0\r\n"), "rtsp"},
+		{[]byte("OPTIONS sip:example.com SIP/2.0\r\n"), "sip"},
+		{[]byte("REQMOD icap://proxy/filter ICAP/1.0\r\n"), "icap"},
+		{[]byte("CONNECT example.com:443 HTTP/1.1\r\n"), "connect"},
+		{[]byte("GET / HTTP/1.0\r\n"), "http"},
+		{[]byte("GET / FOO/1.0\r\n"), "default"},
+	})
+}
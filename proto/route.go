@@ -0,0 +1,46 @@
+package proto
+
+import "net"
+
+// RouteMatcher checks if a route applies to a connection, given the hint
+// parsed by the Protocol routing it, such as the *SSHIdentification for SSH.
+// Hints of other types do not match.
+type RouteMatcher interface {
+	Matches(hint interface{}) bool
+}
+
+// Route describes a handler for connections accepted by its Matcher.
+type Route struct {
+	Matcher RouteMatcher
+	Handler func(net.Conn) (net.Conn, error)
+}
+
+// RouteTable holds the routes of a Protocol, along with the handler used if
+// none of them match.
+type RouteTable struct {
+	// Routes are tried in order, with the first matching route being used.
+	Routes []Route
+
+	// Handler is used if no route matches.
+	Handler func(net.Conn) (net.Conn, error)
+}
+
+// Route calls the handler of the first route matching the hint, or Handler if
+// none do. If there is no handler to call, the connection is closed and
+// ErrNoRoute returned.
+func (t *RouteTable) Route(c net.Conn, hint interface{}) (net.Conn, error) {
+	handler := t.Handler
+	for i := range t.Routes {
+		if t.Routes[i].Matcher.Matches(hint) {
+			handler = t.Routes[i].Handler
+			break
+		}
+	}
+
+	if handler == nil {
+		c.Close()
+		return nil, ErrNoRoute
+	}
+
+	return handler(c)
+}
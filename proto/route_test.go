@@ -0,0 +1,116 @@
+package proto
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// routeTest is a payload and the name of the route expected to handle it.
+type routeTest struct {
+	payload []byte
+	route   string
+}
+
+// routeRecorder creates handlers reporting their name when called with a
+// connection carrying a hint of the same type as hint.
+type routeRecorder struct {
+	t      *testing.T
+	hint   reflect.Type
+	routed chan string
+}
+
+func newRouteRecorder(t *testing.T, hint interface{}) *routeRecorder {
+	return &routeRecorder{
+		t:      t,
+		hint:   reflect.TypeOf(hint),
+		routed: make(chan string, 1),
+	}
+}
+
+func (r *routeRecorder) handler(name string) func(net.Conn) (net.Conn, error) {
+	return func(c net.Conn) (net.Conn, error) {
+		hints := utils.GetHints(c)
+		if len(hints) == 0 || reflect.TypeOf(hints[len(hints)-1]) != r.hint {
+			r.t.Errorf("%v hint missing", r.hint)
+		}
+		r.routed <- name
+		return nil, nil
+	}
+}
+
+// check writes each payload to a connection given to handle, verifying the
+// route it was given to.
+func (r *routeRecorder) check(handle func(net.Conn) (net.Conn, error), tests []routeTest) {
+	for _, test := range tests {
+		server, client := net.Pipe()
+		go client.Write(test.payload)
+
+		if _, err := handle(server); err != nil {
+			r.t.Errorf("handle failed for %q: %v", test.payload, err)
+		}
+
+		select {
+		case route := <-r.routed:
+			if route != test.route {
+				r.t.Errorf("%q routed to %s, expected %s", test.payload, route, test.route)
+			}
+		case <-time.After(300 * time.Millisecond):
+			r.t.Errorf("timed out waiting for %q to be routed", test.payload)
+		}
+
+		server.Close()
+		client.Close()
+	}
+}
+
+// prefixMatch matches string hints with a prefix.
+type prefixMatch string
+
+func (m prefixMatch) Matches(hint interface{}) bool {
+	s, ok := hint.(string)
+	return ok && strings.HasPrefix(s, string(m))
+}
+
+func TestRouteTable(t *testing.T) {
+	var routed string
+	handler := func(name string) func(net.Conn) (net.Conn, error) {
+		return func(net.Conn) (net.Conn, error) {
+			routed = name
+			return nil, nil
+		}
+	}
+
+	table := RouteTable{
+		Routes: []Route{
+			{Matcher: prefixMatch("a"), Handler: handler("a")},
+			{Matcher: prefixMatch("ab"), Handler: handler("ab")},
+		},
+	}
+
+	tests := []struct {
+		hint  interface{}
+		route string
+		err   error
+	}{
+		{"abc", "a", nil},
+		{"b", "", ErrNoRoute},
+		{[]byte("abc"), "", ErrNoRoute},
+	}
+
+	for _, test := range tests {
+		routed = ""
+		server, client := net.Pipe()
+		if _, err := table.Route(server, test.hint); err != test.err {
+			t.Errorf("%q routed with %v, expected %v", test.hint, err, test.err)
+		}
+		if routed != test.route {
+			t.Errorf("%q routed to %q, expected %q", test.hint, routed, test.route)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,440 @@
+package proto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errSignature = errors.New("signatures: invalid file")
+
+// SignatureCondition is a condition of a Signature.
+type SignatureCondition struct {
+	// Kind is the keyword of the condition: "bytes", "string", "istring",
+	// "regex" or "length".
+	Kind   string
+	Offset int
+
+	// Value and Mask are the bytes compared by bytes, string and istring
+	// conditions. For istring, the case bit of letters is masked out.
+	Value []byte
+	Mask  []byte
+
+	// Size and Max describe the length field of length conditions.
+	Size int
+	Max  int
+
+	check     Checker
+	lookahead int
+}
+
+// fixed reports if the condition is fully described by Value and Mask.
+func (c *SignatureCondition) fixed() bool {
+	return c.Kind == "bytes" || c.Kind == "string" || c.Kind == "istring"
+}
+
+// Signature is a detector loaded by LoadSignatures. It matches if all its
+// conditions match.
+type Signature struct {
+	Name       string
+	Conditions []SignatureCondition
+
+	// Action is the action line of the signature, such as "proxy tcp
+	// localhost:22".
+	Action string
+
+	// Line is the line of the signature in the file.
+	Line int
+
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+
+	check Checker
+}
+
+func (s *Signature) String() string {
+	return s.Description
+}
+
+// MaxLookahead returns the largest amount of bytes the conditions may need.
+func (s *Signature) MaxLookahead() int {
+	var max int
+	for i := range s.Conditions {
+		if l := s.Conditions[i].lookahead; l > max {
+			max = l
+		}
+	}
+	return max
+}
+
+func (s *Signature) compile() {
+	checkers := make([]Checker, len(s.Conditions))
+	for i := range s.Conditions {
+		checkers[i] = s.Conditions[i].check
+	}
+	s.check = All(checkers...)
+}
+
+// Check checks all the conditions, like All.
+func (s *Signature) Check(header []byte, hints []interface{}) (bool, int) {
+	return s.check(header, hints)
+}
+
+// Handle calls the handler of the action.
+func (s *Signature) Handle(c net.Conn) (net.Conn, error) {
+	return s.Handler(c)
+}
+
+// signatureFields splits a line into fields, keeping double-quoted strings,
+// which may contain escapes, as one field.
+func signatureFields(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" || line[0] == '#' {
+			return fields, nil
+		}
+
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end == -1 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+			continue
+		}
+
+		end := 1
+		for ; end < len(line) && line[end] != '"'; end++ {
+			if line[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(line) {
+			return nil, errors.New("unterminated string")
+		}
+
+		s, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, s)
+		line = line[end+1:]
+	}
+}
+
+// parseCondition parses the fields of a condition line.
+func parseCondition(fields []string) (SignatureCondition, error) {
+	var c SignatureCondition
+	if len(fields) < 3 {
+		return c, fmt.Errorf("%s: missing arguments", fields[0])
+	}
+
+	c.Kind = fields[0]
+	offset, err := strconv.Atoi(fields[1])
+	if err != nil || offset < 0 {
+		return c, fmt.Errorf("%s: invalid offset %q", c.Kind, fields[1])
+	}
+	c.Offset = offset
+
+	switch c.Kind {
+	case "bytes":
+		c.Value, c.Mask, err = ParseMaskPattern(strings.Join(fields[2:], " "))
+		if err != nil {
+			return c, err
+		}
+		m := &MaskMatcher{Offset: offset, Value: c.Value, Mask: c.Mask}
+		c.check = m.Check
+		c.lookahead = m.MaxLookahead()
+
+	case "string", "istring":
+		if len(fields) != 3 || fields[2] == "" {
+			return c, fmt.Errorf("%s: expected one non-empty string", c.Kind)
+		}
+		c.Value = []byte(fields[2])
+		c.Mask = make([]byte, len(c.Value))
+		for i, b := range c.Value {
+			c.Mask[i] = 0xFF
+			if c.Kind == "istring" && ('a' <= b|0x20 && b|0x20 <= 'z') {
+				c.Value[i] = b &^ 0x20
+				c.Mask[i] = 0xDF
+			}
+		}
+		sm := &SimpleMatcher{Matches: [][]byte{c.Value}, FoldCase: c.Kind == "istring"}
+		c.check = AtOffset(offset, sm.Check)
+		c.lookahead = offset + len(c.Value)
+
+	case "regex":
+		if len(fields) != 3 {
+			return c, fmt.Errorf("%s: expected one expression", c.Kind)
+		}
+		rm, err := NewRegexMatcher(fields[2], nil)
+		if err != nil {
+			return c, err
+		}
+		c.check = AtOffset(offset, rm.Check)
+		c.lookahead = offset + rm.MaxLookahead()
+
+	case "length":
+		if len(fields) != 4 {
+			return c, fmt.Errorf("%s: expected size and maximum", c.Kind)
+		}
+		c.Size, err = strconv.Atoi(fields[2])
+		if err != nil || c.Size < 1 || c.Size > 4 {
+			return c, fmt.Errorf("%s: invalid size %q", c.Kind, fields[2])
+		}
+		c.Max, err = strconv.Atoi(fields[3])
+		if err != nil || c.Max < 1 {
+			return c, fmt.Errorf("%s: invalid maximum %q", c.Kind, fields[3])
+		}
+		c.check = AtOffset(offset, LengthPrefixed(c.Size, c.Max, nil).Check)
+		c.lookahead = offset + c.Size
+
+	default:
+		return c, fmt.Errorf("unknown keyword %q", c.Kind)
+	}
+
+	return c, nil
+}
+
+// parseAction parses the fields of an action line, returning the handler, or
+// nil if the line is not an action.
+func parseAction(fields []string, routes map[string]func(net.Conn) (net.Conn, error)) (func(net.Conn) (net.Conn, error), error) {
+	switch fields[0] {
+	case "proxy":
+		if len(fields) != 3 {
+			return nil, errors.New("proxy: expected network and address")
+		}
+		return ProxyHandler(fields[1], fields[2]), nil
+
+	case "drop":
+		if len(fields) != 1 {
+			return nil, errors.New("drop: unexpected arguments")
+		}
+		return DropHandler(), nil
+
+	case "tarpit":
+		if len(fields) != 2 {
+			return nil, errors.New("tarpit: expected duration")
+		}
+		d, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		return TarpitHandler(d), nil
+
+	case "route":
+		if len(fields) != 2 {
+			return nil, errors.New("route: expected handler name")
+		}
+		handler := routes[fields[1]]
+		if handler == nil {
+			return nil, fmt.Errorf("route: unknown handler %q", fields[1])
+		}
+		return handler, nil
+	}
+
+	return nil, nil
+}
+
+// LoadSignatures reads signatures, compiling them into Protocols, in the order
+// of the file. Each signature starts with a "signature <name>" line, followed
+// by its conditions, all of which must match, and one action:
+//
+//	# TLS records carrying a ClientHello
+//	signature tls
+//		bytes 0 16 03 ?? ?? ?? 01
+//		length 3 2 16384
+//		proxy tcp localhost:443
+//
+// Conditions start with the offset they apply at:
+//
+//	bytes <offset> <pattern>     bytes as parsed by ParseMaskPattern
+//	string <offset> "<string>"   a string, with Go escapes
+//	istring <offset> "<string>"  a string, ignoring ASCII case
+//	regex <offset> "<expr>"      an expression, as matched by RegexMatcher
+//	length <offset> <size> <max> a big-endian length field of size bytes,
+//	                             which may be at most max
+//
+// Actions are "proxy <network> <address>", "drop", "tarpit <duration>" and
+// "route <name>", which uses the handler of that name in routes. Lines
+// starting with # are ignored.
+//
+// As signatures match with certainty, the first matching signature is used.
+// ValidateSignatures reports signatures that overlap.
+func LoadSignatures(r io.Reader, routes map[string]func(net.Conn) (net.Conn, error)) ([]*Signature, error) {
+	var (
+		sigs    []*Signature
+		current *Signature
+		names   = make(map[string]bool)
+		scanner = bufio.NewScanner(r)
+		line    int
+	)
+
+	fail := func(format string, v ...interface{}) ([]*Signature, error) {
+		return nil, fmt.Errorf("%v: line %d: %s", errSignature, line, fmt.Sprintf(format, v...))
+	}
+
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		if len(current.Conditions) == 0 {
+			return fmt.Errorf("signature %q has no conditions", current.Name)
+		}
+		if current.Handler == nil {
+			return fmt.Errorf("signature %q has no action", current.Name)
+		}
+		current.compile()
+		sigs = append(sigs, current)
+		return nil
+	}
+
+	for scanner.Scan() {
+		line++
+		fields, err := signatureFields(scanner.Text())
+		if err != nil {
+			return fail("%v", err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "signature" {
+			if err := finish(); err != nil {
+				return fail("%v", err)
+			}
+			if len(fields) != 2 {
+				return fail("signature: expected name")
+			}
+			if names[fields[1]] {
+				return fail("duplicate signature %q", fields[1])
+			}
+			names[fields[1]] = true
+			current = &Signature{Name: fields[1], Line: line, Description: fields[1]}
+			continue
+		}
+
+		if current == nil {
+			return fail("%s outside of signature", fields[0])
+		}
+
+		handler, err := parseAction(fields, routes)
+		if err != nil {
+			return fail("%v", err)
+		}
+		if handler != nil {
+			if current.Handler != nil {
+				return fail("signature %q has more than one action", current.Name)
+			}
+			current.Handler = handler
+			current.Action = strings.Join(fields, " ")
+			continue
+		}
+
+		c, err := parseCondition(fields)
+		if err != nil {
+			return fail("%v", err)
+		}
+		current.Conditions = append(current.Conditions, c)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return fail("%v", err)
+	}
+
+	return sigs, nil
+}
+
+// SignatureConflict describes two signatures that may match the same header.
+type SignatureConflict struct {
+	First, Second *Signature
+
+	// Shadowed is set if First matches every header Second matches, so that
+	// Second is never used.
+	Shadowed bool
+}
+
+func (c SignatureConflict) String() string {
+	if c.Shadowed {
+		return fmt.Sprintf("signature %q (line %d) is shadowed by %q (line %d)",
+			c.Second.Name, c.Second.Line, c.First.Name, c.First.Line)
+	}
+	return fmt.Sprintf("signature %q (line %d) may overlap with %q (line %d)",
+		c.Second.Name, c.Second.Line, c.First.Name, c.First.Line)
+}
+
+// signatureBytes returns the value and mask of the byte conditions of the
+// signature by offset, and if these were all the conditions.
+func signatureBytes(s *Signature) (value, mask []byte, fixed bool) {
+	fixed = true
+	for i := range s.Conditions {
+		c := &s.Conditions[i]
+		if !c.fixed() {
+			fixed = false
+			continue
+		}
+
+		for end := c.Offset + len(c.Value); len(value) < end; {
+			value, mask = append(value, 0), append(mask, 0)
+		}
+		for j := range c.Value {
+			value[c.Offset+j] |= c.Value[j] & c.Mask[j]
+			mask[c.Offset+j] |= c.Mask[j]
+		}
+	}
+	return value, mask, fixed
+}
+
+// ValidateSignatures reports pairs of signatures that may match the same
+// header, judged by their byte and string conditions. Signatures are in the
+// order they are tried, so later signatures matching a subset of the headers
+// of earlier ones are reported as shadowed.
+func ValidateSignatures(sigs []*Signature) []SignatureConflict {
+	type bytesOf struct {
+		value, mask []byte
+		fixed       bool
+	}
+
+	all := make([]bytesOf, len(sigs))
+	for i, s := range sigs {
+		all[i].value, all[i].mask, all[i].fixed = signatureBytes(s)
+	}
+
+	var conflicts []SignatureConflict
+	for i := range sigs {
+		for j := i + 1; j < len(sigs); j++ {
+			a, b := all[i], all[j]
+
+			overlap, covers := true, a.fixed
+			for k := 0; k < len(a.value) && overlap; k++ {
+				var bv, bm byte
+				if k < len(b.value) {
+					bv, bm = b.value[k], b.mask[k]
+				}
+				both := a.mask[k] & bm
+				overlap = a.value[k]&both == bv&both
+				covers = covers && bm&a.mask[k] == a.mask[k]
+			}
+
+			if overlap {
+				conflicts = append(conflicts, SignatureConflict{
+					First:    sigs[i],
+					Second:   sigs[j],
+					Shadowed: covers,
+				})
+			}
+		}
+	}
+
+	return conflicts
+}
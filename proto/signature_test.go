@@ -0,0 +1,157 @@
+package proto
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const testSignatures = `
+# TLS records carrying a ClientHello
+signature tls
+	bytes 0 16 03 ?? ?? ?? 01
+	length 3 2 16384
+	proxy tcp localhost:443
+
+signature smtp
+	istring 0 "helo "
+	route mail
+
+signature http-get
+	string 0 "GET "
+	regex 4 "/[a-z]+ HTTP/1\\.[01]\r?\n"
+	drop
+
+signature http-any
+	string 0 "GET"
+	tarpit 1s
+`
+
+func TestLoadSignatures(t *testing.T) {
+	routes := map[string]func(net.Conn) (net.Conn, error){
+		"mail": ProxyHandler("tcp", "localhost:25"),
+	}
+
+	sigs, err := LoadSignatures(strings.NewReader(testSignatures), routes)
+	if err != nil {
+		t.Fatalf("loading failed: %v", err)
+	}
+	if len(sigs) != 4 {
+		t.Fatalf("loaded %d signatures, expected 4", len(sigs))
+	}
+
+	tests := []struct {
+		sig      int
+		payload  string
+		match    bool
+		required int
+	}{
+		{0, "", false, 5},
+		{0, "\x16\x03\x01", false, 5},
+		{0, "\x16\x03\x01\x00\x10\x01", true, 0},
+		{0, "\x16\x03\x01\x50\x00\x01", false, 0},
+		{0, "\x16\x03\x01\x00\x10\x02", false, 0},
+		{1, "HeLo example.com\r\n", true, 0},
+		{1, "ehlo", false, 0},
+		{2, "GET /index HTTP/1.1\r\n", true, 0},
+		{2, "GET /index", false, 16},
+		{2, "GET / HTTP/1.1\r\n", false, 0},
+		{3, "GET / HTTP/1.1\r\n", true, 0},
+	}
+
+	for _, test := range tests {
+		match, required := sigs[test.sig].Check([]byte(test.payload), nil)
+		if test.match != match {
+			t.Errorf("%v: match not correct for %q: was %t, expected %t",
+				sigs[test.sig], test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("%v: required not correct for %q: was %d, expected %d",
+				sigs[test.sig], test.payload, required, test.required)
+		}
+	}
+
+	if l := sigs[0].MaxLookahead(); l != 6 {
+		t.Errorf("lookahead of tls was %d, expected 6", l)
+	}
+	if l := sigs[2].MaxLookahead(); l != 4+DefaultRegexMaxLength {
+		t.Errorf("lookahead of http-get was %d, expected %d", l, 4+DefaultRegexMaxLength)
+	}
+	if a := sigs[1].Action; a != "route mail" {
+		t.Errorf("action of smtp was %q, expected route mail", a)
+	}
+}
+
+func TestLoadSignaturesErrors(t *testing.T) {
+	tests := []string{
+		"bytes 0 16",
+		"signature\n",
+		"signature a\n\tbytes 0 16\n\tdrop\nsignature a\n\tbytes 0 17\n\tdrop",
+		"signature a\n\tdrop",
+		"signature a\n\tbytes 0 16",
+		"signature a\n\tbytes 0 16\n\tdrop\n\tdrop",
+		"signature a\n\tbytes x 16\n\tdrop",
+		"signature a\n\tbytes 0 1x\n\tdrop",
+		"signature a\n\tstring 0 \"abc\n\tdrop",
+		"signature a\n\tstring 0 \"\"\n\tdrop",
+		"signature a\n\tregex 0 \"(\"\n\tdrop",
+		"signature a\n\tlength 0 5 10\n\tdrop",
+		"signature a\n\tlength 0 2\n\tdrop",
+		"signature a\n\tmagic 0 2\n\tdrop",
+		"signature a\n\tbytes 0 16\n\troute nowhere",
+		"signature a\n\tbytes 0 16\n\ttarpit forever",
+		"signature a\n\tbytes 0 16\n\tproxy tcp",
+	}
+
+	for _, test := range tests {
+		if _, err := LoadSignatures(strings.NewReader(test), nil); err == nil {
+			t.Errorf("loading %q did not fail", test)
+		}
+	}
+}
+
+func TestValidateSignatures(t *testing.T) {
+	sigs, err := LoadSignatures(strings.NewReader(testSignatures+`
+signature tls-v1
+	bytes 0 16 03 01
+	drop
+
+signature tls-low
+	bytes 0 16 0?
+	drop
+
+signature ssh
+	string 0 "SSH-"
+	drop
+
+signature ssh-2
+	string 0 "SSH-2.0-"
+	drop
+
+signature ssh-1
+	istring 0 "ssh-1"
+	drop
+`), map[string]func(net.Conn) (net.Conn, error){"mail": DropHandler()})
+	if err != nil {
+		t.Fatalf("loading failed: %v", err)
+	}
+
+	expected := []string{
+		`signature "tls-v1" (line 21) may overlap with "tls" (line 3)`,
+		`signature "tls-low" (line 25) may overlap with "tls" (line 3)`,
+		`signature "http-any" (line 17) may overlap with "http-get" (line 12)`,
+		`signature "tls-low" (line 25) may overlap with "tls-v1" (line 21)`,
+		`signature "ssh-2" (line 33) is shadowed by "ssh" (line 29)`,
+		`signature "ssh-1" (line 37) may overlap with "ssh" (line 29)`,
+	}
+
+	conflicts := ValidateSignatures(sigs)
+	if len(conflicts) != len(expected) {
+		t.Fatalf("reported %v, expected %v", conflicts, expected)
+	}
+	for i, c := range conflicts {
+		if c.String() != expected[i] {
+			t.Errorf("reported %q, expected %q", c, expected[i])
+		}
+	}
+}
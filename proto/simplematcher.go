@@ -15,7 +15,18 @@ func (ms matchByLength) Less(i, j int) bool { return len(ms[i]) < len(ms[j]) }
 // SimpleMatcher matches the provided bytes against a list of potential
 // matches, quickly dismissing impossible matches.
 type SimpleMatcher struct {
-	Matches     [][]byte
+	Matches [][]byte
+
+	// FoldCase makes the comparison ignore ASCII case.
+	FoldCase bool
+
+	// MinAfter is the amount of bytes required after a match.
+	MinAfter int
+
+	// Handlers holds handlers for individual matches, keyed by the match as
+	// listed in Matches. Matches without a handler use Handler.
+	Handlers map[string]func(net.Conn) (net.Conn, error)
+
 	Handler     func(net.Conn) (net.Conn, error)
 	Description string
 }
@@ -25,25 +36,103 @@ func (s *SimpleMatcher) String() string {
 	return s.Description
 }
 
-// Handle calls the provided handler.
+// Handle calls the handler of the match, or the provided handler.
 func (s *SimpleMatcher) Handle(c net.Conn) (net.Conn, error) {
-	return s.Handler(c)
-}
+	if len(s.Handlers) == 0 {
+		return s.Handler(c)
+	}
 
-// Check looks through the provided matches.
-func (s *SimpleMatcher) Check(header []byte, _ []interface{}) (bool, int) {
+	var max int
 	for _, candidate := range s.Matches {
+		if len(candidate) > max {
+			max = len(candidate)
+		}
+	}
+
+	header, pc, err := peek(c, max+s.MinAfter, s.Check)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	handler := s.Handler
+	if i, _ := s.find(header); i != -1 {
+		if h, ok := s.Handlers[string(s.Matches[i])]; ok {
+			handler = h
+		}
+	}
+
+	if handler == nil {
+		c.Close()
+		return nil, ErrNoRoute
+	}
+
+	return handler(pc)
+}
+
+// equalFoldASCII compares a and b, ignoring ASCII case.
+func equalFoldASCII(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		x, y := a[i], b[i]
+		if 'A' <= x && x <= 'Z' {
+			x += 'a' - 'A'
+		}
+		if 'A' <= y && y <= 'Z' {
+			y += 'a' - 'A'
+		}
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *SimpleMatcher) equal(a, b []byte) bool {
+	if s.FoldCase {
+		return equalFoldASCII(a, b)
+	}
+	return bytes.Equal(a, b)
+}
+
+// find looks through the matches, returning the index of the match, or -1
+// and the amount of bytes needed.
+func (s *SimpleMatcher) find(header []byte) (int, int) {
+	for i, candidate := range s.Matches {
 		if len(candidate) > len(header) {
-			if bytes.Compare(candidate[:len(header)], header) == 0 {
+			if s.equal(candidate[:len(header)], header) {
 				// We found the smallest potential future match
-				return false, len(candidate)
+				return -1, len(candidate) + s.MinAfter
+			}
+		} else if s.equal(header[:len(candidate)], candidate) {
+			if needed := len(candidate) + s.MinAfter; needed > len(header) {
+				// Longer matches would need even more
+				return -1, needed
 			}
-		} else if bytes.Compare(header[:len(candidate)], candidate) == 0 {
-			return true, 0
+			return i, 0
 		}
 	}
 
-	return false, 0
+	return -1, 0
+}
+
+// Check looks through the provided matches.
+func (s *SimpleMatcher) Check(header []byte, _ []interface{}) (bool, int) {
+	i, needed := s.find(header)
+	return i != -1, needed
+}
+
+// Prefixes returns the provided matches, allowing the server to match them
+// without calling Check. This gives the same results as Check with the
+// matches sorted by length. If FoldCase or MinAfter is set, nil is returned,
+// and Check is used.
+func (s *SimpleMatcher) Prefixes() [][]byte {
+	if s.FoldCase || s.MinAfter > 0 {
+		return nil
+	}
+	return s.Matches
 }
 
 // Sort sorts the provided matches by length.
@@ -1,6 +1,7 @@
 package proto
 
 import (
+	"net"
 	"testing"
 )
 
@@ -41,3 +42,87 @@ func TestSimpleMatcher(t *testing.T) {
 		}
 	}
 }
+
+func TestSimpleMatcherOptions(t *testing.T) {
+	fold := NewSimpleMatcher([][]byte{[]byte("HELO "), []byte("EHLO ")}, nil)
+	fold.FoldCase = true
+
+	after := NewSimpleMatcher([][]byte{[]byte("GE"), []byte("GET")}, nil)
+	after.MinAfter = 2
+
+	tests := []struct {
+		sm       *SimpleMatcher
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{fold, nil, false, 5},
+		{fold, []byte("h"), false, 5},
+		{fold, []byte("helo x"), true, 0},
+		{fold, []byte("eHlO x"), true, 0},
+		{fold, []byte("HELP"), false, 0},
+		{fold, []byte("h\xc5"), false, 0},
+		{after, nil, false, 4},
+		{after, []byte("G"), false, 4},
+		{after, []byte("GET"), false, 4},
+		{after, []byte("GET "), true, 0},
+		{after, []byte("GEX"), false, 4},
+		{after, []byte("GEXY"), true, 0},
+		{after, []byte("GA"), false, 0},
+		{after, []byte("P"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := test.sm.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+
+	if fold.Prefixes() != nil || after.Prefixes() != nil {
+		t.Errorf("prefixes returned for matcher needing Check")
+	}
+}
+
+func TestSimpleMatcherHandlers(t *testing.T) {
+	handled := make(chan string, 1)
+	handler := func(name string) func(net.Conn) (net.Conn, error) {
+		return func(c net.Conn) (net.Conn, error) {
+			handled <- name
+			return nil, nil
+		}
+	}
+
+	sm := NewSimpleMatcher([][]byte{[]byte("GET"), []byte("POST"), []byte("PUT")}, handler("default"))
+	sm.FoldCase = true
+	sm.Handlers = map[string]func(net.Conn) (net.Conn, error){
+		"GET":  handler("get"),
+		"POST": handler("post"),
+	}
+
+	tests := []struct {
+		payload string
+		name    string
+	}{
+		{"GET / HTTP/1.1\r\n", "get"},
+		{"post / HTTP/1.1\r\n", "post"},
+		{"PUT / HTTP/1.1\r\n", "default"},
+	}
+
+	for _, test := range tests {
+		server, client := net.Pipe()
+		go client.Write([]byte(test.payload))
+
+		if _, err := sm.Handle(server); err != nil {
+			t.Errorf("handling %q failed: %v", test.payload, err)
+		} else if name := <-handled; name != test.name {
+			t.Errorf("%q handled by %s, expected %s", test.payload, name, test.name)
+		}
+		client.Close()
+	}
+}
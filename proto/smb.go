@@ -0,0 +1,209 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// SMB field constants
+const (
+	SMB1Negotiate     = 0x72
+	SMB2Negotiate     = 0x0000
+	SMBMaxLookahead   = 1024
+	smbHeaderLen      = 4 + 4
+	smb1HeaderLen     = 32
+	smb2HeaderLen     = 64
+	smb2DialectsStart = 4 + smb2HeaderLen + 36
+)
+
+var (
+	smb1Magic = []byte("\xFFSMB")
+	smb2Magic = []byte("\xFESMB")
+)
+
+// SMBNegotiate describes the first message sent by an SMB client over direct
+// TCP. It is added as a hint to connections handled by SMB.
+type SMBNegotiate struct {
+	// Version is 1 for SMB1 messages and 2 for SMB2 and SMB3 messages.
+	Version int
+	Command uint16
+
+	// Dialects are the dialects offered by a Negotiate request, if they were
+	// within the first SMBMaxLookahead bytes. SMB1 dialects are named as sent,
+	// such as "NT LM 0.12" or "SMB 2.???", and SMB2 dialects as revisions,
+	// such as "2.1" or "3.1.1".
+	Dialects []string
+}
+
+// smb2DialectName returns the revision name of an SMB2 dialect.
+func smb2DialectName(d uint16) string {
+	switch d {
+	case 0x0202:
+		return "2.0.2"
+	case 0x0210:
+		return "2.1"
+	case 0x02FF:
+		return "2.???"
+	case 0x0300:
+		return "3.0"
+	case 0x0302:
+		return "3.0.2"
+	case 0x0311:
+		return "3.1.1"
+	}
+	return fmt.Sprintf("0x%04x", d)
+}
+
+// ParseSMBNegotiate parses the NetBIOS session header and SMB header, and the
+// dialects of Negotiate requests as far as available.
+func ParseSMBNegotiate(header []byte) (*SMBNegotiate, error) {
+	if len(header) < smbHeaderLen {
+		return nil, ErrNoMatch
+	}
+
+	n := &SMBNegotiate{}
+	switch {
+	case bytes.Equal(header[4:8], smb1Magic) && len(header) >= 4+smb1HeaderLen:
+		n.Version = 1
+		n.Command = uint16(header[8])
+	case bytes.Equal(header[4:8], smb2Magic) && len(header) >= 4+smb2HeaderLen:
+		n.Version = 2
+		n.Command = binary.LittleEndian.Uint16(header[4+12:])
+	default:
+		return nil, ErrNoMatch
+	}
+
+	switch {
+	case n.Version == 1 && n.Command == SMB1Negotiate:
+		// WordCount (0), ByteCount and null-terminated dialects, each
+		// preceded by a buffer format of 0x02
+		p := header[4+smb1HeaderLen:]
+		if len(p) < 3 || p[0] != 0 {
+			break
+		}
+		count := int(binary.LittleEndian.Uint16(p[1:]))
+		p = p[3:]
+		if count < len(p) {
+			p = p[:count]
+		}
+		for len(p) > 1 && p[0] == 0x02 {
+			end := bytes.IndexByte(p[1:], 0)
+			if end == -1 {
+				break
+			}
+			n.Dialects = append(n.Dialects, string(p[1:1+end]))
+			p = p[2+end:]
+		}
+	case n.Version == 2 && n.Command == SMB2Negotiate:
+		if len(header) < 4+smb2HeaderLen+4 {
+			break
+		}
+		count := int(binary.LittleEndian.Uint16(header[4+smb2HeaderLen+2:]))
+		for i := 0; i < count && len(header) >= smb2DialectsStart+2*i+2; i++ {
+			d := binary.LittleEndian.Uint16(header[smb2DialectsStart+2*i:])
+			n.Dialects = append(n.Dialects, smb2DialectName(d))
+		}
+	}
+
+	return n, nil
+}
+
+// SMB detects SMB1, SMB2 and SMB3 clients over direct TCP by the NetBIOS
+// session header and the SMB protocol ID of their first message. The
+// *SMBNegotiate is added as a hint to the connection given to the handler.
+//
+// The handler decides what happens to the connection, such as ProxyHandler to
+// pass it on to a file server, or DropHandler or TarpitHandler to block it.
+type SMB struct {
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (s *SMB) String() string {
+	return s.Description
+}
+
+// Check validates the NetBIOS session message header, the protocol ID and the
+// length of the SMB header.
+func (s *SMB) Check(header []byte, _ []interface{}) (bool, int) {
+	if len(header) >= 1 && header[0] != 0 {
+		return false, 0
+	}
+	if len(header) >= 5 {
+		magic := smb2Magic
+		if header[4] == smb1Magic[0] {
+			magic = smb1Magic
+		}
+		end := len(header)
+		if end > smbHeaderLen {
+			end = smbHeaderLen
+		}
+		if !bytes.HasPrefix(magic, header[4:end]) {
+			return false, 0
+		}
+	}
+	if len(header) < smbHeaderLen {
+		return false, smbHeaderLen
+	}
+
+	length := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+	if header[4] == smb1Magic[0] {
+		return length >= smb1HeaderLen+3, 0
+	}
+	return length >= smb2HeaderLen, 0
+}
+
+// checkLookahead requires as much of the message as possible within
+// SMBMaxLookahead.
+func (s *SMB) checkLookahead(header []byte, hints []interface{}) (bool, int) {
+	ok, needed := s.Check(header, hints)
+	if !ok {
+		return ok, needed
+	}
+
+	total := 4 + (int(header[1])<<16 | int(header[2])<<8 | int(header[3]))
+	if total > SMBMaxLookahead {
+		total = SMBMaxLookahead
+	}
+	if len(header) < total {
+		return false, total
+	}
+	return true, 0
+}
+
+// Handle parses the first message, adds it as a hint and calls the handler.
+func (s *SMB) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, SMBMaxLookahead, s.checkLookahead)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	n, err := ParseSMBNegotiate(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(n))
+	return s.Handler(pc)
+}
+
+// NewSMB returns an SMB with the provided handler.
+func NewSMB(handler func(net.Conn) (net.Conn, error)) *SMB {
+	return &SMB{
+		Handler:     handler,
+		Description: "SMB",
+	}
+}
+
+// NewSMBProxy returns an SMB set up to call DialAndProxy.
+func NewSMBProxy(proto, dest string) *SMB {
+	s := NewSMB(ProxyHandler(proto, dest))
+	s.Description = fmt.Sprintf("SMB [dest: %s]", dest)
+	return s
+}
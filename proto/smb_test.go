@@ -0,0 +1,114 @@
+package proto
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func smbMessage(msg []byte) []byte {
+	return append([]byte{0, 0, byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func smb1Negotiate(dialects ...string) []byte {
+	msg := make([]byte, smb1HeaderLen+3)
+	copy(msg, smb1Magic)
+	msg[4] = SMB1Negotiate
+	for _, d := range dialects {
+		msg = append(msg, 0x02)
+		msg = append(msg, d...)
+		msg = append(msg, 0)
+	}
+	binary.LittleEndian.PutUint16(msg[smb1HeaderLen+1:], uint16(len(msg)-smb1HeaderLen-3))
+	return smbMessage(msg)
+}
+
+func smb2Negotiate(dialects ...uint16) []byte {
+	msg := make([]byte, smb2HeaderLen+36)
+	copy(msg, smb2Magic)
+	binary.LittleEndian.PutUint16(msg[4:], smb2HeaderLen)
+	binary.LittleEndian.PutUint16(msg[smb2HeaderLen:], 36)
+	binary.LittleEndian.PutUint16(msg[smb2HeaderLen+2:], uint16(len(dialects)))
+	for _, d := range dialects {
+		msg = append(msg, byte(d), byte(d>>8))
+	}
+	return smbMessage(msg)
+}
+
+func TestSMB(t *testing.T) {
+	h := NewSMB(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 8},
+		{[]byte("\x00\x00\x00\x6c\xfe"), false, 8},
+		{[]byte("\x00\x00\x00\x6c\xfeSM"), false, 8},
+		{smb2Negotiate(0x0202, 0x0311), true, 0},
+		{smb1Negotiate("NT LM 0.12"), true, 0},
+		{[]byte("\x00\x00\x00\x40\xfeSMB"), true, 0},
+		{[]byte("\x00\x00\x00\x3f\xfeSMB"), false, 0},
+		{[]byte("\x00\x00\x00\x22\xffSMB"), false, 0},
+		{[]byte("\x00\x00\x00\x6c\xfdSMB"), false, 0},
+		{[]byte("\x00\x00\x00\x6c\xffSMX"), false, 0},
+		{[]byte("\x00\x00\x00\x6c\xfeSMX"), false, 0},
+		{[]byte("\x81\x00\x00\x44"), false, 0},
+		{[]byte("\x00\x0e\x38"), false, 8},
+		{[]byte("GET / HTTP/1.1"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestParseSMBNegotiate(t *testing.T) {
+	tests := []struct {
+		payload []byte
+		version int
+		command uint16
+		dialect []string
+	}{
+		{smb2Negotiate(0x0202, 0x0210, 0x0300, 0x0302, 0x0311), 2, SMB2Negotiate, []string{"2.0.2", "2.1", "3.0", "3.0.2", "3.1.1"}},
+		{smb1Negotiate("NT LM 0.12", "SMB 2.002", "SMB 2.???"), 1, SMB1Negotiate, []string{"NT LM 0.12", "SMB 2.002", "SMB 2.???"}},
+		{smb2Negotiate(0x0302)[:smb2DialectsStart], 2, SMB2Negotiate, nil},
+	}
+
+	for _, test := range tests {
+		n, err := ParseSMBNegotiate(test.payload)
+		if err != nil {
+			t.Errorf("parse failed for %q: %v", test.payload, err)
+			continue
+		}
+		if n.Version != test.version || n.Command != test.command || !reflect.DeepEqual(n.Dialects, test.dialect) {
+			t.Errorf("%q parsed as %+v", test.payload, n)
+		}
+	}
+}
+
+func TestSMBDrop(t *testing.T) {
+	h := NewSMB(DropHandler())
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go client.Write(smb2Negotiate(0x0311))
+
+	if _, err := h.Handle(server); err != ErrDropped {
+		t.Errorf("handle returned %v, expected %v", err, ErrDropped)
+	}
+
+	if _, err := client.Write([]byte{0}); err == nil {
+		t.Errorf("connection not closed")
+	}
+}
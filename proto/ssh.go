@@ -0,0 +1,186 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// SSH field constants
+const (
+	// SSHMaxIdentificationLength is the maximum length of the identification
+	// string, including the terminating CR LF, as set by RFC 4253 section 4.2.
+	SSHMaxIdentificationLength = 255
+)
+
+var sshPrefix = []byte("SSH-")
+
+// SSHIdentification is the parsed identification string sent by an SSH client.
+// It is added as a hint to connections handled by SSH.
+type SSHIdentification struct {
+	ProtoVersion    string
+	SoftwareVersion string
+	Comments        string
+}
+
+// ParseSSHIdentification parses an identification string of the form
+// "SSH-protoversion-softwareversion SP comments CR LF". For compatibility with
+// older implementations, the CR is optional.
+func ParseSSHIdentification(line []byte) (*SSHIdentification, error) {
+	end := bytes.IndexByte(line, '\n')
+	if end == -1 {
+		return nil, errors.New("ssh: identification string not terminated")
+	}
+	if end+1 > SSHMaxIdentificationLength {
+		return nil, errors.New("ssh: identification string too long")
+	}
+
+	line = bytes.TrimSuffix(line[:end], []byte("\r"))
+	if !bytes.HasPrefix(line, sshPrefix) {
+		return nil, errors.New("ssh: missing SSH- prefix")
+	}
+
+	for _, b := range line {
+		if b < 0x20 || b > 0x7E {
+			return nil, fmt.Errorf("ssh: invalid character %q in identification string", b)
+		}
+	}
+
+	line = line[len(sshPrefix):]
+	dash := bytes.IndexByte(line, '-')
+	if dash < 1 {
+		return nil, errors.New("ssh: invalid protocol version")
+	}
+
+	id := &SSHIdentification{ProtoVersion: string(line[:dash])}
+	if strings.ContainsRune(id.ProtoVersion, ' ') {
+		return nil, errors.New("ssh: invalid protocol version")
+	}
+
+	software := line[dash+1:]
+	if sp := bytes.IndexByte(software, ' '); sp != -1 {
+		id.Comments = string(software[sp+1:])
+		software = software[:sp]
+	}
+
+	if len(software) == 0 {
+		return nil, errors.New("ssh: missing software version")
+	}
+	id.SoftwareVersion = string(software)
+
+	return id, nil
+}
+
+// SSHMatch is a RouteMatcher for SSH clients with matching identification
+// strings. Empty lists match everything.
+type SSHMatch struct {
+	ProtoVersions    []string
+	SoftwarePrefixes []string
+}
+
+// Matches checks if the route applies to the identification string.
+func (r *SSHMatch) Matches(hint interface{}) bool {
+	id, ok := hint.(*SSHIdentification)
+	if !ok {
+		return false
+	}
+
+	if len(r.ProtoVersions) > 0 && !containsString(r.ProtoVersions, id.ProtoVersion) {
+		return false
+	}
+
+	if len(r.SoftwarePrefixes) > 0 {
+		for _, prefix := range r.SoftwarePrefixes {
+			if strings.HasPrefix(id.SoftwareVersion, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// SSH detects SSH clients by their full identification string, and routes
+// them based on the protocol and software version. The *SSHIdentification is
+// added as a hint to the connection given to the handler.
+//
+// As the identification string may be up to 255 bytes long, SSH declares that
+// as its lookahead.
+type SSH struct {
+	RouteTable
+
+	Description string
+}
+
+func (s *SSH) String() string {
+	return s.Description
+}
+
+// MaxLookahead returns the maximum length of the identification string.
+func (s *SSH) MaxLookahead() int {
+	return SSHMaxIdentificationLength
+}
+
+// Check reads the identification string up to the terminating line feed.
+func (s *SSH) Check(header []byte, _ []interface{}) (bool, int) {
+	if len(header) < len(sshPrefix) {
+		if !bytes.HasPrefix(sshPrefix, header) {
+			return false, 0
+		}
+		return false, len(sshPrefix)
+	}
+
+	if !bytes.HasPrefix(header, sshPrefix) {
+		return false, 0
+	}
+
+	if bytes.IndexByte(header, '\n') == -1 {
+		if len(header) >= SSHMaxIdentificationLength {
+			return false, 0
+		}
+		return false, len(header) + 1
+	}
+
+	_, err := ParseSSHIdentification(header)
+	return err == nil, 0
+}
+
+// Handle parses the identification string and calls the handler of the first
+// matching route.
+func (s *SSH) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, SSHMaxIdentificationLength, s.Check)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	id, err := ParseSSHIdentification(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(id))
+
+	return s.Route(pc, id)
+}
+
+// NewSSH returns an SSH with the provided handler as fallback.
+func NewSSH(handler func(net.Conn) (net.Conn, error)) *SSH {
+	return &SSH{
+		RouteTable:  RouteTable{Handler: handler},
+		Description: "SSH",
+	}
+}
+
+// NewSSHProxy returns an SSH set up to call DialAndProxy if no routes match.
+func NewSSHProxy(proto, dest string) *SSH {
+	s := NewSSH(ProxyHandler(proto, dest))
+	s.Description = fmt.Sprintf("SSH [dest: %s]", dest)
+	return s
+}
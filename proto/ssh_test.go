@@ -0,0 +1,81 @@
+package proto
+
+import (
+	"testing"
+)
+
+func TestSSH(t *testing.T) {
+	h := NewSSH(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 4},
+		{[]byte("S"), false, 4},
+		{[]byte("SSX"), false, 0},
+		{[]byte("SSH-"), false, 5},
+		{[]byte("SSH-2.0-OpenSSH_9.6"), false, 20},
+		{[]byte("SSH-2.0-OpenSSH_9.6\r\n"), true, 0},
+		{[]byte("SSH-2.0-OpenSSH_9.6\n"), true, 0},
+		{[]byte("SSH-1.99-paramiko_3.4.0 comment\r\nKEX"), true, 0},
+		{[]byte("SSH-2.0-\r\n"), false, 0},
+		{[]byte("SSH--OpenSSH\r\n"), false, 0},
+		{[]byte("SSH-2.0-Open\x01SSH\r\n"), false, 0},
+		{[]byte("GET / HTTP/1.1\r\n"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestParseSSHIdentification(t *testing.T) {
+	id, err := ParseSSHIdentification([]byte("SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13\r\n"))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	expected := SSHIdentification{
+		ProtoVersion:    "2.0",
+		SoftwareVersion: "OpenSSH_9.6p1",
+		Comments:        "Ubuntu-3ubuntu13",
+	}
+	if *id != expected {
+		t.Errorf("identification was %+v, expected %+v", *id, expected)
+	}
+
+	long := append([]byte("SSH-2.0-"), make([]byte, 300)...)
+	for i := 8; i < len(long); i++ {
+		long[i] = 'a'
+	}
+	if _, err = ParseSSHIdentification(append(long, '\r', '\n')); err == nil {
+		t.Errorf("parse of overlong identification string did not fail")
+	}
+}
+
+func TestSSHRoutes(t *testing.T) {
+	r := newRouteRecorder(t, (*SSHIdentification)(nil))
+
+	h := NewSSH(r.handler("default"))
+	h.Routes = []Route{
+		{Matcher: &SSHMatch{ProtoVersions: []string{"1.99"}}, Handler: r.handler("legacy")},
+		{Matcher: &SSHMatch{SoftwarePrefixes: []string{"paramiko", "Go"}}, Handler: r.handler("automation")},
+	}
+
+	r.check(h.Handle, []routeTest{
+		{[]byte("SSH-2.0-OpenSSH_9.6\r\n"), "default"},
+		{[]byte("SSH-1.99-OpenSSH_3.0\r\n"), "legacy"},
+		{[]byte("SSH-2.0-paramiko_3.4.0\r\n"), "automation"},
+		{[]byte("SSH-2.0-Go\r\n"), "automation"},
+	})
+}
@@ -0,0 +1,150 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// STOMP field constants
+const (
+	STOMPMaxLookahead = 1024
+)
+
+var stompMatcher = NewSimpleMatcher([][]byte{
+	[]byte("STOMP\n"),
+	[]byte("STOMP\r\n"),
+	[]byte("CONNECT\n"),
+	[]byte("CONNECT\r\n"),
+}, nil)
+
+// STOMPConnect is the parsed CONNECT or STOMP frame sent by a STOMP client. It
+// is added as a hint to connections handled by STOMP. Headers are only
+// available if they were within the first STOMPMaxLookahead bytes of the frame.
+type STOMPConnect struct {
+	Command string
+	Headers map[string]string
+}
+
+// AcceptVersion returns the versions listed in the accept-version header.
+// STOMP 1.0 clients do not send the header.
+func (sc *STOMPConnect) AcceptVersion() []string {
+	v, ok := sc.Headers["accept-version"]
+	if !ok {
+		return []string{"1.0"}
+	}
+	return strings.Split(v, ",")
+}
+
+// Host returns the virtual host requested by the client.
+func (sc *STOMPConnect) Host() string {
+	return sc.Headers["host"]
+}
+
+// ParseSTOMPConnect parses the command and headers of a CONNECT or STOMP
+// frame. Incomplete header lines at the end of the data are ignored.
+func ParseSTOMPConnect(frame []byte) (*STOMPConnect, error) {
+	lines := bytes.Split(frame, []byte("\n"))
+	if len(lines) < 2 {
+		return nil, errors.New("stomp: missing command")
+	}
+
+	sc := &STOMPConnect{
+		Command: string(bytes.TrimSuffix(lines[0], []byte("\r"))),
+		Headers: make(map[string]string),
+	}
+	if sc.Command != "CONNECT" && sc.Command != "STOMP" {
+		return nil, fmt.Errorf("stomp: unexpected command %q", sc.Command)
+	}
+
+	// The last line is either incomplete or follows the end of the headers.
+	for _, line := range lines[1 : len(lines)-1] {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			break
+		}
+
+		colon := bytes.IndexByte(line, ':')
+		if colon == -1 {
+			return nil, fmt.Errorf("stomp: invalid header %q", line)
+		}
+
+		// Only the first occurrence of a header is used.
+		key := string(line[:colon])
+		if _, ok := sc.Headers[key]; !ok {
+			sc.Headers[key] = string(line[colon+1:])
+		}
+	}
+
+	return sc, nil
+}
+
+// STOMP detects STOMP clients by their CONNECT or STOMP frame. The
+// *STOMPConnect is added as a hint to the connection given to the handler.
+type STOMP struct {
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (s *STOMP) String() string {
+	return s.Description
+}
+
+// Check verifies the command line of the first frame. Unlike a HTTP CONNECT
+// request, the STOMP command is immediately followed by the end of the line.
+func (s *STOMP) Check(header []byte, hints []interface{}) (bool, int) {
+	return stompMatcher.Check(header, hints)
+}
+
+// checkHeaders requires the headers of the frame, or STOMPMaxLookahead bytes,
+// whichever comes first.
+func (s *STOMP) checkHeaders(header []byte, hints []interface{}) (bool, int) {
+	ok, needed := s.Check(header, hints)
+	if !ok {
+		return ok, needed
+	}
+
+	if len(header) >= STOMPMaxLookahead ||
+		bytes.Contains(header, []byte("\n\n")) ||
+		bytes.Contains(header, []byte("\n\r\n")) {
+		return true, 0
+	}
+	return false, len(header) + 1
+}
+
+// Handle parses the frame headers, adds them as a hint and calls the handler.
+func (s *STOMP) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, STOMPMaxLookahead, s.checkHeaders)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	sc, err := ParseSTOMPConnect(header)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(sc))
+	return s.Handler(pc)
+}
+
+// NewSTOMP returns a STOMP with the provided handler.
+func NewSTOMP(handler func(net.Conn) (net.Conn, error)) *STOMP {
+	return &STOMP{
+		Handler:     handler,
+		Description: "STOMP",
+	}
+}
+
+// NewSTOMPProxy returns a STOMP set up to call DialAndProxy.
+func NewSTOMPProxy(proto, dest string) *STOMP {
+	s := NewSTOMP(ProxyHandler(proto, dest))
+	s.Description = fmt.Sprintf("STOMP [dest: %s]", dest)
+	return s
+}
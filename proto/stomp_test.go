@@ -0,0 +1,77 @@
+package proto
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+func TestSTOMP(t *testing.T) {
+	h := NewSTOMP(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 6},
+		{[]byte("C"), false, 8},
+		{[]byte("CONNECT"), false, 8},
+		{[]byte("CONNECT\r"), false, 9},
+		{[]byte("CONNECT\n"), true, 0},
+		{[]byte("CONNECT\r\naccept-version:1.2\r\n"), true, 0},
+		{[]byte("STOMP\nhost:/\n\n\x00"), true, 0},
+		{[]byte("CONNECT example.com:443 HTTP/1.1\r\n"), false, 0},
+		{[]byte("SEND\n"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
+
+func TestSTOMPHandle(t *testing.T) {
+	hinted := make(chan *STOMPConnect, 1)
+	h := NewSTOMP(func(c net.Conn) (net.Conn, error) {
+		hints := utils.GetHints(c)
+		sc, _ := hints[len(hints)-1].(*STOMPConnect)
+		hinted <- sc
+		return nil, nil
+	})
+
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.Write([]byte("STOMP\r\naccept-version:1.1,1.2\r\nhost:broker\r\nhost:ignored\r\n\r\n\x00"))
+
+	if _, err := h.Handle(server); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+
+	select {
+	case sc := <-hinted:
+		if sc == nil {
+			t.Fatalf("connect hint missing")
+		}
+		if sc.Command != "STOMP" || sc.Host() != "broker" {
+			t.Errorf("unexpected frame: %+v", sc)
+		}
+		if v := sc.AcceptVersion(); !reflect.DeepEqual(v, []string{"1.1", "1.2"}) {
+			t.Errorf("accept-version was %v", v)
+		}
+	case <-time.After(300 * time.Millisecond):
+		t.Errorf("timed out waiting for handler")
+	}
+}
@@ -0,0 +1,87 @@
+package proto
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// Telnet field constants
+const (
+	TelnetIAC  = 0xFF
+	TelnetSB   = 0xFA
+	TelnetWILL = 0xFB
+	TelnetWONT = 0xFC
+	TelnetDO   = 0xFD
+	TelnetDONT = 0xFE
+)
+
+// TelnetNegotiation is the first option negotiation sent by a Telnet client.
+// It is added as a hint to connections handled by Telnet.
+type TelnetNegotiation struct {
+	// Command is one of TelnetSB, TelnetWILL, TelnetWONT, TelnetDO or
+	// TelnetDONT.
+	Command byte
+	Option  byte
+}
+
+// Telnet detects Telnet clients by the IAC option negotiation they start
+// with. The *TelnetNegotiation is added as a hint to the connection given to
+// the handler.
+//
+// Clients that do not negotiate options, such as most clients connecting to
+// ports other than 23, cannot be told apart from other plain text protocols.
+type Telnet struct {
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (t *Telnet) String() string {
+	return t.Description
+}
+
+// Check verifies the IAC, a negotiation command and the option code.
+func (t *Telnet) Check(header []byte, _ []interface{}) (bool, int) {
+	if len(header) >= 1 && header[0] != TelnetIAC {
+		return false, 0
+	}
+	if len(header) >= 2 && (header[1] < TelnetSB || header[1] == TelnetIAC) {
+		return false, 0
+	}
+	if len(header) < 3 {
+		return false, 3
+	}
+	return true, 0
+}
+
+// Handle adds the negotiation as a hint and calls the handler.
+func (t *Telnet) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, 3, t.Check)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(&TelnetNegotiation{
+		Command: header[1],
+		Option:  header[2],
+	}))
+
+	return t.Handler(pc)
+}
+
+// NewTelnet returns a Telnet with the provided handler.
+func NewTelnet(handler func(net.Conn) (net.Conn, error)) *Telnet {
+	return &Telnet{
+		Handler:     handler,
+		Description: "Telnet",
+	}
+}
+
+// NewTelnetProxy returns a Telnet set up to call DialAndProxy.
+func NewTelnetProxy(proto, dest string) *Telnet {
+	t := NewTelnet(ProxyHandler(proto, dest))
+	t.Description = fmt.Sprintf("Telnet [dest: %s]", dest)
+	return t
+}
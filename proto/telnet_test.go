@@ -0,0 +1,37 @@
+package proto
+
+import (
+	"testing"
+)
+
+func TestTelnet(t *testing.T) {
+	h := NewTelnet(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 3},
+		{[]byte("\xFF"), false, 3},
+		{[]byte("\xFF\xFD"), false, 3},
+		{[]byte("\xFF\xFD\x18"), true, 0},
+		{[]byte("\xFF\xFB\x1F\xFF\xFB\x20"), true, 0},
+		{[]byte("\xFF\xFA\x18"), true, 0},
+		{[]byte("\xFF\xF1\x00"), false, 0},
+		{[]byte("\xFF\xFF\x00"), false, 0},
+		{[]byte("GET / HTTP/1.1"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
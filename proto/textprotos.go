@@ -0,0 +1,187 @@
+package proto
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	// IRCCommands are the commands an IRC client registers with.
+	IRCCommands = []string{"CAP", "PASS", "NICK", "USER"}
+
+	// MemcachedCommands are the memcached text protocol commands.
+	MemcachedCommands = []string{
+		"get", "gets", "gat", "gats",
+		"set", "add", "replace", "append", "prepend", "cas",
+		"delete", "incr", "decr", "touch",
+		"stats", "version", "verbosity", "flush_all", "quit",
+		"mg", "ms", "md", "ma", "mn", "me",
+	}
+
+	// RTSPMethods are the RTSP request methods.
+	RTSPMethods = []string{
+		"OPTIONS", "DESCRIBE", "ANNOUNCE", "SETUP", "PLAY", "PAUSE",
+		"TEARDOWN", "GET_PARAMETER", "SET_PARAMETER", "REDIRECT", "RECORD",
+	}
+
+	// SIPMethods are the SIP request methods.
+	SIPMethods = []string{
+		"INVITE", "ACK", "BYE", "CANCEL", "REGISTER", "OPTIONS", "PRACK",
+		"SUBSCRIBE", "NOTIFY", "PUBLISH", "INFO", "REFER", "MESSAGE", "UPDATE",
+	}
+)
+
+// Line length limits of the text protocols.
+const (
+	IRCMaxLength       = 512
+	MemcachedMaxLength = 2048
+	RTSPMaxLength      = 4096
+	SIPMaxLength       = 4096
+	memcachedMaxKey    = 250
+)
+
+func isUint(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
+
+func isInt(s string) bool {
+	_, err := strconv.ParseInt(s, 10, 64)
+	return err == nil
+}
+
+func validIRC(tl *TextLine) bool {
+	switch strings.ToUpper(tl.Command) {
+	case "CAP":
+		// CAP LS [version], CAP REQ :caps or CAP END
+		return len(tl.Args) >= 1 && containsFold([]string{"LS", "REQ", "END"}, tl.Args[0])
+	case "PASS", "NICK":
+		return len(tl.Args) >= 1 && tl.Args[0] != ""
+	case "USER":
+		// USER <username> <mode> <unused> :<realname>
+		return len(tl.Args) >= 4 && tl.Args[0] != "" && strings.HasPrefix(tl.Args[3], ":")
+	}
+	return false
+}
+
+func validMemcachedKeys(keys []string) bool {
+	if len(keys) == 0 {
+		return false
+	}
+	for _, k := range keys {
+		if k == "" || len(k) > memcachedMaxKey {
+			return false
+		}
+	}
+	return true
+}
+
+func validMemcached(tl *TextLine) bool {
+	args := tl.Args
+	noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+
+	switch tl.Command {
+	case "get", "gets":
+		return validMemcachedKeys(args)
+	case "gat", "gats":
+		return len(args) >= 2 && isInt(args[0]) && validMemcachedKeys(args[1:])
+	case "set", "add", "replace", "append", "prepend":
+		// <key> <flags> <exptime> <bytes> [noreply]
+		if noreply {
+			args = args[:len(args)-1]
+		}
+		return len(args) == 4 && validMemcachedKeys(args[:1]) &&
+			isUint(args[1]) && isInt(args[2]) && isUint(args[3])
+	case "cas":
+		// <key> <flags> <exptime> <bytes> <cas unique> [noreply]
+		if noreply {
+			args = args[:len(args)-1]
+		}
+		return len(args) == 5 && validMemcachedKeys(args[:1]) &&
+			isUint(args[1]) && isInt(args[2]) && isUint(args[3]) && isUint(args[4])
+	case "delete":
+		return (len(args) == 1 || len(args) == 2 && noreply) && validMemcachedKeys(args[:1])
+	case "incr", "decr":
+		return (len(args) == 2 || len(args) == 3 && noreply) && validMemcachedKeys(args[:1]) && isUint(args[1])
+	case "touch":
+		return (len(args) == 2 || len(args) == 3 && noreply) && validMemcachedKeys(args[:1]) && isInt(args[1])
+	case "stats":
+		return true
+	case "version", "quit":
+		return len(args) == 0
+	case "verbosity":
+		return len(args) >= 1 && len(args) <= 2 && isUint(args[0])
+	case "flush_all":
+		return len(args) == 0 || noreply || len(args) <= 2 && isInt(args[0])
+	case "mg", "ms", "md", "ma":
+		return len(args) >= 1 && validMemcachedKeys(args[:1])
+	case "mn", "me":
+		return true
+	}
+	return false
+}
+
+// validRequestLine checks for "METHOD SP URI SP VERSION", with the version
+// being one of versions and the URI having one of the prefixes.
+func validRequestLine(tl *TextLine, versions, prefixes []string) bool {
+	if len(tl.Args) != 2 || !containsString(versions, tl.Args[1]) {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(strings.ToLower(tl.Args[0]), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func validRTSP(tl *TextLine) bool {
+	if tl.Command == "OPTIONS" && len(tl.Args) == 2 && tl.Args[0] == "*" {
+		return containsString(RTSPVersions, tl.Args[1])
+	}
+	return validRequestLine(tl, RTSPVersions, []string{"rtsp://", "rtsps://", "rtspu://"})
+}
+
+func validSIP(tl *TextLine) bool {
+	return validRequestLine(tl, SIPVersions, []string{"sip:", "sips:", "tel:"})
+}
+
+// NewIRC returns a Line detecting IRC clients by their registration commands,
+// being CAP LS, PASS, NICK or USER.
+func NewIRC(handler func(net.Conn) (net.Conn, error)) *Line {
+	l := NewLine("IRC", IRCCommands, validIRC, handler)
+	l.FoldCase = true
+	l.MaxLength = IRCMaxLength
+	return l
+}
+
+// NewMemcached returns a Line detecting memcached text protocol clients by
+// the arguments of their first command.
+func NewMemcached(handler func(net.Conn) (net.Conn, error)) *Line {
+	l := NewLine("memcached", MemcachedCommands, validMemcached, handler)
+	l.MaxLength = MemcachedMaxLength
+	return l
+}
+
+// NewRTSP returns a Line detecting RTSP clients by their request line, such as
+// "OPTIONS rtsp://example.com/stream RTSP/1.0". As RTSP and HTTP share
+// methods, an HTTP Protocol matching the method may match before the complete
+// line has arrived. Add it with AddHandlerPriority, with a higher priority
+// than HTTP, or use a RequestLineMatcher to route both by version.
+func NewRTSP(handler func(net.Conn) (net.Conn, error)) *Line {
+	l := NewLine("RTSP", RTSPMethods, validRTSP, handler)
+	l.MaxLength = RTSPMaxLength
+	return l
+}
+
+// NewSIP returns a Line detecting SIP over TCP clients by their request line,
+// such as "INVITE sip:bob@example.com SIP/2.0". As SIP and HTTP share
+// methods, an HTTP Protocol matching the method may match before the complete
+// line has arrived. Add it with AddHandlerPriority, with a higher priority
+// than HTTP, or use a RequestLineMatcher to route both by version.
+func NewSIP(handler func(net.Conn) (net.Conn, error)) *Line {
+	l := NewLine("SIP", SIPMethods, validSIP, handler)
+	l.MaxLength = SIPMaxLength
+	return l
+}
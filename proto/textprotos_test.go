@@ -0,0 +1,72 @@
+package proto
+
+import (
+	"testing"
+)
+
+func TestTextProtocols(t *testing.T) {
+	irc := NewIRC(nil)
+	memcached := NewMemcached(nil)
+	rtsp := NewRTSP(nil)
+	sip := NewSIP(nil)
+
+	tests := []struct {
+		proto    *Line
+		payload  string
+		match    bool
+		required int
+	}{
+		{irc, "NICK alice\r\n", true, 0},
+		{irc, "nick alice\r\n", true, 0},
+		{irc, "CAP LS 302\r\n", true, 0},
+		{irc, "PASS secret\r\n", true, 0},
+		{irc, "USER alice 0 * :Alice\r\n", true, 0},
+		{irc, "USER alice 0 *\r\n", false, 0},
+		{irc, "NICK\r\n", false, 0},
+		{irc, "CAP FOO\r\n", false, 0},
+		{irc, "NICK ali", false, 9},
+		{irc, "JOIN #x\r\n", false, 0},
+
+		{memcached, "get foo\r\n", true, 0},
+		{memcached, "get foo bar baz\r\n", true, 0},
+		{memcached, "set foo 0 3600 5\r\n", true, 0},
+		{memcached, "set foo 0 3600 5 noreply\r\n", true, 0},
+		{memcached, "cas foo 0 0 5 12\r\n", true, 0},
+		{memcached, "incr counter 1\r\n", true, 0},
+		{memcached, "version\r\n", true, 0},
+		{memcached, "stats slabs\r\n", true, 0},
+		{memcached, "mg foo v\r\n", true, 0},
+		{memcached, "get\r\n", false, 0},
+		{memcached, "set foo 0 3600\r\n", false, 0},
+		{memcached, "set foo x 3600 5\r\n", false, 0},
+		{memcached, "GET foo\r\n", false, 0},
+		{memcached, "gex", false, 0},
+
+		{rtsp, "OPTIONS rtsp://example.com/stream RTSP/1.0\r\n", true, 0},
+		{rtsp, "OPTIONS * RTSP/1.0\r\n", true, 0},
+		{rtsp, "DESCRIBE rtsps://example.com/stream RTSP/2.0\r\n", true, 0},
+		{rtsp, "OPTIONS * HTTP/1.1\r\n", false, 0},
+		{rtsp, "OPTIONS rtsp://example.com/stream HTTP/1.1\r\n", false, 0},
+		{rtsp, "GET / HTTP/1.1\r\n", false, 0},
+		{rtsp, "OPTIONS rtsp://", false, 16},
+
+		{sip, "INVITE sip:bob@example.com SIP/2.0\r\n", true, 0},
+		{sip, "REGISTER sips:example.com SIP/2.0\r\n", true, 0},
+		{sip, "OPTIONS sip:example.com SIP/2.0\r\n", true, 0},
+		{sip, "OPTIONS * SIP/2.0\r\n", false, 0},
+		{sip, "OPTIONS sip:example.com RTSP/1.0\r\n", false, 0},
+		{sip, "INVITE http://example.com SIP/2.0\r\n", false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := test.proto.Check([]byte(test.payload), nil)
+		if test.match != match {
+			t.Errorf("%s: match not correct for %q: was %t, expected %t",
+				test.proto, test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("%s: required not correct for %q: was %d, expected %d",
+				test.proto, test.payload, required, test.required)
+		}
+	}
+}
@@ -44,8 +44,7 @@ func (t *TLS) Setup(protos []string, cert, key string) error {
 // the connection as a hint.
 func (t *TLS) Handle(c net.Conn) (net.Conn, error) {
 	s := tls.Server(c, t.config)
-	hints := append(utils.GetHints(c), s)
-	return utils.NewHintConn(s, hints), nil
+	return utils.NewHintConn(s, utils.HintsOf(c).Add(s)), nil
 }
 
 // Check checks if the protocol is TLS
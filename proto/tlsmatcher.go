@@ -1,9 +1,10 @@
 package proto
 
 import (
-	"crypto/tls"
 	"crypto/x509"
 	"net"
+
+	"github.com/kennylevinsen/serve2/utils"
 )
 
 // TLSMatcherChecks is a bitmask describing what to verify.
@@ -39,29 +40,18 @@ type TLSMatcher struct {
 	Description                string
 }
 
-type connectionStater interface {
-	ConnectionState() tls.ConnectionState
-}
-
 func (tc *TLSMatcher) String() string {
 	return tc.Description
 }
 
-// Check inspects the last transport hint, checking if it is a TLS transport.
+// Check inspects the nearest TLS transport hint, ignoring hints added after
+// it by other transports or protocols.
 func (tc *TLSMatcher) Check(_ []byte, hints []interface{}) (bool, int) {
-	if len(hints) == 0 {
-		return false, 0
-	}
-
-	h := hints[len(hints)-1]
-
-	c, ok := h.(connectionStater)
+	cs, ok := utils.Hints(hints).ConnectionState()
 	if !ok {
 		return false, 0
 	}
 
-	cs := c.ConnectionState()
-
 	if tc.Checks.IsSet(TLSCheckServerName) {
 		for _, sn := range tc.ServerNames {
 			if sn == cs.ServerName {
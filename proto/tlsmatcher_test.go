@@ -86,3 +86,28 @@ func TestTLSMatcher(t *testing.T) {
 		}
 	}
 }
+
+func TestTLSMatcherStacked(t *testing.T) {
+	tlsCheck := &TLSMatcher{
+		ServerNames: []string{"inner"},
+		Checks:      TLSCheckServerName,
+	}
+
+	tests := []struct {
+		match bool
+		hints []interface{}
+	}{
+		{false, nil},
+		{false, []interface{}{"websocket"}},
+		{true, []interface{}{ConnectionStater{tls.ConnectionState{ServerName: "inner"}}, "websocket"}},
+		{true, []interface{}{ConnectionStater{tls.ConnectionState{ServerName: "outer"}}, ConnectionStater{tls.ConnectionState{ServerName: "inner"}}}},
+		{false, []interface{}{ConnectionStater{tls.ConnectionState{ServerName: "inner"}}, ConnectionStater{tls.ConnectionState{ServerName: "outer"}}, "websocket"}},
+	}
+
+	for i, test := range tests {
+		match, _ := tlsCheck.Check(nil, test.hints)
+		if match != test.match {
+			t.Errorf("test %d: expected match %v, got %v", i, test.match, match)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package proto
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// VNC field constants
+const (
+	// VNCDefaultVersion is the RFB ProtocolVersion offered to clients.
+	VNCDefaultVersion = "RFB 003.008\n"
+)
+
+// VNCVersion is an RFB protocol version.
+type VNCVersion struct {
+	Major int
+	Minor int
+}
+
+// parseRFBVersion parses an RFB ProtocolVersion message.
+func parseRFBVersion(b []byte) (*VNCVersion, error) {
+	var v VNCVersion
+	if len(b) != 12 || !strings.HasPrefix(string(b), "RFB ") || b[7] != '.' || b[11] != '\n' {
+		return nil, fmt.Errorf("vnc: invalid protocol version %q", b)
+	}
+	if _, err := fmt.Sscanf(string(b[4:11]), "%03d.%03d", &v.Major, &v.Minor); err != nil {
+		return nil, fmt.Errorf("vnc: invalid protocol version %q", b)
+	}
+	return &v, nil
+}
+
+// VNC handles VNC clients. As the RFB protocol is server-speaks-first, there is
+// nothing to detect, and VNC only works as the IdleProtocol of the server. VNC sends the ProtocolVersion greeting itself, and once the client
+// has replied with the version it wants, dials the VNC server, relays the
+// selected version and proxies the connection.
+//
+// The VNC server must support the version selected by the client.
+type VNC struct {
+	// Version is the ProtocolVersion greeting sent to the client.
+	Version string
+
+	Proto       string
+	Dest        string
+	Description string
+}
+
+func (v *VNC) String() string {
+	return v.Description
+}
+
+// Check never matches, as VNC clients send nothing to detect. The Server gives
+// them to its IdleProtocol instead.
+func (v *VNC) Check(header []byte, _ []interface{}) (bool, int) {
+	return false, 0
+}
+
+// Handle performs the version handshake with the client and the server, and
+// proxies the connection.
+func (v *VNC) Handle(c net.Conn) (net.Conn, error) {
+	if _, err := io.WriteString(c, v.Version); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(c, version); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if _, err := parseRFBVersion(version); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	server, err := net.Dial(v.Proto, v.Dest)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// The client has already been greeted, so the greeting of the server is
+	// discarded.
+	greeting := make([]byte, 12)
+	if _, err = io.ReadFull(server, greeting); err == nil {
+		_, err = parseRFBVersion(greeting)
+	}
+	if err == nil {
+		_, err = server.Write(version)
+	}
+	if err != nil {
+		c.Close()
+		server.Close()
+		return nil, err
+	}
+
+	utils.Proxy(c, server)
+	return nil, nil
+}
+
+// NewVNCProxy returns a VNC set up to proxy to the provided VNC server.
+func NewVNCProxy(proto, dest string) *VNC {
+	return &VNC{
+		Version:     VNCDefaultVersion,
+		Proto:       proto,
+		Dest:        dest,
+		Description: fmt.Sprintf("VNC [dest: %s]", dest),
+	}
+}
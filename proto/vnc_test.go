@@ -0,0 +1,70 @@
+package proto
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestVNC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer l.Close()
+
+	selected := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		io.WriteString(c, "RFB 003.008\n")
+		version := make([]byte, 12)
+		io.ReadFull(c, version)
+		selected <- string(version)
+		io.WriteString(c, "\x01\x01")
+	}()
+
+	h := NewVNCProxy("tcp", l.Addr().String())
+
+	if match, required := h.Check(nil, nil); match || required != 0 {
+		t.Errorf("VNC matched silent connection")
+	}
+	if match, _ := h.Check([]byte("GET"), nil); match {
+		t.Errorf("VNC matched when it shouldn't")
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		if _, err := h.Handle(server); err != nil {
+			t.Errorf("handle failed: %v", err)
+		}
+	}()
+
+	greeting := make([]byte, 12)
+	if _, err = io.ReadFull(client, greeting); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(greeting) != VNCDefaultVersion {
+		t.Errorf("greeting was %q, expected %q", greeting, VNCDefaultVersion)
+	}
+
+	io.WriteString(client, "RFB 003.007\n")
+	if v := <-selected; v != "RFB 003.007\n" {
+		t.Errorf("server received version %q", v)
+	}
+
+	// Security types from the server are proxied to the client
+	security := make([]byte, 2)
+	if _, err = io.ReadFull(client, security); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(security) != "\x01\x01" {
+		t.Errorf("security types were %q", security)
+	}
+}
@@ -0,0 +1,95 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+// WireGuard field constants
+const (
+	WireGuardInitiationLength = 148
+	wireGuardSenderEnd        = 2 + 4 + 4
+)
+
+var wireGuardPrefix = []byte{0x00, WireGuardInitiationLength, 0x01, 0x00, 0x00, 0x00}
+
+// WireGuardInitiation describes the handshake initiation a WireGuard peer
+// starts with. It is added as a hint to connections handled by WireGuard.
+type WireGuardInitiation struct {
+	// SenderIndex is the index chosen by the initiator.
+	SenderIndex uint32
+}
+
+// WireGuard detects WireGuard tunneled over TCP by wrappers framing each UDP
+// datagram with a 2-byte big endian length, such as udp-over-tcp. The first
+// datagram must be a handshake initiation. The *WireGuardInitiation is added as
+// a hint to the connection given to the handler, which must speak the same
+// framing, as serve2 does not unwrap the datagrams.
+type WireGuard struct {
+	Handler     func(net.Conn) (net.Conn, error)
+	Description string
+}
+
+func (w *WireGuard) String() string {
+	return w.Description
+}
+
+// Check verifies the length of the datagram, and the message type and
+// reserved bytes of the handshake initiation.
+func (w *WireGuard) Check(header []byte, _ []interface{}) (bool, int) {
+	if len(header) < len(wireGuardPrefix) {
+		if !bytes.HasPrefix(wireGuardPrefix, header) {
+			return false, 0
+		}
+		return false, len(wireGuardPrefix)
+	}
+
+	return bytes.HasPrefix(header, wireGuardPrefix), 0
+}
+
+// checkSender requires the sender index.
+func (w *WireGuard) checkSender(header []byte, hints []interface{}) (bool, int) {
+	ok, needed := w.Check(header, hints)
+	if !ok {
+		return ok, needed
+	}
+	if len(header) < wireGuardSenderEnd {
+		return false, wireGuardSenderEnd
+	}
+	return true, 0
+}
+
+// Handle adds the initiation as a hint and calls the handler.
+func (w *WireGuard) Handle(c net.Conn) (net.Conn, error) {
+	header, pc, err := peek(c, wireGuardSenderEnd, w.checkSender)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	pc.SetHints(utils.HintsOf(pc).Add(&WireGuardInitiation{
+		SenderIndex: binary.LittleEndian.Uint32(header[6:10]),
+	}))
+
+	return w.Handler(pc)
+}
+
+// NewWireGuard returns a WireGuard with the provided handler.
+func NewWireGuard(handler func(net.Conn) (net.Conn, error)) *WireGuard {
+	return &WireGuard{
+		Handler:     handler,
+		Description: "WireGuard",
+	}
+}
+
+// NewWireGuardProxy returns a WireGuard set up to call DialAndProxy. The
+// destination must be the TCP side of a wrapper, not the WireGuard server.
+func NewWireGuardProxy(proto, dest string) *WireGuard {
+	w := NewWireGuard(ProxyHandler(proto, dest))
+	w.Description = fmt.Sprintf("WireGuard [dest: %s]", dest)
+	return w
+}
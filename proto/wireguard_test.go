@@ -0,0 +1,36 @@
+package proto
+
+import (
+	"testing"
+)
+
+func TestWireGuard(t *testing.T) {
+	h := NewWireGuard(nil)
+
+	tests := []struct {
+		payload  []byte
+		match    bool
+		required int
+	}{
+		{nil, false, 6},
+		{[]byte("\x00\x94"), false, 6},
+		{[]byte("\x00\x94\x01\x00\x00\x00"), true, 0},
+		{[]byte("\x00\x94\x01\x00\x00\x00\x3a\x9c\x41\x07"), true, 0},
+		{[]byte("\x00\x5c\x02\x00\x00\x00"), false, 0},
+		{[]byte("\x00\x94\x01\x00\x01\x00"), false, 0},
+		{[]byte("\x01\x94"), false, 0},
+		{[]byte("\x00\x0e\x38"), false, 0},
+	}
+
+	for _, test := range tests {
+		match, required := h.Check(test.payload, nil)
+		if test.match != match {
+			t.Errorf("match not correct for %q: was %t, expected %t",
+				test.payload, match, test.match)
+		}
+		if test.required != required {
+			t.Errorf("required not correct for %q: was %d, expected %d",
+				test.payload, required, test.required)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package serve2
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Status is the outcome of a detection.
+type Status int
+
+// Detection outcomes.
+const (
+	// NeedMore means that more data is needed to decide.
+	NeedMore Status = iota
+
+	// Match means that the header matches the protocol.
+	Match
+
+	// NoMatch means that the header does not match the protocol, and that no
+	// further calls should be made.
+	NoMatch
+)
+
+func (s Status) String() string {
+	switch s {
+	case NeedMore:
+		return "NeedMore"
+	case Match:
+		return "Match"
+	case NoMatch:
+		return "NoMatch"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// Confidence levels for matches.
+const (
+	// ConfidenceCertain matches are used without waiting for other
+	// candidates of the same or lower priority to decide. Protocols adapted
+	// by AdaptProtocol match with this confidence, keeping their
+	// first-match-wins behaviour.
+	ConfidenceCertain = 100
+
+	// ConfidenceLikely is a suggested confidence for heuristic matches that
+	// should yield to more specific protocols.
+	ConfidenceLikely = 50
+)
+
+// Result is the result of a detection.
+type Result struct {
+	Status Status
+
+	// Needed is the amount of bytes wanted for NeedMore.
+	Needed int
+
+	// Confidence ranks matches, from 0 to ConfidenceCertain. Matches below
+	// ConfidenceCertain wait for other candidates to decide, with the highest
+	// confidence winning.
+	Confidence int
+
+	// Length is the amount of header bytes the match is based on, used to
+	// prefer the longest of otherwise equal matches. If zero, the amount of
+	// header bytes available when matching is used.
+	Length int
+
+	// Metadata, if not nil, is added as a hint to the connection given to
+	// Handle, such as a parsed header.
+	Metadata interface{}
+}
+
+// Matched returns a Match Result with the provided confidence and metadata.
+func Matched(confidence int, metadata interface{}) Result {
+	return Result{Status: Match, Confidence: confidence, Metadata: metadata}
+}
+
+// NeedBytes returns a NeedMore Result for the provided amount of bytes.
+func NeedBytes(needed int) Result {
+	return Result{Status: NeedMore, Needed: needed}
+}
+
+// NotMatched returns a NoMatch Result.
+func NotMatched() Result {
+	return Result{Status: NoMatch}
+}
+
+// ProtocolV2 is the detection and handling interface used by the Server. Its
+// Detect method follows the rules of Protocol.Check, but returns a Result,
+// allowing for ambiguous matches to be resolved by confidence rather than
+// registration order. HandleContext receives a context carrying deadlines and
+// cancellation from the Server.
+type ProtocolV2 interface {
+	// Detect informs if the bytes match the protocol. Called with nil, nil,
+	// it must return NeedMore with the smallest amount of bytes that makes
+	// sense to call Detect with.
+	Detect(header []byte, hints []interface{}) Result
+
+	// HandleContext manages the protocol. Like Protocol.Handle, it can return
+	// a net.Conn to be run through protocol detection again.
+	HandleContext(ctx context.Context, c net.Conn) (net.Conn, error)
+}
+
+// protocolAdapter implements ProtocolV2 for a Protocol.
+type protocolAdapter struct {
+	Protocol
+}
+
+func (a protocolAdapter) String() string {
+	return fmt.Sprint(a.Protocol)
+}
+
+// Detect translates the result of Check, with matches being certain.
+func (a protocolAdapter) Detect(header []byte, hints []interface{}) Result {
+	ok, needed := a.Check(header, hints)
+	switch {
+	case ok:
+		return Matched(ConfidenceCertain, nil)
+	case needed == 0:
+		return NotMatched()
+	default:
+		return NeedBytes(needed)
+	}
+}
+
+// HandleContext calls Handle, ignoring the context.
+func (a protocolAdapter) HandleContext(_ context.Context, c net.Conn) (net.Conn, error) {
+	return a.Handle(c)
+}
+
+// AdaptProtocol returns a ProtocolV2 for the Protocol. If the Protocol also
+// implements ProtocolV2, it is returned as is.
+func AdaptProtocol(p Protocol) ProtocolV2 {
+	switch p := p.(type) {
+	case v2Protocol:
+		return p.ProtocolV2
+	case ProtocolV2:
+		return p
+	}
+	return protocolAdapter{p}
+}
+
+// v2Protocol implements Protocol for a ProtocolV2, allowing it to be stored
+// in Server.Protocols.
+type v2Protocol struct {
+	ProtocolV2
+}
+
+func (p v2Protocol) String() string {
+	return fmt.Sprint(p.ProtocolV2)
+}
+
+// Check translates the result of Detect, with any match being accepted.
+func (p v2Protocol) Check(header []byte, hints []interface{}) (bool, int) {
+	r := p.Detect(header, hints)
+	switch r.Status {
+	case Match:
+		return true, 0
+	case NeedMore:
+		return false, r.Needed
+	default:
+		return false, 0
+	}
+}
+
+// Handle calls HandleContext with a background context.
+func (p v2Protocol) Handle(c net.Conn) (net.Conn, error) {
+	return p.HandleContext(context.Background(), c)
+}
@@ -1,8 +1,11 @@
 package serve2
 
 import (
+	"context"
 	"errors"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/kennylevinsen/serve2/utils"
 )
@@ -10,11 +13,36 @@ import (
 const (
 	// DefaultBytesToCheck default maximum amount of bytes to check
 	DefaultBytesToCheck = 128
+
+	// DefaultMaxBytesToCheck default maximum amount of bytes to check for
+	// protocols declaring a larger Lookahead
+	DefaultMaxBytesToCheck = 16 * 1024
+
+	// DefaultDecisionTimeout default time to wait for more data when a match
+	// below ConfidenceCertain is pending
+	DefaultDecisionTimeout = 100 * time.Millisecond
+)
+
+// ReadPolicy decides how much is read from a connection while detecting its
+// protocol.
+type ReadPolicy int
+
+// Read policies.
+const (
+	// ReadAvailable reads as much as is available, up to the size of the
+	// header buffer.
+	ReadAvailable ReadPolicy = iota
+
+	// ReadExact reads no more than the smallest amount of bytes requested by
+	// the remaining protocols, leaving the rest of the data unread until more
+	// is needed.
+	ReadExact
 )
 
 // Errors
 var (
-	ErrGreedyHandler = errors.New("remaining handlers too greedy")
+	ErrGreedyHandler     = errors.New("remaining handlers too greedy")
+	ErrLookaheadExceeded = errors.New("remaining handlers exceeded their lookahead")
 )
 
 // Protocol is the protocol detection and handling interface used by serve2.
@@ -50,16 +78,86 @@ type Server struct {
 	// Logger is used for logging if set
 	Logger Logger
 
-	// BytesToCheck is the max amount of bytes to check
+	// BytesToCheck is the max amount of bytes to check for protocols not
+	// implementing Lookahead, and the initial size of the header buffer
 	BytesToCheck int
 
-	// Protocols is the list of protocols
+	// MaxBytesToCheck is the max amount of bytes to check for any protocol,
+	// limiting the Lookahead of protocols. If zero, BytesToCheck is used.
+	MaxBytesToCheck int
+
+	// IdleProtocol, if set, handles connections where the client has not sent
+	// anything within IdleTimeout. This allows for protocols where the server
+	// speaks first. It only applies to accepted connections, not to the
+	// transports returned by protocols.
+	IdleProtocol Protocol
+
+	// IdleTimeout is how long to wait for the first data before using
+	// IdleProtocol.
+	IdleTimeout time.Duration
+
+	// DecisionTimeout is how long to wait for more data when a match below
+	// ConfidenceCertain is pending, but other candidates need more data. If
+	// zero, the wait is only bounded by the lookahead of the candidates.
+	DecisionTimeout time.Duration
+
+	// ReadPolicy decides how much is read at a time. Regardless of the
+	// policy, protocols are only called once the smallest amount of bytes
+	// requested by them has been read.
+	ReadPolicy ReadPolicy
+
+	// Profile, if set, is called with the DetectionStats of each connection
+	// once detection is done.
+	Profile func(c net.Conn, stats DetectionStats)
+
+	// Protocols is the list of protocols. Protocols added through
+	// AddProtocol are stored wrapped, implementing Protocol.
 	Protocols []Protocol
+
+	// priorities holds the priorities of Protocols, with missing entries
+	// being 0.
+	priorities []int
+
+	// dispatch holds the prefix tree of the static protocols, built when the
+	// first connection is handled after Protocols changed.
+	dispatch   *dispatch
+	dispatchMu sync.Mutex
 }
 
 // AddHandler registers a Protocol
 func (s *Server) AddHandler(p Protocol) {
+	s.addPriority(p, 0)
+}
+
+// AddHandlerPriority registers a Protocol with a priority
+func (s *Server) AddHandlerPriority(p Protocol, priority int) {
+	s.addPriority(p, priority)
+}
+
+// AddProtocol registers a ProtocolV2
+func (s *Server) AddProtocol(p ProtocolV2) {
+	s.AddProtocolPriority(p, 0)
+}
+
+// addPriority registers a Protocol with a priority.
+func (s *Server) addPriority(p Protocol, priority int) {
+	for len(s.priorities) < len(s.Protocols) {
+		s.priorities = append(s.priorities, 0)
+	}
 	s.Protocols = append(s.Protocols, p)
+	s.priorities = append(s.priorities, priority)
+}
+
+// AddProtocolPriority registers a ProtocolV2 with a priority. Matches from
+// protocols with a higher priority are preferred regardless of confidence,
+// and protocols with a lower priority cannot prevent a match from being
+// used. Protocols added without a priority have priority 0.
+func (s *Server) AddProtocolPriority(p ProtocolV2, priority int) {
+	if legacy, ok := p.(Protocol); ok {
+		s.addPriority(legacy, priority)
+		return
+	}
+	s.addPriority(v2Protocol{p}, priority)
 }
 
 // AddHandlers registers a set of Protocols
@@ -70,12 +168,16 @@ func (s *Server) AddHandlers(p ...Protocol) {
 }
 
 // handle wraps the net.Conn in a ProxyConn, and if the protocol returns a
-// transport, runs it through HandleConn again as appropriate.
-func (s *Server) handle(h Protocol, c net.Conn, hints []interface{}, header []byte, readErr error) {
+// transport, runs it through HandleConn again as appropriate. Metadata from
+// the detection is added to the hints if set.
+func (s *Server) handle(ctx context.Context, h ProtocolV2, c net.Conn, hints []interface{}, header []byte, readErr error, metadata interface{}) {
 	proxy := utils.NewProxyConn(c, header, readErr)
+	if metadata != nil {
+		hints = utils.Hints(hints).Add(metadata)
+	}
 	proxy.SetHints(hints)
 
-	transport, err := h.Handle(proxy)
+	transport, err := h.HandleContext(ctx, proxy)
 	if err != nil {
 		if s.Logger != nil {
 			s.Logger("Handling %v as %v failed: %v", c.RemoteAddr(), h, err)
@@ -91,7 +193,7 @@ func (s *Server) handle(h Protocol, c net.Conn, hints []interface{}, header []by
 		if x, ok := transport.(utils.HintedConn); ok {
 			hints = x.Hints()
 		}
-		s.HandleConn(transport, hints)
+		s.handleConn(ctx, transport, hints, false)
 	} else {
 		if s.Logger != nil {
 			s.Logger("Handling %v as %v", c.RemoteAddr(), h)
@@ -102,25 +204,150 @@ func (s *Server) handle(h Protocol, c net.Conn, hints []interface{}, header []by
 // HandleConn runs a connection through protocol detection and handling as
 // needed.
 func (s *Server) HandleConn(c net.Conn, hints []interface{}) error {
+	return s.HandleConnContext(context.Background(), c, hints)
+}
+
+// HandleConnContext runs a connection through protocol detection and handling
+// as needed, passing the context on to the selected protocol.
+//
+// Matches are ranked by priority, then confidence, then the length of the
+// match, and finally registration order. The best match is used as soon as no
+// undecided candidate could outrank it, meaning that a match with
+// ConfidenceCertain only waits for candidates with a higher priority. If no
+// candidate has a higher priority, such a match is used immediately, without
+// calling the remaining candidates, keeping the first-match-wins behaviour of
+// Protocol.
+// Otherwise, it is used once the other candidates give up or exceed their
+// lookahead, or no more data arrives within DecisionTimeout. Server.Explain
+// reports the outcome for a header.
+//
+// The prefixes of StaticProtocols are matched as a group using a shared prefix
+// tree, stepping only through newly read bytes, while other protocols are only
+// called once the amount of bytes they requested is available. The header
+// buffer starts at BytesToCheck, and grows as needed by protocols implementing
+// Lookahead, up to MaxBytesToCheck.
+//
+// If no protocol matches, the DefaultProtocol is given the connection along
+// with any read error. Without a DefaultProtocol, the connection is closed,
+// returning the read error, or if there was none, ErrLookaheadExceeded or
+// ErrGreedyHandler if the last candidate to be removed requested more than its
+// own or the global limit.
+func (s *Server) HandleConnContext(ctx context.Context, c net.Conn, hints []interface{}) error {
+	return s.handleConn(ctx, c, hints, true)
+}
+
+// handleConn runs the protocol detection, with accepted being set for
+// connections not returned as a transport by a protocol.
+func (s *Server) handleConn(ctx context.Context, c net.Conn, hints []interface{}, accepted bool) error {
 	var (
-		err      error
-		n        int
-		header   = make([]byte, 0, s.BytesToCheck)
-		handlers = make([]Protocol, len(s.Protocols))
+		err     error
+		evicted error
+		n       int
+		header  = make([]byte, 0, s.initialBytesToCheck())
+		best    *match
+
+		d     = s.dispatcher()
+		node  = d.root
+		depth int
+		stats *DetectionStats
 	)
 
+	if s.Profile != nil {
+		stats = &DetectionStats{
+			Checks:  make([]int, len(d.candidates)),
+			Evicted: make([]error, len(d.candidates)),
+		}
+		defer func() { s.Profile(c, *stats) }()
+	}
+
+	if err = ctx.Err(); err != nil {
+		c.Close()
+		return err
+	}
+
+	// The dynamic handlers are copied into a pooled buffer, which is returned
+	// once detection is done.
+	pooled := d.getHandlers()
+	handlers := *pooled
+
+	for _, index := range node.over {
+		// Static handlers with prefixes longer than they may request cannot
+		// match.
+		evicted = s.evict(&d.candidates[index], node.below[index], stats)
+	}
+	if !node.undecided() {
+		node = nil
+	}
+
 	if hints == nil {
 		hints = make([]interface{}, 0)
 	}
 
-	copy(handlers, s.Protocols)
+	// The IdleProtocol is used if nothing arrives on an accepted connection
+	// before the deadline.
+	var idleDeadline time.Time
+	if accepted && s.IdleProtocol != nil && s.IdleTimeout > 0 {
+		idleDeadline = time.Now().Add(s.IdleTimeout)
+	}
 
 	// This loop runs until we are out of candidate handlers, or until a handler
 	// is selected.
-	for len(handlers) > 0 {
-		// Read the required data
-		n, err = c.Read(header[len(header):cap(header)])
+	for len(handlers) > 0 || node.undecided() {
+		idle := !idleDeadline.IsZero() && len(header) == 0
+		pending := best != nil && s.DecisionTimeout > 0
+		switch {
+		case pending:
+			c.SetReadDeadline(time.Now().Add(s.DecisionTimeout))
+		case idle:
+			c.SetReadDeadline(idleDeadline)
+		}
+
+		// Read the required data, growing the header buffer if needed
+		want, largest := smallestNeeded(handlers, node, len(header))
+		if want > largest {
+			// The remaining handlers cannot be given more
+			break
+		}
+		if want > cap(header) {
+			size := 2 * cap(header)
+			if size < want {
+				size = want
+			}
+			if size > largest {
+				size = largest
+			}
+			header = append(make([]byte, 0, size), header...)
+		}
+
+		limit := cap(header)
+		if s.ReadPolicy == ReadExact {
+			limit = want
+		}
+
+		n, err = c.Read(header[len(header):limit])
 		header = header[:len(header)+n]
+		if stats != nil {
+			stats.Reads++
+		}
+
+		if idle || pending {
+			c.SetReadDeadline(time.Time{})
+
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if idle && n == 0 {
+					// The client is waiting for the server to speak first
+					d.putHandlers(pooled)
+					s.handle(ctx, AdaptProtocol(s.IdleProtocol), c, hints, nil, nil, nil)
+					return nil
+				}
+				if pending && n == 0 {
+					// The client is waiting for a reply to what it sent
+					err = nil
+					break
+				}
+				err = nil
+			}
+		}
 
 		if n == 0 && err == nil {
 			// Nothing read, but connection isn't dead yet
@@ -132,53 +359,124 @@ func (s *Server) HandleConn(c net.Conn, hints []interface{}) error {
 			break
 		}
 
-		// We run the current data through all candidate handlers.
-		for i := 0; i < len(handlers); i++ {
-			handler := handlers[i]
+		if len(header) < want && err == nil {
+			// No handler has what it asked for yet
+			continue
+		}
+
+		if stats != nil {
+			stats.Rounds++
+		}
+
+		// The static handlers are followed through the prefix tree as a
+		// group, only stepping over the newly read bytes.
+		if node != nil {
+			next, found := d.step(node, header, depth)
+			depth = len(header)
+
+			if found != -1 {
+				best = d.rank(best, newMatch(d.candidates[found], Matched(ConfidenceCertain, nil), len(header)))
+			}
+			if next != nil {
+				for _, index := range next.over {
+					if !node.overAt(index) {
+						evicted = s.evict(&d.candidates[index], next.below[index], stats)
+					}
+				}
+			}
 
-			ok, required := handler.Check(header, hints)
+			node = next
+			if !node.undecided() {
+				node = nil
+			}
+		}
+
+		// We run the current data through the dynamic handlers that have
+		// enough of it. Remaining handlers are moved to the front, only
+		// copying them once others have been removed.
+		unbeaten := best != nil && best.unbeaten(d.maxPriority)
+		remaining := 0
+		for i := range handlers {
+			handler := &handlers[i]
+			if unbeaten && handler.index > best.index {
+				// Nothing can outrank the match, so the remaining handlers
+				// need not be called.
+				break
+			}
+
+			if len(header) < handler.needed && handler.needed <= handler.limit {
+				if remaining != i {
+					handlers[remaining] = *handler
+				}
+				remaining++
+				if stats != nil {
+					stats.Skipped++
+				}
+				continue
+			}
+
+			result := handler.protocol.Detect(header, hints)
+			if stats != nil {
+				stats.Checks[handler.index]++
+			}
+
+			required := result.Needed
 			switch {
-			case ok:
-				// THe handler accepted the connection
-				s.handle(handler, c, hints, header, err)
-				return nil
-			case required == 0:
+			case result.Status == Match:
+				// The handler accepted the connection, but others may outrank
+				// it.
+				best = d.rank(best, newMatch(*handler, result, len(header)))
+				unbeaten = best.unbeaten(d.maxPriority)
+			case result.Status == NoMatch, required == 0:
 				// The handler is sure that it doesn't match, so remove it.
 			case required <= len(header):
 				// The handler is broken, requesting less than we already gave it, so
 				// we remove it.
 				if s.Logger != nil {
 					s.Logger("Handler %v is requesting %d bytes, but already read %d bytes. Skipping.",
-						handler, required, len(header))
+						handler.protocol, required, len(header))
 				}
 
-			case required > s.BytesToCheck:
-				// The handler is being greedy, so we remove it.
-				if s.Logger != nil {
-					s.Logger("Handler %v is requesting %d bytes, but maximum read size set to %d. Skipping.",
-						handler, required, s.BytesToCheck)
-				}
+			case required > handler.limit:
+				// The handler is requesting more than it may, so we remove it.
+				evicted = s.evict(handler, required, stats)
 
 			default:
-				// The handler is not certain, so we leave it be.
-				continue
+				// The handler is not certain, so we leave it be until it has
+				// what it asked for.
+				handler.needed = required
+				if remaining != i {
+					handlers[remaining] = *handler
+				}
+				remaining++
 			}
+		}
+		handlers = handlers[:remaining]
 
-			handlers = append(handlers[:i], handlers[i+1:]...)
-			i--
-
+		if unbeaten || best != nil && !best.contested(handlers, node) {
+			break
 		}
 	}
+	d.putHandlers(pooled)
+
+	if best != nil {
+		s.handle(ctx, best.protocol, c, hints, header, err, best.result.Metadata)
+		return nil
+	}
 
-	if err != nil && s.Logger != nil {
-		s.Logger("Protocol detection failure: %v", err)
+	if s.Logger != nil {
+		if err != nil {
+			s.Logger("Protocol detection failure: %v", err)
+		} else if evicted != nil {
+			s.Logger("Protocol detection failure: %v", evicted)
+		}
 	}
 
 	if s.DefaultProtocol != nil {
 		if s.Logger != nil {
 			s.Logger("Defaulting %v: [%q]", c.RemoteAddr(), header)
 		}
-		s.handle(s.DefaultProtocol, c, hints, header, err)
+		s.handle(ctx, AdaptProtocol(s.DefaultProtocol), c, hints, header, err, nil)
 		return nil
 	}
 
@@ -188,11 +486,85 @@ func (s *Server) HandleConn(c net.Conn, hints []interface{}) error {
 	}
 
 	c.Close()
+	if err == nil {
+		err = evicted
+	}
 	return err
 }
 
+// smallestNeeded returns the smallest amount of bytes requested by the
+// handlers and the static handlers below the node, being at least one more
+// than already read, and the largest amount of bytes any of them may request.
+// Handlers requesting more than they may are called as soon as possible, to be
+// removed.
+func smallestNeeded(handlers []candidate, node *prefixNode, read int) (smallest, largest int) {
+	if node.undecided() {
+		smallest, largest = node.needed, node.largest
+	}
+	for _, handler := range handlers {
+		needed := handler.needed
+		if needed <= read || needed > handler.limit {
+			needed = read + 1
+		}
+		if smallest == 0 || needed < smallest {
+			smallest = needed
+		}
+		if handler.limit > largest {
+			largest = handler.limit
+		}
+	}
+	return smallest, largest
+}
+
+// evict logs the removal of a handler requesting more than its limit, and
+// returns the error describing it: ErrLookaheadExceeded if the handler
+// requested more than it declared, and otherwise ErrGreedyHandler.
+func (s *Server) evict(handler *candidate, required int, stats *DetectionStats) error {
+	err := ErrGreedyHandler
+	if handler.declared && handler.limit < s.maxBytesToCheck() {
+		err = ErrLookaheadExceeded
+	}
+	if stats != nil {
+		stats.Evicted[handler.index] = err
+	}
+
+	if s.Logger != nil {
+		if err == ErrLookaheadExceeded {
+			s.Logger("Handler %v is requesting %d bytes, but its lookahead is %d. Skipping.",
+				handler.protocol, required, handler.limit)
+		} else {
+			s.Logger("Handler %v is requesting %d bytes, but maximum read size set to %d. Skipping.",
+				handler.protocol, required, handler.limit)
+		}
+	}
+	return err
+}
+
+// initialBytesToCheck returns the initial size of the header buffer.
+func (s *Server) initialBytesToCheck() int {
+	if max := s.maxBytesToCheck(); max < s.BytesToCheck {
+		return max
+	}
+	return s.BytesToCheck
+}
+
 // Serve accepts connections on a listener, handling them as appropriate.
 func (s *Server) Serve(l net.Listener) error {
+	return s.ServeContext(context.Background(), l)
+}
+
+// ServeContext accepts connections on a listener, handling them as
+// appropriate. The listener is closed when the context is done, and the
+// context given to protocols is cancelled when ServeContext returns.
+func (s *Server) ServeContext(ctx context.Context, l net.Listener) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
 	if s.Logger != nil {
 		s.Logger("Serving %d protocols:", len(s.Protocols))
 
@@ -204,11 +576,14 @@ func (s *Server) Serve(l net.Listener) error {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return err
 		}
 
 		go func() {
-			s.HandleConn(conn, nil)
+			s.HandleConnContext(ctx, conn, nil)
 		}()
 	}
 }
@@ -216,7 +591,9 @@ func (s *Server) Serve(l net.Listener) error {
 // New returns a new Server.
 func New() *Server {
 	return &Server{
-		BytesToCheck: DefaultBytesToCheck,
-		Logger:       nil,
+		BytesToCheck:    DefaultBytesToCheck,
+		MaxBytesToCheck: DefaultMaxBytesToCheck,
+		DecisionTimeout: DefaultDecisionTimeout,
+		Logger:          nil,
 	}
 }
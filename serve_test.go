@@ -0,0 +1,270 @@
+package serve2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/serve2/utils"
+)
+
+type contextKey struct{}
+
+// testProtocol matches a prefix with the provided confidence, reporting the
+// name and hints of the connections it handles.
+type testProtocol struct {
+	name       string
+	prefix     []byte
+	confidence int
+	metadata   interface{}
+	handled    chan *testProtocol
+	hints      []interface{}
+	ctx        context.Context
+}
+
+func (p *testProtocol) String() string {
+	return p.name
+}
+
+func (p *testProtocol) Detect(header []byte, _ []interface{}) Result {
+	switch {
+	case len(header) < len(p.prefix):
+		if !bytes.HasPrefix(p.prefix, header) {
+			return NotMatched()
+		}
+		return NeedBytes(len(p.prefix))
+	case bytes.HasPrefix(header, p.prefix):
+		return Matched(p.confidence, p.metadata)
+	default:
+		return NotMatched()
+	}
+}
+
+func (p *testProtocol) HandleContext(ctx context.Context, c net.Conn) (net.Conn, error) {
+	p.hints = utils.GetHints(c)
+	p.ctx = ctx
+	p.handled <- p
+	return nil, nil
+}
+
+// legacyProtocol matches a prefix using the Protocol interface.
+type legacyProtocol struct {
+	testProtocol
+}
+
+func (p *legacyProtocol) Check(header []byte, hints []interface{}) (bool, int) {
+	r := p.Detect(header, hints)
+	return r.Status == Match, r.Needed
+}
+
+func (p *legacyProtocol) Handle(c net.Conn) (net.Conn, error) {
+	return p.HandleContext(context.Background(), c)
+}
+
+func serveOne(t *testing.T, s *Server, ctx context.Context, payload string, handled chan *testProtocol) *testProtocol {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go s.HandleConnContext(ctx, server, nil)
+	go client.Write([]byte(payload))
+
+	select {
+	case p := <-handled:
+		return p
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %q to be handled", payload)
+	}
+	return nil
+}
+
+func TestLegacyFirstMatch(t *testing.T) {
+	handled := make(chan *testProtocol, 1)
+	s := New()
+	s.AddHandlers(
+		&legacyProtocol{testProtocol{name: "short", prefix: []byte("GE"), handled: handled}},
+		&legacyProtocol{testProtocol{name: "long", prefix: []byte("GET"), handled: handled}},
+	)
+
+	if p := serveOne(t, s, context.Background(), "GET / HTTP/1.1\r\n", handled); p.name != "short" {
+		t.Errorf("handled by %s, expected short", p.name)
+	}
+}
+
+func TestProtocolsField(t *testing.T) {
+	handled := make(chan *testProtocol, 1)
+	s := New()
+	s.Protocols = []Protocol{
+		&legacyProtocol{testProtocol{name: "legacy", prefix: []byte("GET"), handled: handled}},
+	}
+	s.AddProtocol(&testProtocol{name: "v2", prefix: []byte("POST"), confidence: ConfidenceCertain, handled: handled})
+
+	tests := []struct {
+		payload string
+		name    string
+	}{
+		{"GET / HTTP/1.1\r\n", "legacy"},
+		{"POST / HTTP/1.1\r\n", "v2"},
+	}
+
+	for _, test := range tests {
+		if p := serveOne(t, s, context.Background(), test.payload, handled); p.name != test.name {
+			t.Errorf("%q handled by %s, expected %s", test.payload, p.name, test.name)
+		}
+	}
+}
+
+func TestConfidence(t *testing.T) {
+	handled := make(chan *testProtocol, 1)
+	s := New()
+	s.AddProtocol(&testProtocol{name: "likely", prefix: []byte("OPTIONS"), confidence: ConfidenceLikely, handled: handled})
+	s.AddProtocol(&testProtocol{name: "unlikely", prefix: []byte("OPT"), confidence: ConfidenceLikely - 1, handled: handled})
+	s.AddProtocol(&testProtocol{name: "certain", prefix: []byte("OPTIONS rtsp"), confidence: ConfidenceCertain, metadata: "rtsp", handled: handled})
+
+	tests := []struct {
+		payload string
+		name    string
+	}{
+		{"OPTIONS rtsp://example.com RTSP/1.0\r\n", "certain"},
+		{"OPTIONS * HTTP/1.1\r\n", "likely"},
+		{"OPTX", "unlikely"},
+	}
+
+	for _, test := range tests {
+		p := serveOne(t, s, context.Background(), test.payload, handled)
+		if p.name != test.name {
+			t.Errorf("%q handled by %s, expected %s", test.payload, p.name, test.name)
+		}
+	}
+}
+
+func TestDecisionTimeout(t *testing.T) {
+	handled := make(chan *testProtocol, 1)
+	s := New()
+	s.AddProtocol(&testProtocol{name: "likely", prefix: []byte("OPT"), confidence: ConfidenceLikely, handled: handled})
+	s.AddProtocol(&testProtocol{name: "certain", prefix: []byte("OPTIONS rtsp"), confidence: ConfidenceCertain, handled: handled})
+
+	// The client stops after a partial line, so the pending match is used.
+	if p := serveOne(t, s, context.Background(), "OPTIONS", handled); p.name != "likely" {
+		t.Errorf("handled by %s, expected likely", p.name)
+	}
+}
+
+// transportProtocol matches a prefix, returning the rest of the connection as
+// a transport.
+type transportProtocol struct {
+	testProtocol
+}
+
+func (p *transportProtocol) HandleContext(_ context.Context, c net.Conn) (net.Conn, error) {
+	_, err := io.ReadFull(c, make([]byte, len(p.prefix)))
+	return c, err
+}
+
+func TestIdleProtocol(t *testing.T) {
+	handled := make(chan *testProtocol, 1)
+	s := New()
+	s.IdleProtocol = &legacyProtocol{testProtocol{name: "idle", handled: handled}}
+	s.IdleTimeout = 20 * time.Millisecond
+	s.AddProtocol(&transportProtocol{testProtocol{name: "transport", prefix: []byte("T"), confidence: ConfidenceCertain}})
+	s.AddProtocol(&testProtocol{name: "inner", prefix: []byte("GET"), confidence: ConfidenceCertain, handled: handled})
+
+	if p := serveOne(t, s, context.Background(), "", handled); p.name != "idle" {
+		t.Errorf("silent connection handled by %s, expected idle", p.name)
+	}
+
+	// The transport is silent for longer than IdleTimeout, which must not
+	// make it idle.
+	server, client := net.Pipe()
+	defer client.Close()
+	go s.HandleConn(server, nil)
+	go func() {
+		client.Write([]byte("T"))
+		time.Sleep(3 * s.IdleTimeout)
+		client.Write([]byte("GET"))
+	}()
+
+	select {
+	case p := <-handled:
+		if p.name != "inner" {
+			t.Errorf("silent transport handled by %s, expected inner", p.name)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the transport to be handled")
+	}
+}
+
+func TestMetadataAndContext(t *testing.T) {
+	handled := make(chan *testProtocol, 1)
+	s := New()
+	s.AddProtocol(&testProtocol{name: "meta", prefix: []byte("META"), confidence: ConfidenceCertain, metadata: "parsed", handled: handled})
+
+	ctx := context.WithValue(context.Background(), contextKey{}, "value")
+	p := serveOne(t, s, ctx, "META", handled)
+
+	if len(p.hints) != 1 || p.hints[0] != "parsed" {
+		t.Errorf("hints were %v, expected [parsed]", p.hints)
+	}
+	if p.ctx.Value(contextKey{}) != "value" {
+		t.Errorf("context not passed to protocol")
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	s := New()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	if err := s.HandleConnContext(ctx, server, nil); err != context.Canceled {
+		t.Errorf("handling returned %v, expected %v", err, context.Canceled)
+	}
+}
+
+func TestReadPolicy(t *testing.T) {
+	tests := []struct {
+		policy  ReadPolicy
+		chunk   int
+		reads   []int
+		rounds  int
+		checks  []int
+		skipped int
+	}{
+		{ReadExact, 16, []int{4}, 1, []int{1, 0}, 0},
+		{ReadExact, 2, []int{4, 2}, 1, []int{1, 0}, 0},
+		{ReadAvailable, 16, []int{DefaultBytesToCheck}, 1, []int{1, 0}, 0},
+		{ReadAvailable, 2, []int{DefaultBytesToCheck, DefaultBytesToCheck - 2}, 1, []int{1, 0}, 0},
+	}
+
+	for _, test := range tests {
+		handled := make(chan *testProtocol, 1)
+		s := New()
+		s.ReadPolicy = test.policy
+		s.AddHandlers(
+			&legacyProtocol{testProtocol{name: "short", prefix: []byte("ABCD"), confidence: ConfidenceCertain, handled: handled}},
+			&legacyProtocol{testProtocol{name: "long", prefix: []byte("ABCDEFGH"), confidence: ConfidenceCertain, handled: handled}},
+		)
+
+		var stats DetectionStats
+		s.Profile = func(_ net.Conn, s DetectionStats) { stats = s }
+
+		c := &benchConn{r: bytes.NewReader([]byte("ABCDEFGHIJ")), chunk: test.chunk, reads: []int{}}
+		s.HandleConn(c, nil)
+
+		if p := <-handled; p.name != "short" {
+			t.Errorf("policy %d, chunk %d: handled by %s, expected short", test.policy, test.chunk, p.name)
+		}
+		if fmt.Sprint(c.reads) != fmt.Sprint(test.reads) {
+			t.Errorf("policy %d, chunk %d: reads were %v, expected %v", test.policy, test.chunk, c.reads, test.reads)
+		}
+		if stats.Reads != len(test.reads) || stats.Rounds != test.rounds ||
+			fmt.Sprint(stats.Checks) != fmt.Sprint(test.checks) || stats.Skipped != test.skipped {
+			t.Errorf("policy %d, chunk %d: stats were %+v", test.policy, test.chunk, stats)
+		}
+	}
+}
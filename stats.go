@@ -0,0 +1,36 @@
+package serve2
+
+// DetectionStats counts the work done detecting the protocol of a connection,
+// for profiling the registered protocols.
+type DetectionStats struct {
+	// Reads is the amount of reads from the connection.
+	Reads int
+
+	// Rounds is the amount of times the header was run through the
+	// protocols, which happens once enough has been read for one of them.
+	Rounds int
+
+	// Checks holds the amount of calls to Detect or Check of each protocol,
+	// in registration order. StaticProtocols are never called.
+	Checks []int
+
+	// Skipped is the amount of times a protocol was not called, as it had
+	// requested more bytes than had been read.
+	Skipped int
+
+	// Evicted holds, in registration order, ErrLookaheadExceeded for
+	// protocols removed for requesting more than their Lookahead, and
+	// ErrGreedyHandler for protocols removed for requesting more than
+	// BytesToCheck or MaxBytesToCheck.
+	Evicted []error
+}
+
+// TotalChecks returns the amount of calls to Detect or Check of all
+// protocols.
+func (s DetectionStats) TotalChecks() int {
+	var total int
+	for _, checks := range s.Checks {
+		total += checks
+	}
+	return total
+}
@@ -35,7 +35,7 @@ func NewHintConn(c net.Conn, hints []interface{}) *HintConn {
 }
 
 // GetHints is a convenience function for retrieving hints from a net.Conn if
-// available, otherwise returning nil.
+// available, otherwise returning nil. See HintsOf for the typed equivalent.
 func GetHints(c net.Conn) []interface{} {
 	if hintedConn, ok := c.(HintedConn); ok {
 		return hintedConn.Hints()
@@ -63,6 +63,11 @@ func (c *ProxyConn) SetHints(hints []interface{}) {
 	c.hints = hints
 }
 
+// Buffered returns the amount of buffered bytes that have not been read yet.
+func (c *ProxyConn) Buffered() int {
+	return len(c.buffer)
+}
+
 // Read reads data from the connection.  If buffer is available, it will try to
 // serve the request from the buffer alone. If the buffer is empty, it simply
 // calls read.
@@ -121,6 +126,12 @@ func DialAndProxyTLS(a net.Conn, proto, dest string, config *tls.Config) error {
 	return nil
 }
 
+// Proxy takes a net.Conn "a" and a net.Conn "b", and forwards traffic between
+// the connections, closing both when either side is done.
+func Proxy(a net.Conn, b net.Conn) {
+	proxy(a, b)
+}
+
 // proxy takes a net.Conn "a" and a net.Conn "b", and forwards traffic between
 // the connections.
 func proxy(a net.Conn, b net.Conn) {
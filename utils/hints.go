@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Hints is the list of hints about a connection, in the order they were
+// added. As transports add their hints when unwrapping a connection, later
+// hints describe inner layers, and the last hints are the nearest to the
+// connection being inspected.
+//
+// Hints has the same underlying type as []interface{}, so it can be passed to
+// and from Check and HintedConn as is.
+type Hints []interface{}
+
+// HintsOf retrieves the hints from a net.Conn if available, otherwise
+// returning nil.
+func HintsOf(c net.Conn) Hints {
+	return GetHints(c)
+}
+
+// Add returns the hints with the hint appended. The result never shares its
+// backing array with h, so hints given to different connections can be
+// extended independently.
+func (h Hints) Add(hint interface{}) Hints {
+	n := make(Hints, len(h), len(h)+1)
+	copy(n, h)
+	return append(n, hint)
+}
+
+// Find returns the nearest hint accepted by match, or nil if none are.
+func (h Hints) Find(match func(interface{}) bool) interface{} {
+	for i := len(h) - 1; i >= 0; i-- {
+		if match(h[i]) {
+			return h[i]
+		}
+	}
+	return nil
+}
+
+type connectionStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// ConnectionState returns the state of the nearest TLS transport, which is
+// either a hint implementing ConnectionState, such as a *tls.Conn, or a
+// tls.ConnectionState.
+func (h Hints) ConnectionState() (tls.ConnectionState, bool) {
+	switch hint := h.Find(func(hint interface{}) bool {
+		switch hint.(type) {
+		case connectionStater, tls.ConnectionState, *tls.ConnectionState:
+			return true
+		}
+		return false
+	}).(type) {
+	case connectionStater:
+		return hint.ConnectionState(), true
+	case tls.ConnectionState:
+		return hint, true
+	case *tls.ConnectionState:
+		return *hint, true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// Transports returns the transport stack, from the outermost transport
+// inwards. Transports record themselves by adding the net.Conn they unwrapped
+// the connection into as a hint, such as the *tls.Conn for TLS.
+func (h Hints) Transports() []net.Conn {
+	var transports []net.Conn
+	for _, hint := range h {
+		if c, ok := hint.(net.Conn); ok {
+			transports = append(transports, c)
+		}
+	}
+	return transports
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func TestHintsAdd(t *testing.T) {
+	h := make(Hints, 1, 4)
+	h[0] = "outer"
+
+	a := h.Add("a")
+	b := h.Add("b")
+	if len(h) != 1 || a[1] != "a" || b[1] != "b" {
+		t.Errorf("Unexpected result. Add shared hints: %v, %v", a, b)
+	}
+}
+
+func TestHintsLookup(t *testing.T) {
+	var (
+		c1, c2 = net.Pipe()
+		outer  = tls.Client(c1, &tls.Config{})
+		inner  = tls.ConnectionState{ServerName: "inner"}
+	)
+	defer c1.Close()
+	defer c2.Close()
+
+	var h Hints
+	if _, ok := h.ConnectionState(); ok {
+		t.Errorf("Unexpected result. Found a ConnectionState without hints")
+	}
+
+	h = h.Add("proxy").Add(outer).Add(inner).Add("websocket")
+
+	if cs, ok := h.ConnectionState(); !ok || cs.ServerName != "inner" {
+		t.Errorf("Unexpected result. ConnectionState returned %v, %v", cs.ServerName, ok)
+	}
+	if hint := h.Find(func(hint interface{}) bool { return hint == "proxy" }); hint != "proxy" {
+		t.Errorf("Unexpected result. Find returned %v", hint)
+	}
+	if transports := h.Transports(); len(transports) != 1 || transports[0] != outer {
+		t.Errorf("Unexpected result. Transports returned %v", transports)
+	}
+}
+
+func TestHintsOf(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	if h := HintsOf(c1); h != nil {
+		t.Errorf("Unexpected result. HintsOf returned %v", h)
+	}
+
+	hc := NewHintConn(c1, Hints{"hint"})
+	if h := HintsOf(hc); len(h) != 1 || h[0] != "hint" {
+		t.Errorf("Unexpected result. HintsOf returned %v", h)
+	}
+}